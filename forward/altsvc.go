@@ -0,0 +1,44 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StripAltSvc removes the Alt-Svc header from the responses. The alternative services advertised by the
+// backends, e.g. their HTTP/3 endpoints, are usually not reachable by the clients of the proxy, which
+// would otherwise try them and fall back to the proxy after a timeout. The header is passed through
+// by default.
+func StripAltSvc() optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.overrideAltSvc = true
+		f.httpForwarder.altSvc = ""
+		return nil
+	}
+}
+
+// RewriteAltSvc replaces the Alt-Svc header of the responses with value, e.g. `h3=":443"; ma=86400` to
+// advertise the HTTP/3 endpoint of the proxy itself. The value is set whether or not the backend
+// advertised alternative services.
+func RewriteAltSvc(value string) optSetter {
+	return func(f *Forwarder) error {
+		if value == "" {
+			return fmt.Errorf("Alt-Svc can't be empty, use StripAltSvc to remove the header")
+		}
+		f.httpForwarder.overrideAltSvc = true
+		f.httpForwarder.altSvc = value
+		return nil
+	}
+}
+
+// setAltSvc strips or rewrites the Alt-Svc header of the response as configured
+func (f *httpForwarder) setAltSvc(h http.Header) {
+	if !f.overrideAltSvc {
+		return
+	}
+	if f.altSvc == "" {
+		h.Del(AltSvc)
+		return
+	}
+	h.Set(AltSvc, f.altSvc)
+}
@@ -0,0 +1,81 @@
+package forward
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RequestAuthorizer decides whether a request is forwarded. It is called before any other check, for
+// the plain requests and the websocket upgrades alike.
+type RequestAuthorizer interface {
+	// Authorize returns nil to forward the request. An error with a StatusCode() int method, such as
+	// *StatusError, is replied with its status code, the other errors with 403 Forbidden.
+	Authorize(req *http.Request) error
+}
+
+// Authorizer forwards only the requests the authorizer accepts, the rejected ones are replied through
+// the error handler. The 401 Unauthorized replies carry a WWW-Authenticate header when the authorizer
+// has a Challenge() string method, as BearerTokenAuthorizer does.
+func Authorizer(a RequestAuthorizer) optSetter {
+	return func(f *Forwarder) error {
+		if a == nil {
+			return fmt.Errorf("authorizer can't be nil")
+		}
+		f.authorizer = a
+		return nil
+	}
+}
+
+// BearerTokenAuthorizer accepts the requests carrying one of the tokens in their Authorization header,
+// e.g. "Authorization: Bearer <token>". It is a reference implementation for static tokens, the tokens
+// are compared in constant time.
+type BearerTokenAuthorizer struct {
+	Tokens []string
+}
+
+// Authorize replies 401 when the token is missing and 403 when it is unknown
+func (b *BearerTokenAuthorizer) Authorize(req *http.Request) error {
+	header := req.Header.Get(Authorization)
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return &StatusError{Code: http.StatusUnauthorized, Reason: "missing bearer token"}
+	}
+	token := []byte(header[len(prefix):])
+	valid := 0
+	for _, t := range b.Tokens {
+		valid |= subtle.ConstantTimeCompare(token, []byte(t))
+	}
+	if valid == 0 {
+		return &StatusError{Code: http.StatusForbidden, Reason: "invalid bearer token"}
+	}
+	return nil
+}
+
+// Challenge is the WWW-Authenticate value of the 401 replies
+func (b *BearerTokenAuthorizer) Challenge() string {
+	return "Bearer"
+}
+
+// rejectUnauthorized replies with the status of the authorizer error when the request is not authorized
+func (f *Forwarder) rejectUnauthorized(w http.ResponseWriter, req *http.Request) bool {
+	err := f.authorizer.Authorize(req)
+	if err == nil {
+		return false
+	}
+	code := http.StatusForbidden
+	if sc, ok := err.(interface{ StatusCode() int }); ok {
+		code = sc.StatusCode()
+	}
+	f.log.Infof("Rejecting request to %v with %v: %v", req.URL, code, err)
+	if c, ok := f.authorizer.(interface{ Challenge() string }); ok && code == http.StatusUnauthorized {
+		w.Header().Set(WWWAuthenticate, c.Challenge())
+	}
+	se, ok := err.(*StatusError)
+	if !ok {
+		se = &StatusError{Code: code, Reason: err.Error()}
+	}
+	f.errHandler.ServeHTTP(w, req, se)
+	return true
+}
@@ -0,0 +1,23 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+)
+
+type headersKey struct{}
+
+// WithHeaders returns a copy of the request setting the headers on the request forwarded to the
+// backend, e.g. the headers specific to the backend picked by the load balancer. They replace the
+// client headers of the same name. A nil header removes the headers set by a previous call.
+func WithHeaders(req *http.Request, h http.Header) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), headersKey{}, h))
+}
+
+// setHeaders sets the headers passed with WithHeaders on the forwarded request
+func setHeaders(outReq *http.Request, req *http.Request) {
+	h, _ := req.Context().Value(headersKey{}).(http.Header)
+	for k, vv := range h {
+		outReq.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), vv...)
+	}
+}
@@ -0,0 +1,83 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// defaultCopyBufferSize is the size of the buffers io.Copy allocates
+const defaultCopyBufferSize = 32 * 1024
+
+// BufferPoolTiers copies the response bodies with pooled buffers of the given sizes, e.g. 4KB, 32KB and
+// 256KB, instead of allocating a 32KB buffer per response. The smallest buffer holding the whole body is
+// used when the response has a Content-Length, the largest one when the body is bigger than all of them.
+// The responses of unknown length use the smallest buffer of at least 32KB, or the largest buffer if
+// none is that big.
+func BufferPoolTiers(sizes ...int) optSetter {
+	return func(f *Forwarder) error {
+		if len(sizes) == 0 {
+			return fmt.Errorf("buffer pool needs at least one tier")
+		}
+		for _, size := range sizes {
+			if size <= 0 {
+				return fmt.Errorf("buffer pool tiers should be > 0, got %v", size)
+			}
+		}
+		f.httpForwarder.buffers = newBufferPool(sizes)
+		return nil
+	}
+}
+
+// bufferPool pools the copy buffers in tiers of increasing sizes
+type bufferPool struct {
+	sizes []int
+	tiers []sync.Pool
+}
+
+func newBufferPool(sizes []int) *bufferPool {
+	sorted := append([]int(nil), sizes...)
+	sort.Ints(sorted)
+	p := &bufferPool{}
+	for i, size := range sorted {
+		if i > 0 && size == sorted[i-1] {
+			continue
+		}
+		p.sizes = append(p.sizes, size)
+	}
+	p.tiers = make([]sync.Pool, len(p.sizes))
+	for i := range p.tiers {
+		size := p.sizes[i]
+		p.tiers[i].New = func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+	return p
+}
+
+// tier returns the index of the tier copying a body of length bytes, length is -1 when unknown
+func (p *bufferPool) tier(length int64) int {
+	want := length
+	if length < 0 {
+		want = defaultCopyBufferSize
+	}
+	for i, size := range p.sizes {
+		if int64(size) >= want {
+			return i
+		}
+	}
+	return len(p.sizes) - 1
+}
+
+// copy copies src to dst with a buffer of the tier fitting length. A nil pool falls back to io.Copy.
+func (p *bufferPool) copy(dst io.Writer, src io.Reader, length int64) (int64, error) {
+	if p == nil {
+		return io.Copy(dst, src)
+	}
+	i := p.tier(length)
+	buf := p.tiers[i].Get().(*[]byte)
+	defer p.tiers[i].Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,80 @@
+package forward
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// ChaosLatency delays a sampled fraction of requests by the given duration before forwarding them.
+// It is meant for resilience testing, e.g. to validate client timeouts and retries against a real proxy.
+// Probability of 0 disables the delay.
+func ChaosLatency(probability float64, delay time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if err := validateProbability(probability); err != nil {
+			return err
+		}
+		f.chaos.latencyProbability = probability
+		f.chaos.latency = delay
+		return nil
+	}
+}
+
+// ChaosAbort replies with the given status code to a sampled fraction of requests instead of forwarding them,
+// simulating backend failures. The response is rendered by the error handler, so custom error pages apply.
+// Probability of 0 disables the fault.
+func ChaosAbort(probability float64, statusCode int) optSetter {
+	return func(f *Forwarder) error {
+		if err := validateProbability(probability); err != nil {
+			return err
+		}
+		if statusCode < 100 || statusCode > 599 {
+			return fmt.Errorf("invalid status code: %v", statusCode)
+		}
+		f.chaos.abortProbability = probability
+		f.chaos.abortStatus = statusCode
+		return nil
+	}
+}
+
+// chaos holds the fault injection settings of the forwarder
+type chaos struct {
+	latencyProbability float64
+	latency            time.Duration
+
+	abortProbability float64
+	abortStatus      int
+}
+
+// injectLatency sleeps for the configured delay if the request was sampled. It returns false
+// if the client went away while waiting and the request should not be forwarded.
+func (c *chaos) injectLatency(req *http.Request, clock timetools.TimeProvider) bool {
+	if !sampled(c.latencyProbability) {
+		return true
+	}
+	select {
+	case <-clock.After(c.latency):
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+// abort tells whether the request was sampled to be aborted
+func (c *chaos) abort() bool {
+	return sampled(c.abortProbability)
+}
+
+func sampled(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
+
+func validateProbability(probability float64) error {
+	if probability < 0 || probability > 1 {
+		return fmt.Errorf("probability should be in range [0, 1], got %v", probability)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package forward
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FwdSuite) TestChaosLatency(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	delay := 20 * time.Millisecond
+	f, err := New(ChaosLatency(0.3, delay))
+	c.Assert(err, IsNil)
+
+	requests, delayed := 100, 0
+	for i := 0; i < requests; i++ {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		c.Assert(err, IsNil)
+		req.RequestURI = "/"
+		start := time.Now()
+		rw := httptest.NewRecorder()
+		f.ServeHTTP(rw, req)
+		c.Assert(rw.Code, Equals, http.StatusOK)
+		if time.Since(start) >= delay {
+			delayed++
+		}
+	}
+	// expected 30, standard deviation is ~4.6
+	c.Assert(delayed >= 15 && delayed <= 45, Equals, true, Commentf("delayed %v of %v", delayed, requests))
+}
+
+func (s *FwdSuite) TestChaosLatencyDisabled(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New(ChaosLatency(0, time.Hour))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hello")
+}
+
+func (s *FwdSuite) TestChaosLatencyClock(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	start := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	clock := &timetools.FreezedTime{CurrentTime: start}
+	f, err := New(ChaosLatency(1, time.Hour), Clock(clock))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(clock.UtcNow(), Equals, start.Add(time.Hour))
+}
+
+func (s *FwdSuite) TestChaosBadProbability(c *C) {
+	_, err := New(ChaosLatency(1.5, time.Second))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestChaosAbort(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New(ChaosAbort(0.3, http.StatusServiceUnavailable))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	requests, aborted := 200, 0
+	for i := 0; i < requests; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		switch re.StatusCode {
+		case http.StatusServiceUnavailable:
+			aborted++
+		case http.StatusOK:
+		default:
+			c.Fatalf("unexpected status code: %v", re.StatusCode)
+		}
+	}
+	// expected 60, standard deviation is ~6.5
+	c.Assert(aborted >= 35 && aborted <= 85, Equals, true, Commentf("aborted %v of %v", aborted, requests))
+}
+
+func (s *FwdSuite) TestChaosAbortCustomErrHandler(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New(
+		ChaosAbort(1, http.StatusServiceUnavailable),
+		ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+			w.WriteHeader(http.StatusTeapot)
+			w.Write([]byte(err.Error()))
+		})))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusTeapot)
+	c.Assert(string(body), Equals, "Service Unavailable: chaos abort")
+}
+
+func (s *FwdSuite) TestChaosAbortDisabled(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New(ChaosAbort(0, http.StatusServiceUnavailable))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 20; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+	}
+}
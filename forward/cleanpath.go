@@ -0,0 +1,96 @@
+package forward
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// CleanPath normalizes the path of the forwarded requests: duplicate slashes are collapsed
+// and dot segments are resolved, a trailing slash is kept. Escaped characters like %2F are
+// left untouched. It is off by default, as some backends tell such paths apart.
+func CleanPath(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.cleanPath = b
+		f.websocketForwarder.cleanPath = b
+		return nil
+	}
+}
+
+// NormalizePath collapses the repeated slashes in the path of the forwarded requests, e.g. "//a//b"
+// becomes "/a/b", leaving the dot segments alone, unlike CleanPath. A trailing slash is kept. It is
+// applied after the rewriter, so the paths it builds are normalized too.
+func NormalizePath(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.normalizePath = b
+		f.websocketForwarder.normalizePath = b
+		return nil
+	}
+}
+
+// normalizeURL applies CleanPath or NormalizePath to the outgoing URL
+func normalizeURL(u *url.URL, cleanPath, normalizePath bool) {
+	if cleanPath {
+		cleanURL(u, cleanEscapedPath)
+	} else if normalizePath {
+		cleanURL(u, collapseSlashes)
+	}
+}
+
+// cleanURL normalizes the path of the outgoing URL with clean. Opaque holds the request URI sent to
+// the backend when set, Path and RawPath are updated too so they stay consistent.
+func cleanURL(u *url.URL, clean func(escaped string) string) {
+	escaped, query := u.EscapedPath(), ""
+	if u.Opaque != "" {
+		// an absolute request URI is left as is
+		if !strings.HasPrefix(u.Opaque, "/") {
+			return
+		}
+		escaped = u.Opaque
+		if i := strings.IndexByte(escaped, '?'); i >= 0 {
+			escaped, query = escaped[:i], escaped[i:]
+		}
+	}
+
+	cleaned := clean(escaped)
+	if cleaned == escaped {
+		return
+	}
+	unescaped, err := url.PathUnescape(cleaned)
+	if err != nil {
+		return
+	}
+	u.Path = unescaped
+	u.RawPath = cleaned
+	if u.Opaque != "" {
+		u.Opaque = cleaned + query
+	}
+}
+
+// cleanEscapedPath cleans the escaped form of the path, so the escaped slashes are not seen as separators
+func cleanEscapedPath(p string) string {
+	if p == "" {
+		return p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// collapseSlashes collapses the repeated slashes of the escaped path
+func collapseSlashes(p string) string {
+	if !strings.Contains(p, "//") {
+		return p
+	}
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,32 @@
+package forward
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+)
+
+// ForwardClientCert passes the verified TLS client certificate of the request to the backends,
+// in the X-Client-Cert-Subject and X-Client-Cert-Fingerprint (hex encoded SHA-256 of the
+// certificate) headers. The values of these headers sent by the clients are always dropped.
+func ForwardClientCert(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.forwardClientCert = b
+		f.websocketForwarder.forwardClientCert = b
+		return nil
+	}
+}
+
+// setClientCertHeaders replaces the client certificate headers with the verified client certificate
+func setClientCertHeaders(h http.Header, state *tls.ConnectionState) {
+	h.Del(XClientCertSubject)
+	h.Del(XClientCertFingerprint)
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	h.Set(XClientCertSubject, cert.Subject.String())
+	h.Set(XClientCertFingerprint, hex.EncodeToString(fingerprint[:]))
+}
@@ -0,0 +1,127 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// MaxConnectionsPerClient limits the number of requests, including websocket connections, a single
+// client can have in flight. The client is identified by the IP address of the connection, see
+// ClientTrustedProxies when the forwarder is behind other proxies.
+// Requests over the limit are rejected with 429 Too Many Requests.
+func MaxConnectionsPerClient(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n <= 0 {
+			return fmt.Errorf("max connections per client should be > 0, got %v", n)
+		}
+		f.clientLimiter = &clientLimiter{
+			max:   int64(n),
+			mutex: &sync.Mutex{},
+			conns: make(map[string]int64),
+		}
+		return nil
+	}
+}
+
+// ClientTrustedProxies sets the networks of the proxies in front of the forwarder, as CIDRs or single
+// IP addresses. The requests coming from them are counted by MaxConnectionsPerClient against the
+// rightmost X-Forwarded-For address that is not one of them, the entries on its left being set by
+// the client. X-Forwarded-For is ignored for the requests coming from anywhere else.
+func ClientTrustedProxies(networks ...string) optSetter {
+	return func(f *Forwarder) error {
+		trusted := make([]*net.IPNet, 0, len(networks))
+		for _, network := range networks {
+			if !strings.Contains(network, "/") {
+				ip := net.ParseIP(network)
+				if ip == nil {
+					return fmt.Errorf("invalid trusted proxy address %q", network)
+				}
+				bits := 8 * net.IPv4len
+				if ip.To4() == nil {
+					bits = 8 * net.IPv6len
+				}
+				network = fmt.Sprintf("%v/%v", network, bits)
+			}
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy network %q: %v", network, err)
+			}
+			trusted = append(trusted, ipNet)
+		}
+		f.clientTrustedProxies = trusted
+		return nil
+	}
+}
+
+// clientLimiter counts the connections in flight per client IP
+type clientLimiter struct {
+	max     int64
+	trusted []*net.IPNet
+
+	mutex *sync.Mutex
+	conns map[string]int64
+}
+
+func (l *clientLimiter) acquire(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *clientLimiter) release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.conns[ip]--
+	if l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// clientIP returns the IP address of the client that originated the request
+func (l *clientLimiter) clientIP(req *http.Request) (string, error) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse client IP from %v: %v", req.RemoteAddr, err)
+	}
+	if !l.isTrusted(ip) {
+		return ip, nil
+	}
+	// each trusted proxy appended the address it got the request from
+	var hops []string
+	for _, xff := range req.Header[XForwardedFor] {
+		hops = append(hops, strings.Split(xff, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+	return ip, nil
+}
+
+func (l *clientLimiter) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
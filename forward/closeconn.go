@@ -0,0 +1,244 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CloseConnOnStatus closes the backend connection once a response with one of the status codes is
+// forwarded, instead of returning it to the pool, so the next request gets a fresh connection. It
+// clears the backends getting into a bad state per connection, e.g. CloseConnOnStatus(500, 502, 503).
+// It requires an *http.Transport, the forwarder uses a copy of it with the connections wrapped.
+// HTTP/2 connections are shared by concurrent requests, so the TLS backends are reached over HTTP/1.1.
+func CloseConnOnStatus(codes ...int) optSetter {
+	return func(f *Forwarder) error {
+		if len(codes) == 0 {
+			f.httpForwarder.closeOnStatus = nil
+			return nil
+		}
+		statuses := make(map[int]bool, len(codes))
+		for _, code := range codes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid status code %v", code)
+			}
+			statuses[code] = true
+		}
+		f.httpForwarder.closeOnStatus = statuses
+		return nil
+	}
+}
+
+// closeConnTransport returns the transport closing the connections of the responses with one of the statuses
+func closeConnTransport(rt http.RoundTripper, statuses map[int]bool) (http.RoundTripper, error) {
+	switch t := rt.(type) {
+	case *lifetimeTransport:
+		// built by the forwarder, so it is updated in place
+		closeConnOnStatus(t.Transport, statuses)
+		return t, nil
+	case *http.Transport:
+		t = t.Clone()
+		closeConnOnStatus(t, statuses)
+		return t, nil
+	}
+	return nil, fmt.Errorf("CloseConnOnStatus requires an *http.Transport, got %T", rt)
+}
+
+// closeConnOnStatus wraps the connections dialed by the transport. The transport decides to reuse
+// a connection as soon as the response header is read, before the response is handed to the
+// forwarder, so the statuses are matched while the response is read from the connection.
+func closeConnOnStatus(t *http.Transport, statuses map[int]bool) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	dialTLS := t.DialTLSContext
+	if dialTLS == nil {
+		config, timeout := t.TLSClientConfig, t.TLSHandshakeTimeout
+		dialTLS = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialHTTP1TLS(ctx, dial, config, timeout, network, address)
+		}
+	}
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &statusConn{Conn: conn, statuses: statuses}, nil
+	}
+	t.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialTLS(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &statusConn{Conn: conn, statuses: statuses}, nil
+	}
+}
+
+// dialHTTP1TLS dials the TLS connection the transport would, restricted to HTTP/1.1
+func dialHTTP1TLS(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error),
+	config *tls.Config, timeout time.Duration, network, address string) (net.Conn, error) {
+	conn, err := dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+	config.NextProtos = []string{"http/1.1"}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+const (
+	// reading a response body, or waiting for the next request
+	statusConnIdle = iota
+	statusConnStatusLine
+	statusConnHeader
+)
+
+// maxStatusLine caps the status line kept to parse the status code
+const maxStatusLine = 64
+
+var connectionClose = []byte("Connection: close\r\n")
+
+// statusConn adds the Connection: close header to the responses with one of the statuses, so the
+// transport closes the connection instead of returning it to the pool. A response is expected
+// after each request written, the connection stops looking at the responses when the bytes read
+// are not HTTP, e.g. a TLS connection tunneled through a proxy.
+type statusConn struct {
+	net.Conn
+	statuses map[int]bool
+
+	// guards the state, which is updated by the transport read and write loops
+	mutex   sync.Mutex
+	state   int
+	passive bool
+	line    []byte
+	code    int
+	lineLen int
+
+	// bytes left from the last read, and its error
+	pending []byte
+	err     error
+}
+
+func (c *statusConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	if c.state == statusConnIdle && !c.passive {
+		c.state = statusConnStatusLine
+		c.line = c.line[:0]
+	}
+	c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *statusConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		n, err := c.Conn.Read(b)
+		if n == 0 {
+			return n, err
+		}
+		c.mutex.Lock()
+		out := c.scan(b[:n])
+		c.mutex.Unlock()
+		if out == nil {
+			return n, err
+		}
+		c.pending, c.err = out, err
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// scan follows the responses read, it returns the bytes with the header added,
+// or nil when they are unchanged
+func (c *statusConn) scan(b []byte) []byte {
+	for i, ch := range b {
+		switch c.state {
+		case statusConnIdle:
+			return nil
+		case statusConnStatusLine:
+			if len(c.line) < len("HTTP/") && ch != "HTTP/"[len(c.line)] {
+				c.passive = true
+				c.state = statusConnIdle
+				return nil
+			}
+			if ch != '\n' {
+				if len(c.line) < maxStatusLine {
+					c.line = append(c.line, ch)
+				}
+				continue
+			}
+			c.code = parseStatusLine(c.line)
+			c.state = statusConnHeader
+			c.lineLen = 0
+			if c.statuses[c.code] {
+				rest := c.scan(b[i+1:])
+				if rest == nil {
+					rest = b[i+1:]
+				}
+				out := append(append([]byte{}, b[:i+1]...), connectionClose...)
+				return append(out, rest...)
+			}
+		case statusConnHeader:
+			if ch == '\r' {
+				continue
+			}
+			if ch != '\n' {
+				c.lineLen++
+				continue
+			}
+			if c.lineLen == 0 {
+				// the informational responses are followed by the final one
+				if c.code < http.StatusOK && c.code != http.StatusSwitchingProtocols {
+					c.state = statusConnStatusLine
+					c.line = c.line[:0]
+				} else {
+					c.state = statusConnIdle
+				}
+			}
+			c.lineLen = 0
+		}
+	}
+	return nil
+}
+
+// parseStatusLine returns the status code of the status line, 0 when it is malformed
+func parseStatusLine(line []byte) int {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0
+	}
+	return code
+}
@@ -0,0 +1,139 @@
+package forward
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ForwarderConfig is a read-only snapshot of the forwarder configuration resolved by New
+type ForwarderConfig struct {
+	// PassHostHeader forwards the Host header of the client instead of the backend host
+	PassHostHeader bool
+	// ForwardedHostHeader sets X-Forwarded-Host on the forwarded requests
+	ForwardedHostHeader bool
+	// StreamResponse flushes the responses to the client as they arrive
+	StreamResponse bool
+	// BufferResponseBytes is zero when the responses are not buffered
+	BufferResponseBytes int64
+	// ServerTiming adds the upstream time to the Server-Timing header, ServerTimingBackend names the backend in it
+	ServerTiming        bool
+	ServerTimingBackend bool
+	// MaxResponseHeaders is zero when the response headers are not limited
+	MaxResponseHeaders int
+	// HTTP3Backend is set when the backends are reached over HTTP/3
+	HTTP3Backend bool
+	// RetryTruncatedResponses retries the idempotent requests whose response was cut short
+	RetryTruncatedResponses bool
+	// CleanPath and NormalizePath rewrite the request path before forwarding it
+	CleanPath     bool
+	NormalizePath bool
+	// DiscardHeadBody drops the bodies of the responses to HEAD requests
+	DiscardHeadBody bool
+	// VerboseErrors includes the error and its category in the error responses
+	VerboseErrors bool
+	// PreserveReasonPhrase relays the custom reason phrases of the backends
+	PreserveReasonPhrase bool
+	// CancelOnClientDisconnect cancels the backend request once the client goes away
+	CancelOnClientDisconnect bool
+	// DumpOnError logs the failed requests
+	DumpOnError bool
+	// BackendAcceptEncoding is empty when the client header is passed through
+	BackendAcceptEncoding string
+	// StripAltSvc removes the Alt-Svc of the responses, AltSvc replaces it when not empty
+	StripAltSvc bool
+	AltSvc      string
+	// MaxRequestHeaderBytes is zero when the request headers are not limited
+	MaxRequestHeaderBytes int
+	// AllowedMethods is empty when all the methods are allowed
+	AllowedMethods []string
+	// CloseConnOnStatus lists the sorted status codes closing the backend connection
+	CloseConnOnStatus []int
+	// MaxConcurrentRequests is zero when the requests in flight are not capped,
+	// OverloadQueueTimeout zero when the requests over it are rejected right away
+	MaxConcurrentRequests int
+	OverloadQueueTimeout  time.Duration
+	// BufferPoolTiers lists the sorted sizes of the pooled copy buffers, empty when the buffers are not pooled
+	BufferPoolTiers []int
+	// WebsocketMaxSessionDuration is zero when the sessions are not capped
+	WebsocketMaxSessionDuration time.Duration
+	// MaxWebsocketConnections is zero when the websocket tunnels are not capped
+	MaxWebsocketConnections int
+	// WebsocketAllowedSubprotocols is empty when all the subprotocols are allowed, sorted otherwise
+	WebsocketAllowedSubprotocols []string
+	// The transport timeouts are only reported for *http.Transport round trippers
+	ExpectContinueTimeout time.Duration
+	ResponseHeaderTimeout time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ConnMaxLifetime       time.Duration
+
+	// The chaos settings are zero when no faults are injected
+	ChaosLatencyProbability float64
+	ChaosLatency            time.Duration
+	ChaosAbortProbability   float64
+	ChaosAbortStatus        int
+}
+
+// Config returns the effective configuration of the forwarder
+func (f *Forwarder) Config() ForwarderConfig {
+	c := ForwarderConfig{
+		PassHostHeader:      f.passHost,
+		ForwardedHostHeader: !f.httpForwarder.omitForwardedHost,
+		StreamResponse:      f.httpForwarder.streamResponse,
+		BufferResponseBytes: f.httpForwarder.maxBufferBytes,
+		ServerTiming:        f.httpForwarder.serverTiming,
+		ServerTimingBackend: f.httpForwarder.serverTimingBackend,
+		MaxResponseHeaders:  f.httpForwarder.maxResponseHeaders,
+		HTTP3Backend:        f.httpForwarder.http3,
+
+		RetryTruncatedResponses:  f.httpForwarder.retryTruncated,
+		CleanPath:                f.httpForwarder.cleanPath,
+		NormalizePath:            f.httpForwarder.normalizePath,
+		DiscardHeadBody:          f.httpForwarder.discardHeadBody,
+		VerboseErrors:            f.verboseErrors,
+		PreserveReasonPhrase:     f.httpForwarder.preserveReason,
+		CancelOnClientDisconnect: f.httpForwarder.cancelOnDisconnect,
+		DumpOnError:              f.httpForwarder.dumpOnError,
+		BackendAcceptEncoding:    f.httpForwarder.acceptEncoding,
+		StripAltSvc:              f.httpForwarder.overrideAltSvc && f.httpForwarder.altSvc == "",
+		AltSvc:                   f.httpForwarder.altSvc,
+		MaxRequestHeaderBytes:    f.maxHeaderBytes,
+
+		OverloadQueueTimeout:        f.httpForwarder.overloadWait,
+		WebsocketMaxSessionDuration: f.websocketForwarder.maxSession,
+		MaxWebsocketConnections:     int(f.websocketForwarder.maxTunnels),
+
+		ChaosLatencyProbability: f.chaos.latencyProbability,
+		ChaosLatency:            f.chaos.latency,
+		ChaosAbortProbability:   f.chaos.abortProbability,
+		ChaosAbortStatus:        f.chaos.abortStatus,
+	}
+	t, ok := f.roundTripper.(*http.Transport)
+	if f.methods != nil {
+		c.AllowedMethods = append([]string(nil), f.methods.list...)
+	}
+	for code := range f.httpForwarder.closeOnStatus {
+		c.CloseConnOnStatus = append(c.CloseConnOnStatus, code)
+	}
+	sort.Ints(c.CloseConnOnStatus)
+	if f.httpForwarder.overload != nil {
+		c.MaxConcurrentRequests = f.httpForwarder.overload.max
+	}
+	if f.httpForwarder.buffers != nil {
+		c.BufferPoolTiers = append([]int(nil), f.httpForwarder.buffers.sizes...)
+	}
+	for name := range f.websocketForwarder.subprotocols {
+		c.WebsocketAllowedSubprotocols = append(c.WebsocketAllowedSubprotocols, name)
+	}
+	sort.Strings(c.WebsocketAllowedSubprotocols)
+	if lt, isLifetime := f.roundTripper.(*lifetimeTransport); isLifetime {
+		t, ok = lt.Transport, true
+		c.ConnMaxLifetime = lt.maxLifetime
+	}
+	if ok {
+		c.ExpectContinueTimeout = t.ExpectContinueTimeout
+		c.ResponseHeaderTimeout = t.ResponseHeaderTimeout
+		c.TLSHandshakeTimeout = t.TLSHandshakeTimeout
+	}
+	return c
+}
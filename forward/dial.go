@@ -0,0 +1,88 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+const (
+	// DialTimeMetric is the time spent dialing the backend, in nanoseconds
+	DialTimeMetric = "dial.time.ns"
+	// DialErrorsMetric is the number of failed dials to the backend
+	DialErrorsMetric = "dial.errors"
+)
+
+// DialHistogram returns the histogram of the times spent dialing the backend address (host:port),
+// for both the HTTP and websocket requests. It requires LatencyHistograms.
+func (f *Forwarder) DialHistogram(addr string) (*memmetrics.HDRHistogram, error) {
+	m := f.httpForwarder.latency
+	if m == nil {
+		return nil, fmt.Errorf("latency histograms are not enabled")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	h, ok := m.dials[addr]
+	if !ok {
+		return nil, fmt.Errorf("no dials to %v recorded", addr)
+	}
+	return h.Merged()
+}
+
+// DialErrors returns the number of failed dials to the backend address (host:port).
+// It requires LatencyHistograms.
+func (f *Forwarder) DialErrors(addr string) int64 {
+	m := f.httpForwarder.latency
+	if m == nil {
+		return 0
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.dialErrors[addr]
+}
+
+// timeDials wraps the dialer to record the dials
+func (m *latencyMetrics) timeDials(dial Dialer, ctx *handlerContext) Dialer {
+	return func(network, address string) (net.Conn, error) {
+		start := ctx.clock.UtcNow()
+		conn, err := dial(network, address)
+		m.recordDial(address, ctx.clock.UtcNow().Sub(start), err, ctx)
+		return conn, err
+	}
+}
+
+func (m *latencyMetrics) recordDial(addr string, d time.Duration, err error, ctx *handlerContext) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err != nil {
+		m.dialErrors[addr]++
+	}
+	h, ok := m.dials[addr]
+	if !ok {
+		var herr error
+		if h, herr = m.newHist(); herr != nil {
+			ctx.log.Warningf("Failed to create dial histogram for %v: %v", addr, herr)
+			return
+		}
+		m.dials[addr] = h
+	}
+	if err := h.RecordValues(int64(d), 1); err != nil {
+		ctx.log.Warningf("Failed to record dial time %v: %v", d, err)
+	}
+}
+
+// backendAddr returns the host:port address of the backend
+func backendAddr(u *url.URL) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host
+	}
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		return net.JoinHostPort(u.Host, "443")
+	}
+	return net.JoinHostPort(u.Host, "80")
+}
@@ -0,0 +1,38 @@
+package forward
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// CancelOnClientDisconnect stops copying the upstream response as soon as the client goes away:
+// the upstream body is closed right away, releasing the backend, instead of after the next failed
+// write to the client. It also covers the round trippers ignoring the request context.
+func CancelOnClientDisconnect(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.cancelOnDisconnect = b
+		return nil
+	}
+}
+
+// ClientDisconnects returns the number of upstream responses abandoned because the client went away,
+// only counted with CancelOnClientDisconnect
+func (f *Forwarder) ClientDisconnects() int64 {
+	return atomic.LoadInt64(&f.httpForwarder.disconnects)
+}
+
+// closeOnDisconnect closes the upstream response body once the client goes away, until the returned
+// function is called
+func closeOnDisconnect(req *http.Request, response *http.Response) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-req.Context().Done():
+			response.Body.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
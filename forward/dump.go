@@ -0,0 +1,74 @@
+package forward
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// DefaultRedactedHeaders are the request headers hidden from the dumps unless DumpRedactedHeaders
+// is set
+var DefaultRedactedHeaders = []string{Authorization, ProxyAuthorization, Cookie}
+
+// DumpOnError logs the request, with its sensitive headers redacted, along with the error when the
+// round trip fails or the backend replies with a 5xx. It helps diagnosing the failed requests without
+// logging all of them, the dumps are logged at the info level.
+func DumpOnError(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.dumpOnError = b
+		return nil
+	}
+}
+
+// DumpRedactedHeaders replaces the DefaultRedactedHeaders whose values are hidden from the dumps of
+// DumpOnError. No header is redacted when names is empty.
+func DumpRedactedHeaders(names ...string) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.redacted = make(map[string]bool, len(names))
+		for _, name := range names {
+			f.httpForwarder.redacted[http.CanonicalHeaderKey(name)] = true
+		}
+		return nil
+	}
+}
+
+// dumpRequest logs the failed request and the error or status code of its response
+func (f *httpForwarder) dumpRequest(req *http.Request, code int, err error, ctx *handlerContext) {
+	if !f.dumpOnError {
+		return
+	}
+	outcome := fmt.Sprintf("status: %v", code)
+	if err != nil {
+		outcome = fmt.Sprintf("error: %v", err)
+	}
+	ctx.log.Infof("Failed request %v %v %v, %v, headers: %s", req.Method, req.URL, req.Proto, outcome, f.redactHeaders(req.Header))
+}
+
+// redactHeaders formats the headers sorted by name, with the values of the redacted ones hidden
+func (f *httpForwarder) redactHeaders(h http.Header) []byte {
+	redacted := f.redacted
+	if redacted == nil {
+		redacted = make(map[string]bool, len(DefaultRedactedHeaders))
+		for _, name := range DefaultRedactedHeaders {
+			redacted[name] = true
+		}
+	}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out bytes.Buffer
+	for i, name := range names {
+		if i > 0 {
+			out.WriteString("; ")
+		}
+		if redacted[http.CanonicalHeaderKey(name)] {
+			fmt.Fprintf(&out, "%v: [REDACTED]", name)
+			continue
+		}
+		fmt.Fprintf(&out, "%v: %v", name, h[name])
+	}
+	return out.Bytes()
+}
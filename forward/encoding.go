@@ -0,0 +1,29 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// BackendAcceptEncoding replaces the Accept-Encoding header of the forwarded requests with value, e.g.
+// "identity" to get uncompressed responses the rewriters and observers can inspect, or "gzip" to save
+// the bandwidth to the backends. The responses are relayed with the encoding the backend picked, the
+// forwarder doesn't compress nor decompress them: any value other than identity should only be used
+// when all the clients accept it. The client header is passed through by default.
+func BackendAcceptEncoding(value string) optSetter {
+	return func(f *Forwarder) error {
+		if value == "" {
+			return fmt.Errorf("backend Accept-Encoding can't be empty")
+		}
+		f.httpForwarder.acceptEncoding = value
+		return nil
+	}
+}
+
+// setAcceptEncoding sets the Accept-Encoding of the forwarded request. An explicit header also turns off
+// the transparent decompression of http.Transport, which only applies to the requests it compresses.
+func (f *httpForwarder) setAcceptEncoding(outReq *http.Request) {
+	if f.acceptEncoding != "" {
+		outReq.Header.Set(AcceptEncoding, f.acceptEncoding)
+	}
+}
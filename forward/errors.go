@@ -0,0 +1,117 @@
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// StatusError is returned when the forwarder rejects a request by itself
+// instead of forwarding it, it carries the status code to reply with
+type StatusError struct {
+	Code   int
+	Reason string
+}
+
+func (e *StatusError) Error() string {
+	if e.Reason == "" {
+		return http.StatusText(e.Code)
+	}
+	return fmt.Sprintf("%v: %v", http.StatusText(e.Code), e.Reason)
+}
+
+// StatusCode returns the status code to reply with
+func (e *StatusError) StatusCode() int {
+	return e.Code
+}
+
+// ErrHandler is the default error handler of the forwarder. It renders errors
+// generated by the forwarder itself and delegates the rest to utils.DefaultHandler
+type ErrHandler struct {
+	// Verbose includes the error and its category in the response, see VerboseErrors
+	Verbose bool
+}
+
+func (e *ErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if e.Verbose {
+		code := errorStatusCode(err)
+		w.Header().Set(XProxyError, errorCategory(err))
+		w.Header().Set(ContentType, "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		if _, ok := err.(*StatusError); ok {
+			w.Write([]byte(err.Error()))
+		} else {
+			fmt.Fprintf(w, "%v: %v", http.StatusText(code), err)
+		}
+		return
+	}
+	if se, ok := err.(*StatusError); ok {
+		w.WriteHeader(se.Code)
+		w.Write([]byte(http.StatusText(se.Code)))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+}
+
+var defaultErrHandler = &ErrHandler{}
+
+// errorStatusCode returns the status code the default error handlers reply with
+func errorStatusCode(err error) int {
+	if se, ok := err.(*StatusError); ok {
+		return se.Code
+	}
+	if ne, ok := err.(net.Error); ok {
+		if ne.Timeout() {
+			return http.StatusGatewayTimeout
+		}
+		return http.StatusBadGateway
+	}
+	if err == io.EOF {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// Error categories reported by the verbose error handler
+const (
+	ErrorCategoryProxy     = "proxy"
+	ErrorCategoryTimeout   = "timeout"
+	ErrorCategoryDial      = "dial"
+	ErrorCategoryTLS       = "tls"
+	ErrorCategoryClosed    = "upstream-closed"
+	ErrorCategoryTransport = "transport"
+)
+
+// errorCategory classifies the error, looking through the errors wrapping it
+func errorCategory(err error) string {
+	var (
+		statusErr    *StatusError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		recordErr    tls.RecordHeaderError
+		netErr       net.Error
+		opErr        *net.OpError
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		return ErrorCategoryProxy
+	case errors.As(err, &verifyErr), errors.As(err, &authorityErr), errors.As(err, &hostnameErr),
+		errors.As(err, &invalidErr), errors.As(err, &recordErr):
+		return ErrorCategoryTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorCategoryTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return ErrorCategoryDial
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorCategoryClosed
+	}
+	return ErrorCategoryTransport
+}
@@ -4,17 +4,24 @@
 package forward
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/mailgun/timetools"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -34,6 +41,17 @@ func PassHostHeader(b bool) optSetter {
 	}
 }
 
+// ForwardedHostHeader specifies if the X-Forwarded-Host header is sent to the backends. The header
+// carries the Host of the client, or the one of the previous proxy when the rewriter trusts the
+// forward headers, so the backends can build absolute URLs when the Host is not passed. It is sent
+// by default.
+func ForwardedHostHeader(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.omitForwardedHost = !b
+		return nil
+	}
+}
+
 // StreamResponse forces streaming body (flushes response directly to client)
 func StreamResponse(b bool) optSetter {
 	return func(f *Forwarder) error {
@@ -42,6 +60,105 @@ func StreamResponse(b bool) optSetter {
 	}
 }
 
+// DiscardHeadBody drops the body some backends wrongly send in response to HEAD requests,
+// the response headers, Content-Length included, are passed through as is. The net/http transports
+// already drop these bodies, so it only matters for custom round trippers handing them over.
+func DiscardHeadBody(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.discardHeadBody = b
+		return nil
+	}
+}
+
+// BufferResponse reads the upstream response body into memory before sending it to the client,
+// so the response gets an accurate Content-Length and upstream read errors can be reported properly.
+// Responses larger than maxBytes fall back to streaming. It is mutually exclusive with StreamResponse.
+func BufferResponse(maxBytes int64) optSetter {
+	return func(f *Forwarder) error {
+		if maxBytes <= 0 {
+			return fmt.Errorf("buffer size should be > 0, got %v", maxBytes)
+		}
+		f.httpForwarder.maxBufferBytes = maxBytes
+		return nil
+	}
+}
+
+// ServerTiming adds a Server-Timing response header reporting the time spent waiting for the upstream response
+func ServerTiming(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.serverTiming = b
+		return nil
+	}
+}
+
+// ServerTimingBackend includes the upstream host into the Server-Timing header description.
+// It is off by default to avoid leaking the internal topology to the clients.
+func ServerTimingBackend(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.serverTimingBackend = b
+		return nil
+	}
+}
+
+// MaxResponseHeaders limits the number of upstream response header fields forwarded to the client,
+// the fields over the limit are dropped. Zero means no limit.
+func MaxResponseHeaders(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n < 0 {
+			return fmt.Errorf("max response headers should be >= 0, got %v", n)
+		}
+		f.httpForwarder.maxResponseHeaders = n
+		return nil
+	}
+}
+
+// ExpectContinueTimeout sets how long the default transport waits for the backend to answer
+// requests sent with "Expect: 100-continue" before sending the body anyway. When the backend
+// rejects the request with a final status instead, the rejection is relayed to the client
+// without reading the request body. Zero sends the body immediately.
+// Can't be combined with RoundTripper, configure the transport directly instead.
+func ExpectContinueTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("expect continue timeout should be >= 0, got %v", d)
+		}
+		f.httpForwarder.expectContinueTimeout = &d
+		return nil
+	}
+}
+
+// ConnMaxLifetime closes the backend connections of the default transport once they are older
+// than d, so the traffic rebalances after the backends scale up. Connections busy with a request
+// are closed as soon as the request completes. Zero means no limit.
+// Can't be combined with RoundTripper, configure the transport directly instead.
+func ConnMaxLifetime(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("connection max lifetime should be >= 0, got %v", d)
+		}
+		f.httpForwarder.connMaxLifetime = d
+		return nil
+	}
+}
+
+// HTTPTLSClientConfig sets the TLS configuration the default transport uses to connect to the backends.
+// Can't be combined with RoundTripper, configure the transport directly instead.
+func HTTPTLSClientConfig(config *tls.Config) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.tlsClientConfig = config
+		return nil
+	}
+}
+
+// BackendClientCert presents the certificate to the backends requiring mutual TLS.
+// Can't be combined with RoundTripper, configure the transport directly instead.
+func BackendClientCert(cert tls.Certificate) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.clientCerts = append(f.httpForwarder.clientCerts, cert)
+		return nil
+	}
+}
+
 // RoundTripper sets a new http.RoundTripper
 // Forwarder will use http.DefaultTransport as a default round tripper
 func RoundTripper(r http.RoundTripper) optSetter {
@@ -72,6 +189,16 @@ func Rewriter(r ReqRewriter) optSetter {
 	}
 }
 
+// WebsocketOrigin rewrites the Origin header sent to the websocket backends with fn, for the backends
+// validating it. fn receives the Origin of the client, returning an empty string strips the header.
+// By default the Origin of the client is passed through.
+func WebsocketOrigin(fn func(origin string) string) optSetter {
+	return func(f *Forwarder) error {
+		f.websocketForwarder.rewriteOrigin = fn
+		return nil
+	}
+}
+
 // WebsocketRewriter defines a request rewriter for the websocket forwarder
 func WebsocketRewriter(r ReqRewriter) optSetter {
 	return func(f *Forwarder) error {
@@ -80,6 +207,19 @@ func WebsocketRewriter(r ReqRewriter) optSetter {
 	}
 }
 
+// WebsocketMaxSessionDuration closes the websocket tunnels after d regardless of their activity,
+// e.g. to make the clients reconnect periodically and refresh their tokens. The tunnel isn't aware
+// of the websocket frames, so the connections are closed without a close frame. Zero disables it.
+func WebsocketMaxSessionDuration(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("websocket max session duration should be >= 0, got %v", d)
+		}
+		f.websocketForwarder.maxSession = d
+		return nil
+	}
+}
+
 // ErrorHandler is a functional argument that sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) optSetter {
 	return func(f *Forwarder) error {
@@ -88,6 +228,33 @@ func ErrorHandler(h utils.ErrorHandler) optSetter {
 	}
 }
 
+// VerboseErrors makes the default error handler reply with the underlying error and its category,
+// in the X-Proxy-Error header, to ease debugging. It leaks the internal details of the backends
+// so it is meant for development only, and it has no effect with a custom ErrorHandler.
+func VerboseErrors(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.verboseErrors = b
+		return nil
+	}
+}
+
+// ProblemJSONErrors replies to errors with application/problem+json documents (RFC 7807)
+// using problem types relative to baseType
+func ProblemJSONErrors(baseType string) optSetter {
+	return func(f *Forwarder) error {
+		f.errHandler = &utils.ProblemHandler{BaseType: baseType}
+		return nil
+	}
+}
+
+// Clock sets the time provider used by the forwarder, so tests can control time
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(f *Forwarder) error {
+		f.clock = clock
+		return nil
+	}
+}
+
 // Logger specifies the logger to use.
 // Forwarder will default to oxyutils.NullLogger if no logger has been specified
 func Logger(l utils.Logger) optSetter {
@@ -103,12 +270,30 @@ type Forwarder struct {
 	*httpForwarder
 	*websocketForwarder
 	*handlerContext
+	chaos chaos
+	// Optional allowlist of the forwarded methods
+	methods *methodFilter
+	// Optional limit of the request header size
+	maxHeaderBytes int
+	// Optional authorizer of the requests, checked before anything else
+	authorizer RequestAuthorizer
+	// Optional limit of the connections per client
+	clientLimiter        *clientLimiter
+	clientTrustedProxies []*net.IPNet
+	// Optional limit of the requests in flight per client key
+	keyLimiter    *keyLimiter
+	drainer       *drainer
+	errHandlers   *utils.SwappableErrorHandler
+	verboseErrors bool
+	// Optional observers of the completed requests
+	observers []Observer
 }
 
 // handlerContext defines a handler context for error reporting and logging
 type handlerContext struct {
 	errHandler utils.ErrorHandler
 	log        utils.Logger
+	clock      timetools.TimeProvider
 }
 
 // httpForwarder is a handler that can reverse proxy
@@ -118,31 +303,186 @@ type httpForwarder struct {
 	rewriter       ReqRewriter
 	passHost       bool
 	streamResponse bool
+	// Optional cap of the requests in flight and how long the requests over it wait
+	overload     *overloadLimiter
+	overloadWait time.Duration
+	// Optional priority of the requests waiting for a slot, see QueuePriority
+	queuePriority func(*http.Request) int
+	// Optional label of the upstreams in the X-Oxy-Trace header
+	traceLabel func(upstream *url.URL) string
+	// Optional Accept-Encoding sent to the backends
+	acceptEncoding string
+	// X-Forwarded-Host is removed from the requests, see ForwardedHostHeader
+	omitForwardedHost bool
+	// Optional dump of the failed requests, with the values of the redacted headers hidden
+	dumpOnError bool
+	redacted    map[string]bool
+	// Optional pool of the buffers copying the response bodies
+	buffers *bufferPool
+	// the Alt-Svc of the responses is removed when altSvc is empty, see StripAltSvc
+	overrideAltSvc bool
+	altSvc         string
+	// Optional decider of the responses to stream, see StreamDecider
+	streamDecider  func(*http.Response) bool
+	maxBufferBytes int64
+
+	serverTiming        bool
+	serverTimingBackend bool
+
+	maxResponseHeaders int
+
+	// http3 is set when the backends are reached over HTTP/3, see HTTP3Backend
+	http3 bool
+	// grpc is set when the backends are reached over HTTP/2, see GRPCMode
+	grpc bool
+
+	expectContinueTimeout *time.Duration
+	connMaxLifetime       time.Duration
+	tlsClientConfig       *tls.Config
+	clientCerts           []tls.Certificate
+
+	// Optional histograms of the backend time and the proxy overhead
+	latency *latencyMetrics
+	// Optional tag partitioning the latency histograms
+	metricsTag func(req *http.Request) string
+
+	retryTruncated bool
+	cleanPath      bool
+	normalizePath  bool
+	// Drop the body of the responses to HEAD requests
+	discardHeadBody bool
+	// Pass the client certificate in the request headers
+	forwardClientCert bool
+	// Optional statuses closing the backend connection, see CloseConnOnStatus
+	closeOnStatus map[int]bool
+	// Relay the custom reason phrases, see PreserveReasonPhrase
+	preserveReason bool
+	// Close the upstream body once the client goes away
+	cancelOnDisconnect bool
+	// disconnects counts the responses abandoned by the clients, accessed atomically
+	disconnects int64
+	// truncated counts the responses cut short by the backend, accessed atomically
+	truncated int64
+}
+
+// ownsTransport returns true when the options require the forwarder to build its own transport
+func (f *httpForwarder) ownsTransport() bool {
+	return f.expectContinueTimeout != nil || f.connMaxLifetime > 0 || f.tlsClientConfig != nil || len(f.clientCerts) != 0
+}
+
+// newTransport returns a transport configured like http.DefaultTransport
+// with the transport options applied
+func (f *httpForwarder) newTransport() http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if f.expectContinueTimeout != nil {
+		t.ExpectContinueTimeout = *f.expectContinueTimeout
+	}
+	t.TLSClientConfig = f.clientTLSConfig()
+	if f.connMaxLifetime > 0 {
+		return newLifetimeTransport(t, f.connMaxLifetime)
+	}
+	return t
+}
+
+// clientTLSConfig returns the TLS configuration of the backend connections, nil for the defaults
+func (f *httpForwarder) clientTLSConfig() *tls.Config {
+	if f.tlsClientConfig == nil && len(f.clientCerts) == 0 {
+		return nil
+	}
+	config := &tls.Config{}
+	if f.tlsClientConfig != nil {
+		config = f.tlsClientConfig.Clone()
+	}
+	config.Certificates = append(config.Certificates, f.clientCerts...)
+	return config
 }
 
 // websocketForwarder is a handler that can reverse proxy
 // websocket traffic
 type websocketForwarder struct {
-	dial            Dialer
-	rewriter        ReqRewriter
-	TLSClientConfig *tls.Config
+	dial              Dialer
+	rewriter          ReqRewriter
+	TLSClientConfig   *tls.Config
+	rewriteOrigin     func(origin string) string
+	cleanPath         bool
+	normalizePath     bool
+	forwardClientCert bool
+	// Optional cap of the session duration
+	maxSession time.Duration
+	// Optional allowlist of the subprotocols
+	subprotocols map[string]bool
+	// Open tunnels and their optional limit, their goroutines, accessed atomically
+	tunnels    int64
+	maxTunnels int64
+	goroutines int64
+	// Shared with the forwarder, closes the tunnels left once the HTTP requests are drained
+	drainer *drainer
 }
 
 // New creates an instance of Forwarder based on the provided list of configuration options
 func New(setters ...optSetter) (*Forwarder, error) {
+	d := newDrainer()
 	f := &Forwarder{
 		httpForwarder:      &httpForwarder{},
-		websocketForwarder: &websocketForwarder{},
+		websocketForwarder: &websocketForwarder{drainer: d},
 		handlerContext:     &handlerContext{},
+		drainer:            d,
 	}
 	for _, s := range setters {
 		if err := s(f); err != nil {
 			return nil, err
 		}
 	}
+	if f.httpForwarder.overloadWait > 0 && f.httpForwarder.overload == nil {
+		return nil, fmt.Errorf("OverloadQueueTimeout requires MaxConcurrentRequests")
+	}
+	if f.httpForwarder.queuePriority != nil && f.httpForwarder.overloadWait == 0 {
+		return nil, fmt.Errorf("QueuePriority requires OverloadQueueTimeout")
+	}
+	if f.httpForwarder.streamResponse && f.httpForwarder.maxBufferBytes > 0 {
+		return nil, fmt.Errorf("StreamResponse and BufferResponse are mutually exclusive")
+	}
+	if f.httpForwarder.grpc {
+		if f.httpForwarder.maxBufferBytes > 0 {
+			return nil, fmt.Errorf("GRPCMode and BufferResponse are mutually exclusive")
+		}
+		if f.httpForwarder.http3 {
+			return nil, fmt.Errorf("GRPCMode and HTTP3Backend are mutually exclusive")
+		}
+		if f.httpForwarder.expectContinueTimeout != nil || f.httpForwarder.connMaxLifetime > 0 {
+			return nil, fmt.Errorf("GRPCMode can't be combined with ExpectContinueTimeout and ConnMaxLifetime")
+		}
+		f.httpForwarder.streamResponse = true
+		if f.httpForwarder.roundTripper == nil {
+			f.httpForwarder.roundTripper = f.httpForwarder.newGRPCTransport()
+		}
+	} else if f.httpForwarder.ownsTransport() {
+		if f.httpForwarder.roundTripper != nil {
+			return nil, fmt.Errorf("transport options can't be combined with RoundTripper")
+		}
+		f.httpForwarder.roundTripper = f.httpForwarder.newTransport()
+	}
 	if f.httpForwarder.roundTripper == nil {
 		f.httpForwarder.roundTripper = http.DefaultTransport
 	}
+	if f.httpForwarder.closeOnStatus != nil {
+		rt, err := closeConnTransport(f.httpForwarder.roundTripper, f.httpForwarder.closeOnStatus)
+		if err != nil {
+			return nil, err
+		}
+		f.httpForwarder.roundTripper = rt
+	}
 	if f.websocketForwarder.dial == nil {
 		f.websocketForwarder.dial = net.Dial
 	}
@@ -153,18 +493,96 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		}
 		f.httpForwarder.rewriter = &HeaderRewriter{TrustForwardHeader: true, Hostname: h}
 	}
+	if f.clientLimiter != nil {
+		f.clientLimiter.trusted = f.clientTrustedProxies
+	}
 	if f.log == nil {
 		f.log = utils.NullLogger
 	}
 	if f.errHandler == nil {
-		f.errHandler = utils.DefaultHandler
+		f.errHandler = defaultErrHandler
+		if f.verboseErrors {
+			f.errHandler = &ErrHandler{Verbose: true}
+		}
+	}
+	f.errHandlers = utils.NewSwappableErrorHandler(f.errHandler)
+	f.errHandler = f.errHandlers
+	if f.clock == nil {
+		f.clock = &timetools.RealTime{}
+	}
+	if f.httpForwarder.metricsTag != nil && f.httpForwarder.latency == nil {
+		return nil, fmt.Errorf("MetricsTag requires LatencyHistograms")
+	}
+	if f.httpForwarder.latency != nil {
+		if err := f.httpForwarder.latency.init(f.handlerContext); err != nil {
+			return nil, err
+		}
+		f.websocketForwarder.dial = f.httpForwarder.latency.timeDials(f.websocketForwarder.dial, f.handlerContext)
 	}
 	return f, nil
 }
 
+// SetErrorHandler swaps the error handler, the requests in flight may still use the previous one
+func (f *Forwarder) SetErrorHandler(h utils.ErrorHandler) {
+	f.errHandlers.Set(h)
+}
+
 // ServeHTTP decides which forwarder to use based on the specified
 // request and delegates to the proper implementation
 func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(f.observers) != 0 {
+		f.observe(w, req)
+		return
+	}
+	f.forward(w, req)
+}
+
+func (f *Forwarder) forward(w http.ResponseWriter, req *http.Request) {
+	if f.authorizer != nil && f.rejectUnauthorized(w, req) {
+		return
+	}
+	if f.methods != nil && f.methods.reject(w, req, f.handlerContext) {
+		return
+	}
+	if f.maxHeaderBytes > 0 && f.rejectLargeHeaders(w, req) {
+		return
+	}
+	if !f.drainer.enter() {
+		f.rejectShutdown(w, req)
+		return
+	}
+	defer f.drainer.leave()
+	if f.clientLimiter != nil {
+		ip, err := f.clientLimiter.clientIP(req)
+		if err != nil {
+			f.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		if !f.clientLimiter.acquire(ip) {
+			f.log.Infof("Rejecting request to %v, client %v reached the connection limit", req.URL, ip)
+			f.errHandler.ServeHTTP(w, req, &StatusError{Code: http.StatusTooManyRequests, Reason: "too many connections"})
+			return
+		}
+		defer f.clientLimiter.release(ip)
+	}
+	if f.keyLimiter != nil {
+		if key := f.keyLimiter.key(req); key != "" {
+			if !f.keyLimiter.acquire(key) {
+				f.log.Infof("Rejecting request to %v, its client key reached the concurrency limit", req.URL)
+				f.errHandler.ServeHTTP(w, req, &StatusError{Code: http.StatusTooManyRequests, Reason: "too many concurrent requests"})
+				return
+			}
+			defer f.keyLimiter.release(key)
+		}
+	}
+	if !f.chaos.injectLatency(req, f.clock) {
+		f.log.Infof("Client went away while delaying request to %v", req.URL)
+		return
+	}
+	if f.chaos.abort() {
+		f.errHandler.ServeHTTP(w, req, &StatusError{Code: f.chaos.abortStatus, Reason: "chaos abort"})
+		return
+	}
 	if isWebsocketRequest(req) {
 		f.websocketForwarder.serveHTTP(w, req, f.handlerContext)
 	} else {
@@ -174,53 +592,202 @@ func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 // serveHTTP forwards HTTP traffic using the configured transport
 func (f *httpForwarder) serveHTTP(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
-	start := time.Now().UTC()
-	response, err := f.roundTripper.RoundTrip(f.copyRequest(req, req.URL))
-	if err != nil {
-		ctx.log.Errorf("Error forwarding to %v, err: %v", req.URL, err)
+	if f.overload != nil {
+		if !f.overload.acquire(req, f.overloadWait, f.priorityOf(req)) {
+			f.rejectOverload(w, req, ctx)
+			return
+		}
+		defer f.overload.release()
+	}
+	start := ctx.clock.UtcNow()
+
+	// tracked for the observers only
+	stats := statsFrom(req)
+
+	var (
+		response     *http.Response
+		body         *bodyReader
+		stream       bool
+		upstreamTime time.Duration
+	)
+	for retried := false; ; retried = true {
+		outReq := f.copyRequest(req, req.URL)
+		if f.latency != nil {
+			outReq = f.latency.traceConnections(outReq, ctx)
+		}
+		outReq = stats.trace(outReq)
+		roundTripStart := ctx.clock.UtcNow()
+		var err error
+		response, err = f.roundTripperFor(req).RoundTrip(outReq)
+		if err != nil {
+			ctx.log.Errorf("Error forwarding to %v, err: %v", req.URL, err)
+			f.dumpRequest(req, 0, err, ctx)
+			stats.fail(err)
+			recordUpstreamError(req, err)
+			ctx.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		upstreamTime = ctx.clock.UtcNow().Sub(roundTripStart)
+
+		stream = f.streamResponse || isStreamingRequest(req) || f.decideStream(response)
+
+		body = &bodyReader{Reader: response.Body}
+		if f.discardHeadBody && req.Method == http.MethodHead {
+			body.Reader = http.NoBody
+			break
+		}
+		if !bodyAllowedForStatus(response.StatusCode) {
+			body.Reader = http.NoBody
+			break
+		}
+		if f.maxBufferBytes == 0 || stream {
+			break
+		}
+		buffered, err := ioutil.ReadAll(io.LimitReader(response.Body, f.maxBufferBytes+1))
+		if err == nil {
+			if int64(len(buffered)) <= f.maxBufferBytes {
+				response.Header.Set(ContentLength, strconv.Itoa(len(buffered)))
+			} else {
+				ctx.log.Infof("Response from %v exceeds %v bytes, streaming it instead of buffering", req.URL, f.maxBufferBytes)
+			}
+			body.Reader = io.MultiReader(bytes.NewReader(buffered), response.Body)
+			break
+		}
+		response.Body.Close()
+		if isTruncated(err) {
+			atomic.AddInt64(&f.truncated, 1)
+			if f.retryTruncated && !retried && canRetry(req) {
+				ctx.log.Warningf("Response from %v was truncated, retrying: %v", req.URL, err)
+				continue
+			}
+		}
+		ctx.log.Errorf("Error buffering upstream response Body: %v", err)
+		f.dumpRequest(req, 0, err, ctx)
+		stats.fail(err)
+		recordUpstreamError(req, err)
 		ctx.errHandler.ServeHTTP(w, req, err)
 		return
 	}
 
-	utils.CopyHeaders(w.Header(), response.Header)
-	// Remove hop-by-hop headers.
-	utils.RemoveHeaders(w.Header(), HopHeaders...)
+	if response.StatusCode >= http.StatusInternalServerError {
+		f.dumpRequest(req, response.StatusCode, nil, ctx)
+	}
+
+	if f.maxResponseHeaders > 0 {
+		f.copyHeadersLimited(w.Header(), response.Header, ctx)
+	} else {
+		utils.CopyHeaders(w.Header(), response.Header)
+		// Remove hop-by-hop headers.
+		utils.RemoveHeaders(w.Header(), HopHeaders...)
+	}
+	if hop := f.traceHop(req.URL); hop != "" {
+		prependTrace(w.Header(), hop)
+	}
+	f.setAltSvc(w.Header())
+	if response.StatusCode == http.StatusNoContent || response.StatusCode < 200 {
+		// these responses must not have a Content-Length, RFC 7230 section 3.3.2
+		w.Header().Del(ContentLength)
+	}
+	if f.serverTiming {
+		w.Header().Add(ServerTimingHeader, f.serverTimingMetric(req.URL, upstreamTime))
+	}
+	if f.latency != nil {
+		f.latency.record(f.metricsTagOf(req), upstreamTime, ctx.clock.UtcNow().Sub(start)-upstreamTime, ctx)
+	}
+	if f.preserveReason && hasCustomReason(response) && writeWithReason(w, req, response, body, ctx) {
+		response.Body.Close()
+		return
+	}
 	w.WriteHeader(response.StatusCode)
 
-	stream := f.streamResponse
-	if !stream {
-		contentType, err := utils.GetHeaderMediaType(response.Header, ContentType)
-		if err == nil {
-			stream = contentType == "text/event-stream"
-		}
+	if f.cancelOnDisconnect {
+		stop := closeOnDisconnect(req, response)
+		defer stop()
 	}
-	written, err := io.Copy(newResponseFlusher(w, stream), response.Body)
+	written, err := f.buffers.copy(newResponseFlusher(w, stream), body, response.ContentLength)
+	stats.fail(err)
 
 	if req.TLS != nil {
 		ctx.log.Infof("Round trip: %v, code: %v, duration: %v tls:version: %x, tls:resume:%t, tls:csuite:%x, tls:server:%v",
-			req.URL, response.StatusCode, time.Now().UTC().Sub(start),
+			req.URL, response.StatusCode, ctx.clock.UtcNow().Sub(start),
 			req.TLS.Version,
 			req.TLS.DidResume,
 			req.TLS.CipherSuite,
 			req.TLS.ServerName)
 	} else {
 		ctx.log.Infof("Round trip: %v, code: %v, duration: %v",
-			req.URL, response.StatusCode, time.Now().UTC().Sub(start))
+			req.URL, response.StatusCode, ctx.clock.UtcNow().Sub(start))
 	}
 
 	defer response.Body.Close()
 
 	if err != nil {
+		if f.cancelOnDisconnect && req.Context().Err() != nil {
+			atomic.AddInt64(&f.disconnects, 1)
+			ctx.log.Infof("Client went away, abandoning the response from %v after %v bytes", req.URL, written)
+			return
+		}
+		if isTruncated(body.err) {
+			// the status line is already sent, closing the connection is the only way to
+			// tell the client the response is incomplete
+			atomic.AddInt64(&f.truncated, 1)
+			ctx.log.Errorf("Response from %v was truncated after %v bytes, aborting: %v", req.URL, written, err)
+			panic(http.ErrAbortHandler)
+		}
 		ctx.log.Errorf("Error copying upstream response Body: %v", err)
 		ctx.errHandler.ServeHTTP(w, req, err)
 		return
 	}
 
+	// the trailers are only known once the body is read, e.g. grpc-status
+	for k, vv := range response.Trailer {
+		w.Header()[http.TrailerPrefix+k] = vv
+	}
+
 	if written != 0 {
 		w.Header().Set(ContentLength, strconv.FormatInt(written, 10))
 	}
 }
 
+// copyHeadersLimited copies up to maxResponseHeaders end-to-end header fields from the upstream response.
+// Header names are copied in sorted order, so the same fields are kept for the same response.
+func (f *httpForwarder) copyHeadersLimited(dst, src http.Header, ctx *handlerContext) {
+	headers := make(http.Header, len(src))
+	utils.CopyHeaders(headers, src)
+	// Remove hop-by-hop headers.
+	utils.RemoveHeaders(headers, HopHeaders...)
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	copied, dropped := 0, 0
+	for _, name := range names {
+		for _, value := range headers[name] {
+			if copied >= f.maxResponseHeaders {
+				dropped++
+				continue
+			}
+			dst.Add(name, value)
+			copied++
+		}
+	}
+	if dropped != 0 {
+		ctx.log.Warningf("Dropped %v upstream response header fields over the limit of %v", dropped, f.maxResponseHeaders)
+	}
+}
+
+// serverTimingMetric formats the upstream metric of the Server-Timing header
+func (f *httpForwarder) serverTimingMetric(u *url.URL, d time.Duration) string {
+	metric := "upstream;dur=" + strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	if f.serverTimingBackend {
+		metric += ";desc=" + strconv.Quote(u.Host)
+	}
+	return metric
+}
+
 // copyRequest makes a copy of the specified request to be sent using the configured
 // transport
 func (f *httpForwarder) copyRequest(req *http.Request, u *url.URL) *http.Request {
@@ -237,24 +804,72 @@ func (f *httpForwarder) copyRequest(req *http.Request, u *url.URL) *http.Request
 	if !f.passHost {
 		outReq.Host = u.Host
 	}
-	outReq.Proto = "HTTP/1.1"
-	outReq.ProtoMajor = 1
-	outReq.ProtoMinor = 1
+	if f.http3 {
+		outReq.Proto = "HTTP/3.0"
+		outReq.ProtoMajor = 3
+		outReq.ProtoMinor = 0
+	} else if f.grpc {
+		outReq.Proto = "HTTP/2.0"
+		outReq.ProtoMajor = 2
+		outReq.ProtoMinor = 0
+	} else {
+		outReq.Proto = "HTTP/1.1"
+		outReq.ProtoMajor = 1
+		outReq.ProtoMinor = 1
+	}
 
 	// Overwrite close flag so we can keep persistent connection for the backend servers
-	outReq.Close = false
+	outReq.Close = !isKeepAlive(req)
+
+	// the HTTP/2 upload streams are forwarded as they arrive: a body of unknown length must not be
+	// probed or buffered by the transport to find its length
+	if req.ProtoMajor == 2 && req.ContentLength <= 0 && req.Body != nil && req.Body != http.NoBody {
+		outReq.ContentLength = -1
+	}
 
 	outReq.Header = make(http.Header)
 	utils.CopyHeaders(outReq.Header, req.Header)
+	// the streaming directive is meant for the proxy only
+	outReq.Header.Del(XProxyStream)
 
 	if f.rewriter != nil {
 		f.rewriter.Rewrite(outReq)
 	}
+	// the rewriter sees the Host of the backend, X-Forwarded-Host is the one of the client
+	if rw, ok := f.rewriter.(*HeaderRewriter); ok && !f.passHost {
+		rw.setForwardedHost(outReq, req)
+	}
+	// the rewriter strips TE as a hop-by-hop header, the gRPC servers reject the requests without it
+	if f.grpc && acceptsTrailers(req) {
+		outReq.Header.Set(Te, "trailers")
+	}
+	if f.omitForwardedHost {
+		outReq.Header.Del(XForwardedHost)
+	}
+	f.setAcceptEncoding(outReq)
+	setHeaders(outReq, req)
+	if hop := f.traceHop(u); hop != "" {
+		appendTrace(outReq.Header, hop)
+	}
+	normalizeURL(outReq.URL, f.cleanPath, f.normalizePath)
+	if f.forwardClientCert {
+		setClientCertHeaders(outReq.Header, req.TLS)
+	}
 	return outReq
 }
 
 // serveHTTP forwards websocket traffic
 func (f *websocketForwarder) serveHTTP(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
+	if name, ok := f.disallowedSubprotocol(req); ok {
+		ctx.log.Infof("Rejecting websocket upgrade to %v, subprotocol %q is not allowed", req.URL, name)
+		ctx.errHandler.ServeHTTP(w, req, &StatusError{Code: http.StatusBadRequest, Reason: "subprotocol not allowed"})
+		return
+	}
+	if !f.acquireTunnel() {
+		f.rejectTunnel(w, req, ctx)
+		return
+	}
+	defer f.releaseTunnel()
 	outReq := f.copyRequest(req)
 	host := outReq.URL.Host
 
@@ -273,13 +888,35 @@ func (f *websocketForwarder) serveHTTP(w http.ResponseWriter, req *http.Request,
 		ctx.errHandler.ServeHTTP(w, req, err)
 		return
 	}
+	defer targetConn.Close()
+
+	// write the modified incoming request to the dialed connection
+	if err = outReq.Write(targetConn); err != nil {
+		ctx.log.Errorf("Unable to copy request to target: %v", err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	// the connection is only spliced once the backend accepts the upgrade
+	targetReader := bufio.NewReader(targetConn)
+	response, err := http.ReadResponse(targetReader, outReq)
+	if err != nil {
+		ctx.log.Errorf("Error reading the upgrade response from %v: %v", host, err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		ctx.log.Warningf("Backend %v refused the websocket upgrade with %v", host, response.Status)
+		f.refuseUpgrade(w, response, ctx)
+		return
+	}
+
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		ctx.log.Errorf("Unable to hijack the connection: does not implement http.Hijacker")
-		ctx.errHandler.ServeHTTP(w, req, err)
+		ctx.errHandler.ServeHTTP(w, req, fmt.Errorf("%v does not implement http.Hijacker", reflect.TypeOf(w)))
 		return
 	}
-	underlyingConn, _, err := hijacker.Hijack()
+	underlyingConn, clientReader, err := hijacker.Hijack()
 	if err != nil {
 		ctx.log.Errorf("Unable to hijack the connection: %v %v", reflect.TypeOf(w), err)
 		ctx.errHandler.ServeHTTP(w, req, err)
@@ -287,22 +924,41 @@ func (f *websocketForwarder) serveHTTP(w http.ResponseWriter, req *http.Request,
 	}
 	// it is now caller's responsibility to Close the underlying connection
 	defer underlyingConn.Close()
-	defer targetConn.Close()
 
-	// write the modified incoming request to the dialed connection
-	if err = outReq.Write(targetConn); err != nil {
-		ctx.log.Errorf("Unable to copy request to target: %v", err)
-		ctx.errHandler.ServeHTTP(w, req, err)
+	if err = response.Write(underlyingConn); err != nil {
+		ctx.log.Errorf("Unable to copy the upgrade response to the client: %v", err)
 		return
 	}
+	// the handler waits for the pumps, see WebsocketGoroutinesMetric
+	atomic.AddInt64(&f.goroutines, goroutinesPerTunnel)
 	errc := make(chan error, 2)
 	replicate := func(dst io.Writer, src io.Reader) {
 		_, err := io.Copy(dst, src)
+		atomic.AddInt64(&f.goroutines, -1)
 		errc <- err
 	}
-	go replicate(targetConn, underlyingConn)
-	go replicate(underlyingConn, targetConn)
+	untrack := f.drainer.track(func() {
+		underlyingConn.Close()
+		targetConn.Close()
+	})
+	defer untrack()
+	if f.maxSession > 0 {
+		timer := time.AfterFunc(f.maxSession, func() {
+			ctx.log.Infof("Closing websocket session to %v after %v", host, f.maxSession)
+			underlyingConn.Close()
+			targetConn.Close()
+		})
+		defer timer.Stop()
+	}
+	// the readers hold the bytes already read past the handshakes
+	go replicate(targetConn, clientReader)
+	go replicate(underlyingConn, targetReader)
 	<-errc
+	// closing the connections stops the other pump, so the tunnel is gone once the handler returns
+	underlyingConn.Close()
+	targetConn.Close()
+	<-errc
+	atomic.AddInt64(&f.goroutines, -1)
 }
 
 // copyRequest makes a copy of the specified request.
@@ -312,6 +968,23 @@ func (f *websocketForwarder) copyRequest(req *http.Request) (outReq *http.Reques
 	outReq.URL = utils.CopyURL(req.URL)
 	outReq.URL.Scheme = req.URL.Scheme
 	outReq.URL.Host = req.URL.Host
+	normalizeURL(outReq.URL, f.cleanPath, f.normalizePath)
+
+	if f.rewriteOrigin != nil || f.forwardClientCert || req.Context().Value(headersKey{}) != nil {
+		outReq.Header = make(http.Header)
+		utils.CopyHeaders(outReq.Header, req.Header)
+		setHeaders(outReq, req)
+	}
+	if f.rewriteOrigin != nil {
+		if origin := f.rewriteOrigin(req.Header.Get(Origin)); origin != "" {
+			outReq.Header.Set(Origin, origin)
+		} else {
+			outReq.Header.Del(Origin)
+		}
+	}
+	if f.forwardClientCert {
+		setClientCertHeaders(outReq.Header, req.TLS)
+	}
 	return outReq
 }
 
@@ -329,3 +1002,26 @@ func isWebsocketRequest(req *http.Request) bool {
 	}
 	return containsHeader(Connection, "upgrade") && containsHeader(Upgrade, "websocket")
 }
+
+// bodyAllowedForStatus tells whether the response can have a body, RFC 7230 section 3.3.3
+func bodyAllowedForStatus(code int) bool {
+	switch {
+	case code >= 100 && code <= 199:
+		return false
+	case code == http.StatusNoContent, code == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// refuseUpgrade relays the response of the backend refusing the websocket upgrade as a regular response,
+// so the client gets a clean error instead of a hung connection
+func (f *websocketForwarder) refuseUpgrade(w http.ResponseWriter, response *http.Response, ctx *handlerContext) {
+	defer response.Body.Close()
+	utils.CopyHeaders(w.Header(), response.Header)
+	utils.RemoveHeaders(w.Header(), HopHeaders...)
+	w.WriteHeader(response.StatusCode)
+	if _, err := io.Copy(w, response.Body); err != nil {
+		ctx.log.Errorf("Error copying the response refusing the upgrade: %v", err)
+	}
+}
@@ -1,18 +1,40 @@
 package forward
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/mailgun/timetools"
 	"github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/oxy/utils"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/net/websocket"
 	. "gopkg.in/check.v1"
 	"io"
@@ -159,6 +181,69 @@ func (s *FwdSuite) TestCustomRewriter(c *C) {
 	c.Assert(strings.Contains(outHeaders.Get(XForwardedFor), "192.168.1.1"), Equals, false)
 }
 
+func (s *FwdSuite) TestForwardedHost(c *C) {
+	var outHost, outForwardedHost string
+	var hasForwardedHost bool
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outHost = req.Host
+		outForwardedHost = req.Header.Get(XForwardedHost)
+		_, hasForwardedHost = req.Header[XForwardedHost]
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	get := func(f *Forwarder, opts ...testutils.ReqOption) {
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+		defer proxy.Close()
+		re, _, err := testutils.Get(proxy.URL, append(opts, testutils.Host("client.example.com"))...)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+	}
+
+	// the backend gets its own host and the one of the client in X-Forwarded-Host
+	f, err := New()
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().ForwardedHostHeader, Equals, true)
+	get(f)
+	c.Assert(outHost, Equals, testutils.ParseURI(srv.URL).Host)
+	c.Assert(outForwardedHost, Equals, "client.example.com")
+
+	f, err = New(PassHostHeader(true))
+	c.Assert(err, IsNil)
+	get(f)
+	c.Assert(outHost, Equals, "client.example.com")
+	c.Assert(outForwardedHost, Equals, "client.example.com")
+
+	// the trusted value of the previous proxy is kept
+	get(f, testutils.Header(XForwardedHost, "edge.example.com"))
+	c.Assert(outForwardedHost, Equals, "edge.example.com")
+
+	f, err = New(Rewriter(&HeaderRewriter{TrustForwardHeader: false}))
+	c.Assert(err, IsNil)
+	get(f, testutils.Header(XForwardedHost, "edge.example.com"))
+	c.Assert(outForwardedHost, Equals, "client.example.com")
+
+	f, err = New(ForwardedHostHeader(false))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().ForwardedHostHeader, Equals, false)
+	get(f, testutils.Header(XForwardedHost, "edge.example.com"))
+	c.Assert(hasForwardedHost, Equals, false)
+
+	// the custom rewriters see the host of the backend, and the host they set is kept
+	var rewrittenHost string
+	f, err = New(Rewriter(rewriterFunc(func(req *http.Request) {
+		rewrittenHost = req.Host
+		req.Host = "custom.example.com"
+	})))
+	c.Assert(err, IsNil)
+	get(f)
+	c.Assert(rewrittenHost, Equals, testutils.ParseURI(srv.URL).Host)
+	c.Assert(outHost, Equals, "custom.example.com")
+}
+
 func (s *FwdSuite) TestCustomTransportTimeout(c *C) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		time.Sleep(20 * time.Millisecond)
@@ -414,3 +499,2861 @@ func (s *FwdSuite) TestResponseFlusher(c *C) {
 	}
 	c.Assert(err, Equals, io.EOF)
 }
+
+func (s *FwdSuite) TestBufferResponse(c *C) {
+	payload := strings.Repeat("a", 10*1024)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		// flush first to force chunked transfer encoding from the backend
+		w.(http.Flusher).Flush()
+		w.Write([]byte(payload))
+	})
+	defer srv.Close()
+
+	f, err := New(BufferResponse(64 * 1024))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.ContentLength, Equals, int64(len(payload)))
+	c.Assert(string(body), Equals, payload)
+}
+
+func (s *FwdSuite) TestBufferResponseOverLimitStreams(c *C) {
+	payload := strings.Repeat("a", 10*1024)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.(http.Flusher).Flush()
+		w.Write([]byte(payload))
+	})
+	defer srv.Close()
+
+	f, err := New(BufferResponse(1024))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.ContentLength, Equals, int64(-1))
+	c.Assert(string(body), Equals, payload)
+}
+
+func (s *FwdSuite) TestBufferResponseExcludesStreaming(c *C) {
+	_, err := New(BufferResponse(1024), StreamResponse(true))
+	c.Assert(err, NotNil)
+
+	_, err = New(BufferResponse(0))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestStreamDecider(c *C) {
+	payload := strings.Repeat("a", 1024)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ContentType, req.URL.Query().Get("type"))
+		// flush first to force chunked transfer encoding from the backend
+		w.(http.Flusher).Flush()
+		w.Write([]byte(payload))
+	})
+	defer srv.Close()
+
+	decider := func(response *http.Response) bool {
+		contentType, _ := utils.GetHeaderMediaType(response.Header, ContentType)
+		return contentType == "application/octet-stream" || DefaultStreamDecider(response)
+	}
+	f, err := New(BufferResponse(64*1024), StreamDecider(decider))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// the buffered responses get their length
+	re, body, err := testutils.Get(proxy.URL + "/?type=application/json")
+	c.Assert(err, IsNil)
+	c.Assert(re.ContentLength, Equals, int64(len(payload)))
+	c.Assert(string(body), Equals, payload)
+
+	for _, contentType := range []string{"application/octet-stream", "text/event-stream"} {
+		re, body, err = testutils.Get(proxy.URL + "/?type=" + contentType)
+		c.Assert(err, IsNil)
+		c.Assert(re.ContentLength, Equals, int64(-1))
+		c.Assert(string(body), Equals, payload)
+	}
+
+	_, err = New(StreamDecider(nil))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestNoBodyStatuses(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/no-content":
+			// a stray length sent by the backend
+			conn, rw, _ := w.(http.Hijacker).Hijack()
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 204 No Content\r\nContent-Length: 0\r\nX-Status: 204\r\n\r\n")
+			rw.Flush()
+		case "/not-modified":
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusNotModified)
+		}
+	})
+	defer srv.Close()
+
+	for _, opts := range [][]optSetter{nil, {BufferResponse(1024)}, {StreamResponse(true)}} {
+		f, err := New(opts...)
+		c.Assert(err, IsNil)
+
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			path := req.URL.Path
+			req.URL = testutils.ParseURI(srv.URL)
+			req.URL.Path = path
+			f.ServeHTTP(w, req)
+		})
+
+		re, body, err := testutils.Get(proxy.URL + "/no-content")
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusNoContent)
+		c.Assert(re.Header.Get("X-Status"), Equals, "204")
+		c.Assert(re.Header.Get(ContentLength), Equals, "")
+		c.Assert(len(body), Equals, 0)
+
+		re, body, err = testutils.Get(proxy.URL + "/not-modified")
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusNotModified)
+		c.Assert(re.Header.Get("ETag"), Equals, `"v1"`)
+		c.Assert(re.Header.Get(ContentLength), Equals, "")
+		c.Assert(len(body), Equals, 0)
+
+		proxy.Close()
+
+		// net/http drops them too, unlike the other response writers
+		for _, path := range []string{"/no-content", "/not-modified"} {
+			rec := httptest.NewRecorder()
+			req, err := http.NewRequest("GET", srv.URL+path, nil)
+			c.Assert(err, IsNil)
+			req.RequestURI = path
+			f.ServeHTTP(rec, req)
+			c.Assert(rec.Header().Get(ContentLength), Equals, "")
+			c.Assert(rec.Body.Len(), Equals, 0)
+		}
+	}
+}
+
+func (s *FwdSuite) TestServerTiming(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ServerTimingHeader, "db;dur=1")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(ServerTiming(true))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	timings := re.Header[ServerTimingHeader]
+	c.Assert(len(timings), Equals, 2)
+	c.Assert(timings[0], Equals, "db;dur=1")
+	c.Assert(strings.HasPrefix(timings[1], "upstream;dur="), Equals, true)
+	c.Assert(strings.Contains(timings[1], "desc"), Equals, false)
+}
+
+func (s *FwdSuite) TestServerTimingBackend(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New(ServerTiming(true), ServerTimingBackend(true))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(strings.HasSuffix(re.Header.Get(ServerTimingHeader), fmt.Sprintf(";desc=%q", srv.Listener.Addr().String())), Equals, true)
+}
+
+func (s *FwdSuite) TestServerTimingDisabled(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.Header.Get(ServerTimingHeader), Equals, "")
+}
+
+func (s *FwdSuite) TestMaxResponseHeaders(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 500; i++ {
+			w.Header().Add(fmt.Sprintf("X-Item-%03d", i), "value")
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	buf := &bytes.Buffer{}
+	f, err := New(MaxResponseHeaders(10), Logger(utils.NewFileLogger(buf, utils.WARN)))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hello")
+
+	items := 0
+	for name := range re.Header {
+		if strings.HasPrefix(name, "X-Item-") {
+			items++
+		}
+	}
+	c.Assert(items > 0 && items <= 10, Equals, true, Commentf("got %v items", items))
+	c.Assert(strings.Contains(buf.String(), "over the limit of 10"), Equals, true)
+}
+
+// Makes sure all Set-Cookie headers from the backend reach the client
+func (s *FwdSuite) TestMultipleSetCookies(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "csrf", Value: "2"})
+		http.SetCookie(w, &http.Cookie{Name: "lang", Value: "3"})
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	for _, opts := range [][]optSetter{nil, {MaxResponseHeaders(100)}, {BufferResponse(1024)}} {
+		f, err := New(opts...)
+		c.Assert(err, IsNil)
+
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+
+		re, _, err := testutils.Get(proxy.URL)
+		proxy.Close()
+		c.Assert(err, IsNil)
+		c.Assert(re.Header["Set-Cookie"], DeepEquals, []string{"session=1", "csrf=2", "lang=3"})
+	}
+}
+
+func (s *FwdSuite) TestProblemJSONErrors(c *C) {
+	f, err := New(ProblemJSONErrors("https://example.com/problems"))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost:63450")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(re.Header.Get(ContentType), Equals, "application/problem+json")
+	c.Assert(strings.Contains(string(body), `"type":"https://example.com/problems/upstream-unavailable"`), Equals, true)
+	c.Assert(strings.Contains(string(body), "63450"), Equals, false)
+}
+
+func (s *FwdSuite) TestExpectContinueRejected(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+	})
+	defer srv.Close()
+
+	f, err := New(ExpectContinueTimeout(time.Second))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	host := testutils.ParseURI(proxy.URL).Host
+	conn, err := net.Dial("tcp", host)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the body is never sent, the proxy would block if it tried to read it
+	_, err = fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: %v\r\nExpect: 100-continue\r\nContent-Length: 1048576\r\n\r\n", host)
+	c.Assert(err, IsNil)
+
+	re, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(re.Close, Equals, true)
+
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "unauthorized")
+}
+
+func (s *FwdSuite) TestExpectContinueAccepted(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	})
+	defer srv.Close()
+
+	f, err := New(ExpectContinueTimeout(time.Second))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	host := testutils.ParseURI(proxy.URL).Host
+	conn, err := net.Dial("tcp", host)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: %v\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n", host)
+	c.Assert(err, IsNil)
+
+	reader := bufio.NewReader(conn)
+	re, err := http.ReadResponse(reader, nil)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusContinue)
+
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, IsNil)
+
+	re, err = http.ReadResponse(reader, nil)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+}
+
+func (s *FwdSuite) TestExpectContinueTimeoutWithRoundTripper(c *C) {
+	_, err := New(ExpectContinueTimeout(time.Second), RoundTripper(http.DefaultTransport))
+	c.Assert(err, NotNil)
+
+	_, err = New(ExpectContinueTimeout(-time.Second))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestConfig(c *C) {
+	f, err := New(PassHostHeader(true), BufferResponse(1024), ServerTiming(true), MaxResponseHeaders(10),
+		ExpectContinueTimeout(2*time.Second), ChaosAbort(0.5, http.StatusServiceUnavailable))
+	c.Assert(err, IsNil)
+
+	c.Assert(f.Config(), DeepEquals, ForwarderConfig{
+		PassHostHeader:        true,
+		ForwardedHostHeader:   true,
+		BufferResponseBytes:   1024,
+		ServerTiming:          true,
+		MaxResponseHeaders:    10,
+		ExpectContinueTimeout: 2 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ChaosAbortProbability: 0.5,
+		ChaosAbortStatus:      http.StatusServiceUnavailable,
+	})
+
+	f, err = New(StreamResponse(true), RoundTripper(&http.Transport{ResponseHeaderTimeout: time.Second}))
+	c.Assert(err, IsNil)
+
+	config := f.Config()
+	c.Assert(config.StreamResponse, Equals, true)
+	c.Assert(config.PassHostHeader, Equals, false)
+	c.Assert(config.ResponseHeaderTimeout, Equals, time.Second)
+}
+
+func (s *FwdSuite) TestConnMaxLifetime(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.RemoteAddr))
+	})
+	defer srv.Close()
+
+	f, err := New(ConnMaxLifetime(200 * time.Millisecond))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().ConnMaxLifetime, Equals, 200*time.Millisecond)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	_, first, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+
+	// the connection is reused within its lifetime
+	_, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, string(first))
+
+	time.Sleep(300 * time.Millisecond)
+
+	// and recycled once it has expired
+	_, body, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Not(Equals), string(first))
+}
+
+func (s *FwdSuite) TestConnMaxLifetimeWithRoundTripper(c *C) {
+	_, err := New(ConnMaxLifetime(time.Second), RoundTripper(http.DefaultTransport))
+	c.Assert(err, NotNil)
+
+	_, err = New(ConnMaxLifetime(-time.Second))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestMaxConnectionsPerClient(c *C) {
+	release := make(chan bool)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(MaxConnectionsPerClient(1))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	done := make(chan int)
+	go func() {
+		re, _, err := testutils.Get(proxy.URL + "/slow")
+		c.Assert(err, IsNil)
+		done <- re.StatusCode
+	}()
+	waitForConnections(f, "127.0.0.1", 1)
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusTooManyRequests)
+
+	// the client sets X-Forwarded-For, so it does not reset the count
+	re, _, err = testutils.Get(proxy.URL, testutils.Header(XForwardedFor, "10.0.0.1"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusTooManyRequests)
+
+	close(release)
+	c.Assert(<-done, Equals, http.StatusOK)
+
+	re, _, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *FwdSuite) TestMaxConnectionsPerClientTrustedProxies(c *C) {
+	release := make(chan bool)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(MaxConnectionsPerClient(1), ClientTrustedProxies("127.0.0.1", "192.168.0.0/16"))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	get := func(xff string) int {
+		re, _, err := testutils.Get(proxy.URL, testutils.Header(XForwardedFor, xff))
+		c.Assert(err, IsNil)
+		return re.StatusCode
+	}
+
+	done := make(chan int)
+	go func() {
+		re, _, err := testutils.Get(proxy.URL+"/slow", testutils.Header(XForwardedFor, "10.0.0.1"))
+		c.Assert(err, IsNil)
+		done <- re.StatusCode
+	}()
+	waitForConnections(f, "10.0.0.1", 1)
+
+	c.Assert(get("10.0.0.1"), Equals, http.StatusTooManyRequests)
+	// the entries on the left of the client are set by the client
+	c.Assert(get("1.2.3.4, 10.0.0.1"), Equals, http.StatusTooManyRequests)
+	// and the ones on its right by the trusted proxies
+	c.Assert(get("10.0.0.1, 192.168.1.1"), Equals, http.StatusTooManyRequests)
+	// other clients are not affected
+	c.Assert(get("10.0.0.2"), Equals, http.StatusOK)
+
+	close(release)
+	c.Assert(<-done, Equals, http.StatusOK)
+	c.Assert(get("10.0.0.1"), Equals, http.StatusOK)
+
+	_, err = New(ClientTrustedProxies("10.0.0.0/33"))
+	c.Assert(err, NotNil)
+	_, err = New(ClientTrustedProxies("proxy"))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestMaxConnectionsPerClientWebsocket(c *C) {
+	f, err := New(MaxConnectionsPerClient(1))
+	c.Assert(err, IsNil)
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		mux.ServeHTTP(w, req)
+	})
+	defer srv.Close()
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	proxyAddr := proxy.Listener.Addr().String()
+	conn, err := websocket.Dial(fmt.Sprintf("ws://%s/ws", proxyAddr), "", "http://localhost")
+	c.Assert(err, IsNil)
+	waitForConnections(f, "127.0.0.1", 1)
+
+	_, err = sendWebsocketRequest(proxyAddr, "/ws", "echo", c)
+	c.Assert(err, NotNil)
+
+	// the slot is released on teardown
+	conn.Close()
+	waitForConnections(f, "127.0.0.1", 0)
+
+	resp, err := sendWebsocketRequest(proxyAddr, "/ws", "echo", c)
+	c.Assert(err, IsNil)
+	c.Assert(resp, Equals, "echo")
+}
+
+func (s *FwdSuite) TestWebsocketMaxSessionDuration(c *C) {
+	f, err := New(WebsocketMaxSessionDuration(100 * time.Millisecond))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().WebsocketMaxSessionDuration, Equals, 100*time.Millisecond)
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		mux.ServeHTTP(w, req)
+	})
+	defer srv.Close()
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	start := time.Now()
+	conn, err := websocket.Dial(fmt.Sprintf("ws://%s/ws", proxy.Listener.Addr().String()), "", "http://localhost")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// the session is active until it is closed
+	c.Assert(websocket.Message.Send(conn, "echo"), IsNil)
+	var msg string
+	c.Assert(websocket.Message.Receive(conn, &msg), IsNil)
+	c.Assert(msg, Equals, "echo")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = websocket.Message.Receive(conn, &msg)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(time.Since(start) >= 100*time.Millisecond, Equals, true)
+
+	_, err = New(WebsocketMaxSessionDuration(-time.Second))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestWebsocketAllowedSubprotocols(c *C) {
+	f, err := New(WebsocketAllowedSubprotocols("chat", "chat.v2"))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().WebsocketAllowedSubprotocols, DeepEquals, []string{"chat", "chat.v2"})
+
+	var upgrades int32
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&upgrades, 1)
+		mux.ServeHTTP(w, req)
+	})
+	defer srv.Close()
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	proxyAddr := proxy.Listener.Addr().String()
+	conn, err := websocket.Dial(fmt.Sprintf("ws://%s/ws", proxyAddr), "chat", "http://localhost")
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	// no subprotocol at all is fine
+	conn, err = websocket.Dial(fmt.Sprintf("ws://%s/ws", proxyAddr), "", "http://localhost")
+	c.Assert(err, IsNil)
+	conn.Close()
+	c.Assert(atomic.LoadInt32(&upgrades), Equals, int32(2))
+
+	re, _, err := testutils.Get(proxy.URL+"/ws",
+		testutils.Header(Connection, "Upgrade"),
+		testutils.Header(Upgrade, "websocket"),
+		testutils.Header(SecWebsocketProtocol, "chat, admin"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(atomic.LoadInt32(&upgrades), Equals, int32(2))
+
+	_, err = New(WebsocketAllowedSubprotocols(""))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestWebsocketGoroutines(c *C) {
+	f, err := New(MaxWebsocketConnections(2))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().MaxWebsocketConnections, Equals, 2)
+
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		mux.ServeHTTP(w, req)
+	})
+	defer srv.Close()
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	waitFor := func(n int64) {
+		for i := 0; i < 100 && f.WebsocketGoroutines() != n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(f.WebsocketGoroutines(), Equals, n)
+	}
+	dial := func() (*websocket.Conn, error) {
+		return websocket.Dial(fmt.Sprintf("ws://%s/ws", proxy.Listener.Addr().String()), "", "http://localhost")
+	}
+
+	first, err := dial()
+	c.Assert(err, IsNil)
+	waitFor(3)
+	second, err := dial()
+	c.Assert(err, IsNil)
+	waitFor(6)
+
+	// the tunnels over the limit are rejected
+	_, err = dial()
+	c.Assert(err, NotNil)
+	waitFor(6)
+
+	first.Close()
+	waitFor(3)
+	third, err := dial()
+	c.Assert(err, IsNil)
+	waitFor(6)
+
+	second.Close()
+	third.Close()
+	waitFor(0)
+
+	_, err = New(MaxWebsocketConnections(0))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestWebsocketUpgradeRefused(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Refused", "yes")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no websockets here"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL,
+		testutils.Header(Connection, "Upgrade"), testutils.Header(Upgrade, "websocket"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(re.Header.Get("X-Refused"), Equals, "yes")
+	c.Assert(string(body), Equals, "no websockets here")
+	c.Assert(f.WebsocketGoroutines(), Equals, int64(0))
+}
+
+func (s *FwdSuite) TestMaxConcurrentPerKey(c *C) {
+	release := make(chan bool)
+	var inflight, maxInflight int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Api-Key") == "busy" {
+			n := atomic.AddInt32(&inflight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInflight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&inflight, -1)
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	key := func(req *http.Request) string {
+		return req.Header.Get("X-Api-Key")
+	}
+	f, err := New(MaxConcurrentPerKey(key, 3))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			re, _, err := testutils.Get(proxy.URL, testutils.Header("X-Api-Key", "busy"))
+			c.Assert(err, IsNil)
+			codes <- re.StatusCode
+		}()
+	}
+
+	// the requests over the limit are rejected right away
+	counts := map[int]int{}
+	for i := 0; i < 7; i++ {
+		counts[<-codes]++
+	}
+	c.Assert(counts, DeepEquals, map[int]int{http.StatusTooManyRequests: 7})
+
+	// other keys and the requests without key are not affected
+	re, _, err := testutils.Get(proxy.URL, testutils.Header("X-Api-Key", "other"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	re, _, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		c.Assert(<-codes, Equals, http.StatusOK)
+	}
+	c.Assert(atomic.LoadInt32(&maxInflight), Equals, int32(3))
+
+	// the idle keys are dropped
+	for i := 0; i < 100 && f.keyLimiter.keys() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(f.keyLimiter.keys(), Equals, 0)
+
+	_, err = New(MaxConcurrentPerKey(nil, 1))
+	c.Assert(err, NotNil)
+	_, err = New(MaxConcurrentPerKey(key, 0))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestMaxConcurrentRequests(c *C) {
+	entered := make(chan bool, 10)
+	release := make(chan bool)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		entered <- true
+		<-release
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(MaxConcurrentRequests(2))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().MaxConcurrentRequests, Equals, 2)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			re, _, err := testutils.Get(proxy.URL)
+			c.Assert(err, IsNil)
+			codes <- re.StatusCode
+		}()
+		<-entered
+	}
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(re.Header.Get(RetryAfter), Equals, "1")
+	c.Assert(f.OverloadRejections(), Equals, int64(1))
+
+	close(release)
+	c.Assert(<-codes, Equals, http.StatusOK)
+	c.Assert(<-codes, Equals, http.StatusOK)
+
+	// the slots are released
+	re, _, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(f.OverloadRejections(), Equals, int64(1))
+}
+
+func (s *FwdSuite) TestOverloadQueueTimeout(c *C) {
+	entered := make(chan bool, 10)
+	release := make(chan bool)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		entered <- true
+		<-release
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(MaxConcurrentRequests(1), OverloadQueueTimeout(5*time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().OverloadQueueTimeout, Equals, 5*time.Second)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	codes := make(chan int, 2)
+	get := func() {
+		re, _, err := testutils.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		codes <- re.StatusCode
+	}
+	go get()
+	<-entered
+
+	// the second request waits for the first one instead of being rejected
+	go get()
+	select {
+	case <-entered:
+		c.Fatalf("the concurrency limit was exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	<-entered
+	release <- true
+
+	c.Assert(<-codes, Equals, http.StatusOK)
+	c.Assert(<-codes, Equals, http.StatusOK)
+	c.Assert(f.OverloadRejections(), Equals, int64(0))
+
+	_, err = New(OverloadQueueTimeout(time.Second))
+	c.Assert(err, NotNil)
+	_, err = New(MaxConcurrentRequests(0))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestQueuePriority(c *C) {
+	entered := make(chan string, 10)
+	release := make(chan bool)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		entered <- req.Header.Get("X-Name")
+		<-release
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(MaxConcurrentRequests(1), OverloadQueueTimeout(5*time.Second),
+		QueuePriority(func(req *http.Request) int {
+			p, _ := strconv.Atoi(req.Header.Get("X-Priority"))
+			return p
+		}))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	codes := make(chan int, 5)
+	get := func(name, priority string) {
+		re, _, err := testutils.Get(proxy.URL, testutils.Header("X-Name", name), testutils.Header("X-Priority", priority))
+		c.Assert(err, IsNil)
+		codes <- re.StatusCode
+	}
+	queued := func(n int) {
+		limiter := f.httpForwarder.overload
+		for i := 0; i < 100; i++ {
+			limiter.mutex.Lock()
+			l := len(limiter.waiting)
+			limiter.mutex.Unlock()
+			if l == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Fatalf("%v requests are not queued", n)
+	}
+
+	go get("first", "0")
+	c.Assert(<-entered, Equals, "first")
+
+	// the higher priorities jump the queue, the same priorities keep their arrival order
+	for i, r := range [][]string{{"batch", "0"}, {"interactive", "10"}, {"batch-2", "0"}, {"normal", "5"}} {
+		go get(r[0], r[1])
+		queued(i + 1)
+	}
+	var order []string
+	for i := 0; i < 4; i++ {
+		release <- true
+		order = append(order, <-entered)
+	}
+	release <- true
+	c.Assert(order, DeepEquals, []string{"interactive", "normal", "batch", "batch-2"})
+	for i := 0; i < 5; i++ {
+		c.Assert(<-codes, Equals, http.StatusOK)
+	}
+	_, err = New(MaxConcurrentRequests(1), QueuePriority(func(*http.Request) int { return 0 }))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestCancelOnClientDisconnect(c *C) {
+	backendDone := make(chan bool, 1)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		defer func() { backendDone <- true }()
+		for {
+			if _, err := w.Write([]byte("data\n")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	})
+	defer srv.Close()
+
+	f, err := New(StreamResponse(true), CancelOnClientDisconnect(true))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().CancelOnClientDisconnect, Equals, true)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, err := http.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(re.Body, buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "data\n")
+	re.Body.Close()
+
+	select {
+	case <-backendDone:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("the backend was not released")
+	}
+	for i := 0; i < 100 && f.ClientDisconnects() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(f.ClientDisconnects(), Equals, int64(1))
+}
+
+func (s *FwdSuite) TestUpstreamError(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer srv.Close()
+
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	failures := make(chan error, 1)
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req = WithUpstreamError(req)
+		if req.URL.Path == "/down" {
+			req.URL = testutils.ParseURI("http://localhost:63450")
+		} else {
+			req.URL = testutils.ParseURI(srv.URL)
+		}
+		f.ServeHTTP(w, req)
+		failures <- UpstreamError(req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL + "/down")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(<-failures, NotNil)
+
+	// the 502 of the upstream is not a failure to reach it
+	re, _, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(<-failures, IsNil)
+}
+
+func waitForConnections(f *Forwarder, ip string, expected int64) {
+	for i := 0; i < 100; i++ {
+		f.clientLimiter.mutex.Lock()
+		conns := f.clientLimiter.conns[ip]
+		f.clientLimiter.mutex.Unlock()
+		if conns == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *FwdSuite) TestBackendClientCert(c *C) {
+	clientCert, clientX509 := newTestCertificate(c)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+
+	withCert, err := New(HTTPTLSClientConfig(&tls.Config{RootCAs: rootCAs}), BackendClientCert(clientCert))
+	c.Assert(err, IsNil)
+	withoutCert, err := New(HTTPTLSClientConfig(&tls.Config{RootCAs: rootCAs}))
+	c.Assert(err, IsNil)
+
+	for _, f := range []*Forwarder{withCert, withoutCert} {
+		fwd := f
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			fwd.ServeHTTP(w, req)
+		})
+
+		re, body, err := testutils.Get(proxy.URL)
+		proxy.Close()
+		c.Assert(err, IsNil)
+		if fwd == withCert {
+			c.Assert(re.StatusCode, Equals, http.StatusOK)
+			c.Assert(string(body), Equals, "oxy client")
+		} else {
+			c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+		}
+	}
+}
+
+func newTestCertificate(c *C) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "oxy client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func (s *FwdSuite) TestShutdown(c *C) {
+	release := make(chan bool)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	inFlight := make(chan int)
+	go func() {
+		re, _, err := testutils.Get(proxy.URL + "/slow")
+		c.Assert(err, IsNil)
+		inFlight <- re.StatusCode
+	}()
+	for i := 0; i < 100 && !hasActiveRequests(f); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- f.shutdownOn(signals, time.Second)
+	}()
+	signals <- syscall.SIGTERM
+
+	// wait for the shutdown to start rejecting the new requests
+	var re *http.Response
+	for i := 0; i < 100; i++ {
+		re, _, err = testutils.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		if re.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	select {
+	case <-done:
+		c.Fatalf("shutdown completed with requests in flight")
+	default:
+	}
+
+	close(release)
+	c.Assert(<-inFlight, Equals, http.StatusOK)
+	c.Assert(<-done, IsNil)
+}
+
+func (s *FwdSuite) TestShutdownTimeout(c *C) {
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	c.Assert(f.drainer.enter(), Equals, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Assert(f.Shutdown(ctx), Equals, context.DeadlineExceeded)
+
+	f.drainer.leave()
+	c.Assert(f.Shutdown(context.Background()), IsNil)
+}
+
+func (s *FwdSuite) TestShutdownClosesTunnels(c *C) {
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(conn, conn)
+	}))
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte("hello"))
+	})
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	wsURL := fmt.Sprintf("ws://%s/ws", proxy.Listener.Addr().String())
+	conn, err := websocket.Dial(wsURL, "", "http://localhost")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	echo := func() error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		reply := make([]byte, 4)
+		_, err := io.ReadFull(conn, reply)
+		return err
+	}
+	c.Assert(echo(), IsNil)
+
+	inFlight := make(chan int)
+	go func() {
+		re, _, err := testutils.Get(proxy.URL + "/slow")
+		c.Assert(err, IsNil)
+		inFlight <- re.StatusCode
+	}()
+	for i := 0; i < 100 && activeRequests(f) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Shutdown(context.Background())
+	}()
+	for i := 0; i < 100 && !isDraining(f); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the new tunnels are rejected, the open ones work as long as HTTP requests are in flight
+	_, err = websocket.Dial(wsURL, "", "http://localhost")
+	c.Assert(err, NotNil)
+	c.Assert(echo(), IsNil)
+
+	close(release)
+	c.Assert(<-inFlight, Equals, http.StatusOK)
+	select {
+	case err := <-done:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("the tunnel kept the shutdown waiting")
+	}
+	// the tunnel was closed
+	c.Assert(echo(), NotNil)
+}
+
+func (s *FwdSuite) TestHandleSignals(c *C) {
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	done := f.HandleSignals(time.Second, syscall.SIGUSR1)
+	c.Assert(syscall.Kill(os.Getpid(), syscall.SIGUSR1), IsNil)
+
+	select {
+	case err := <-done:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for the shutdown")
+	}
+	c.Assert(f.drainer.enter(), Equals, false)
+}
+
+func hasActiveRequests(f *Forwarder) bool {
+	f.drainer.mutex.Lock()
+	defer f.drainer.mutex.Unlock()
+	return f.drainer.active > 0
+}
+
+func activeRequests(f *Forwarder) int {
+	f.drainer.mutex.Lock()
+	defer f.drainer.mutex.Unlock()
+	return f.drainer.active
+}
+
+func isDraining(f *Forwarder) bool {
+	f.drainer.mutex.Lock()
+	defer f.drainer.mutex.Unlock()
+	return f.drainer.draining
+}
+
+func (s *FwdSuite) TestLatencyHistograms(c *C) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	// the backend takes 50ms, the rewriting 3ms
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		clock.CurrentTime = clock.CurrentTime.Add(50 * time.Millisecond)
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	rw := rewriterFunc(func(req *http.Request) {
+		clock.CurrentTime = clock.CurrentTime.Add(3 * time.Millisecond)
+	})
+
+	f, err := New(Clock(clock), RoundTripper(rt), Rewriter(rw), LatencyHistograms(nil))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+
+	backend, err := f.LatencyHistogram(BackendTimeMetric)
+	c.Assert(err, IsNil)
+	// the histograms have 2 significant figures
+	c.Assert(time.Duration(backend.ValueAtQuantile(100)).Round(time.Millisecond), Equals, 50*time.Millisecond)
+
+	overhead, err := f.LatencyHistogram(ProxyOverheadMetric)
+	c.Assert(err, IsNil)
+	c.Assert(time.Duration(overhead.ValueAtQuantile(100)).Round(time.Millisecond), Equals, 3*time.Millisecond)
+
+	_, err = f.LatencyHistogram("unknown")
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestMetricsTag(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	service := func(req *http.Request) string {
+		return req.Header.Get("X-Service")
+	}
+	f, err := New(LatencyHistograms(nil), MetricsTag(service))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		if req.Header.Get("X-Route") != "" {
+			req = WithMetricsTag(req, req.Header.Get("X-Route"))
+		}
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for _, h := range []string{"X-Service", "X-Service", "X-Route", ""} {
+		opts := []testutils.ReqOption{}
+		switch h {
+		case "X-Service":
+			opts = append(opts, testutils.Header(h, "users"))
+		case "X-Route":
+			opts = append(opts, testutils.Header(h, "orders"), testutils.Header("X-Service", "users"))
+		}
+		re, _, err := testutils.Get(proxy.URL, opts...)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+	}
+
+	c.Assert(f.MetricsTags(), DeepEquals, []string{"orders", "users"})
+
+	users, err := f.TaggedLatencyHistogram("users", BackendTimeMetric)
+	c.Assert(err, IsNil)
+	c.Assert(users.ValueAtQuantile(100) > 0, Equals, true)
+
+	orders, err := f.TaggedLatencyHistogram("orders", ProxyOverheadMetric)
+	c.Assert(err, IsNil)
+	c.Assert(orders.ValueAtQuantile(100) > 0, Equals, true)
+
+	_, err = f.TaggedLatencyHistogram("unknown", BackendTimeMetric)
+	c.Assert(err, NotNil)
+	_, err = f.TaggedLatencyHistogram("users", ConnectionWaitMetric)
+	c.Assert(err, NotNil)
+
+	_, err = New(MetricsTag(service))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestDialMetrics(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	// a fresh transport so the dial isn't skipped by a pooled connection
+	f, err := New(RoundTripper(&http.Transport{}), LatencyHistograms(nil))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+
+	addr := testutils.ParseURI(srv.URL).Host
+	h, err := f.DialHistogram(addr)
+	c.Assert(err, IsNil)
+	c.Assert(h.ValueAtQuantile(100), Not(Equals), int64(0))
+	c.Assert(f.DialErrors(addr), Equals, int64(0))
+
+	_, err = f.DialHistogram("localhost:1")
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestDialMetricsTimeout(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	// the socket setup outlasts the dial timeout
+	dialer := &net.Dialer{
+		Timeout: 50 * time.Millisecond,
+		Control: func(network, address string, conn syscall.RawConn) error {
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		},
+	}
+	f, err := New(RoundTripper(&http.Transport{DialContext: dialer.DialContext}), LatencyHistograms(nil))
+	c.Assert(err, IsNil)
+
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	req.URL = testutils.ParseURI(srv.URL)
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusGatewayTimeout)
+
+	addr := testutils.ParseURI(srv.URL).Host
+	h, err := f.DialHistogram(addr)
+	c.Assert(err, IsNil)
+	c.Assert(time.Duration(h.ValueAtQuantile(100)) >= 50*time.Millisecond, Equals, true)
+	c.Assert(f.DialErrors(addr), Equals, int64(1))
+}
+
+func (s *FwdSuite) TestWebsocketDialMetrics(c *C) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+
+	dial := func(network, address string) (net.Conn, error) {
+		clock.CurrentTime = clock.CurrentTime.Add(200 * time.Millisecond)
+		return nil, fmt.Errorf("dial %v: i/o timeout", address)
+	}
+	f, err := New(Clock(clock), WebsocketDial(dial), LatencyHistograms(nil))
+	c.Assert(err, IsNil)
+
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	req.URL = testutils.ParseURI("ws://backend")
+	req.Header.Set(Connection, "Upgrade")
+	req.Header.Set(Upgrade, "websocket")
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusInternalServerError)
+
+	h, err := f.DialHistogram("backend:80")
+	c.Assert(err, IsNil)
+	c.Assert(time.Duration(h.ValueAtQuantile(100)).Round(time.Millisecond), Equals, 200*time.Millisecond)
+	c.Assert(f.DialErrors("backend:80"), Equals, int64(1))
+}
+
+// newTruncatingBackend returns a backend announcing 10 bytes and hanging up after 5
+// for the first n requests, the next ones get the full body
+func newTruncatingBackend(c *C, n int) (*httptest.Server, *int32) {
+	var requests int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if int(atomic.AddInt32(&requests, 1)) > n {
+			w.Write([]byte("helloworld"))
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello"))
+		conn.Close()
+	})
+	return srv, &requests
+}
+
+func (s *FwdSuite) TestTruncatedResponseAborts(c *C) {
+	srv, _ := newTruncatingBackend(c, 1)
+	defer srv.Close()
+
+	// streaming flushes the status line before the body is cut short
+	f, err := New(StreamResponse(true), RetryTruncatedResponses(true))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	proxy.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	defer proxy.Close()
+
+	// the client sees the connection closed rather than a complete response
+	re, err := http.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+	c.Assert(f.TruncatedResponses(), Equals, int64(1))
+}
+
+func (s *FwdSuite) TestTruncatedResponseRetry(c *C) {
+	srv, requests := newTruncatingBackend(c, 1)
+	defer srv.Close()
+
+	f, err := New(BufferResponse(1024), RetryTruncatedResponses(true))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().RetryTruncatedResponses, Equals, true)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "helloworld")
+	c.Assert(atomic.LoadInt32(requests), Equals, int32(2))
+	c.Assert(f.TruncatedResponses(), Equals, int64(1))
+
+	// requests with a body are not retried
+	atomic.StoreInt32(requests, 0)
+	re, _, err = testutils.MakeRequest(proxy.URL, testutils.Method("PUT"), testutils.Body("data"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusInternalServerError)
+	c.Assert(atomic.LoadInt32(requests), Equals, int32(1))
+	c.Assert(f.TruncatedResponses(), Equals, int64(2))
+}
+
+func (s *FwdSuite) TestCleanPath(c *C) {
+	var outURI string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outURI = req.RequestURI
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	send := func(f *Forwarder, uri string) string {
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+		defer proxy.Close()
+
+		re, _, err := testutils.Get(proxy.URL + uri)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+		return outURI
+	}
+
+	f, err := New(CleanPath(true))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().CleanPath, Equals, true)
+
+	c.Assert(send(f, "//foo"), Equals, "/foo")
+	c.Assert(send(f, "/a//b/./c/../d"), Equals, "/a/b/d")
+	c.Assert(send(f, "/a//b//"), Equals, "/a/b/")
+	c.Assert(send(f, "/a//b?q=/x//y"), Equals, "/a/b?q=/x//y")
+	// the escaped slashes are not path separators
+	c.Assert(send(f, "/a%2F%2Fb//c"), Equals, "/a%2F%2Fb/c")
+	c.Assert(send(f, "/"), Equals, "/")
+
+	// the path is forwarded as is by default
+	f, err = New()
+	c.Assert(err, IsNil)
+	c.Assert(send(f, "/a//b/./c"), Equals, "/a//b/./c")
+}
+
+func (s *FwdSuite) TestNormalizePath(c *C) {
+	var outURI string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outURI = req.RequestURI
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	send := func(f *Forwarder, uri string) string {
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+		defer proxy.Close()
+
+		re, _, err := testutils.Get(proxy.URL + uri)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+		return outURI
+	}
+
+	f, err := New(NormalizePath(true))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().NormalizePath, Equals, true)
+
+	c.Assert(send(f, "//a//b"), Equals, "/a/b")
+	c.Assert(send(f, "/a//b//"), Equals, "/a/b/")
+	c.Assert(send(f, "/a/b/"), Equals, "/a/b/")
+	c.Assert(send(f, "/"), Equals, "/")
+	// the dot segments and the query are left alone
+	c.Assert(send(f, "/a//./b?q=/x//y"), Equals, "/a/./b?q=/x//y")
+
+	// the paths built by the rewriter are normalized too
+	rw := rewriterFunc(func(req *http.Request) {
+		req.URL.Opaque = "/api/" + req.URL.Opaque
+	})
+	f, err = New(NormalizePath(true), Rewriter(rw))
+	c.Assert(err, IsNil)
+	c.Assert(send(f, "/users"), Equals, "/api/users")
+}
+
+func (s *FwdSuite) TestBackendAcceptEncoding(c *C) {
+	var outEncoding string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outEncoding = req.Header.Get(AcceptEncoding)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	send := func(f *Forwarder, opts ...testutils.ReqOption) string {
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+		defer proxy.Close()
+
+		re, body, err := testutils.Get(proxy.URL, opts...)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, "hello")
+		return outEncoding
+	}
+
+	f, err := New(BackendAcceptEncoding("identity"))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().BackendAcceptEncoding, Equals, "identity")
+	c.Assert(send(f, testutils.Header(AcceptEncoding, "gzip, br")), Equals, "identity")
+	c.Assert(send(f), Equals, "identity")
+
+	// the client header is passed through by default
+	f, err = New()
+	c.Assert(err, IsNil)
+	c.Assert(send(f, testutils.Header(AcceptEncoding, "br")), Equals, "br")
+
+	_, err = New(BackendAcceptEncoding(""))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestAltSvc(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(AltSvc, `h3=":8443"; ma=86400`)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	get := func(f *Forwarder) *http.Response {
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+		defer proxy.Close()
+		re, body, err := testutils.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+		c.Assert(string(body), Equals, "hello")
+		return re
+	}
+
+	// passed through by default
+	f, err := New()
+	c.Assert(err, IsNil)
+	c.Assert(get(f).Header.Get(AltSvc), Equals, `h3=":8443"; ma=86400`)
+
+	f, err = New(StripAltSvc())
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().StripAltSvc, Equals, true)
+	_, ok := get(f).Header[AltSvc]
+	c.Assert(ok, Equals, false)
+
+	f, err = New(RewriteAltSvc(`h3=":443"; ma=3600`))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().StripAltSvc, Equals, false)
+	c.Assert(f.Config().AltSvc, Equals, `h3=":443"; ma=3600`)
+	c.Assert(get(f).Header.Get(AltSvc), Equals, `h3=":443"; ma=3600`)
+
+	_, err = New(RewriteAltSvc(""))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestBufferPoolTiers(c *C) {
+	small, large := strings.Repeat("s", 100), strings.Repeat("l", 300*1024)
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("size") == "large" {
+			w.Write([]byte(large))
+			return
+		}
+		w.Write([]byte(small))
+	})
+	defer srv.Close()
+
+	f, err := New(BufferPoolTiers(256*1024, 4*1024, 32*1024, 4*1024))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().BufferPoolTiers, DeepEquals, []int{4 * 1024, 32 * 1024, 256 * 1024})
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.RawQuery
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.RawQuery = query
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		_, body, err := testutils.Get(proxy.URL + "?size=small")
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, small)
+		_, body, err = testutils.Get(proxy.URL + "?size=large")
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, large)
+	}
+
+	// the smallest tier holding the body, the largest one when none does
+	pool := f.httpForwarder.buffers
+	c.Assert(pool.tier(0), Equals, 0)
+	c.Assert(pool.tier(4*1024), Equals, 0)
+	c.Assert(pool.tier(4*1024+1), Equals, 1)
+	c.Assert(pool.tier(1<<20), Equals, 2)
+	// the unknown lengths get io.Copy sized buffers
+	c.Assert(pool.tier(-1), Equals, 1)
+
+	_, err = New(BufferPoolTiers())
+	c.Assert(err, NotNil)
+	_, err = New(BufferPoolTiers(4*1024, 0))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestAuthorizer(c *C) {
+	var forwarded int32
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		atomic.AddInt32(&forwarded, 1)
+		io.Copy(conn, conn)
+	}))
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&forwarded, 1)
+		w.Write([]byte("hello"))
+	})
+	srv := testutils.NewHandler(mux.ServeHTTP)
+	defer srv.Close()
+
+	f, err := New(Authorizer(&BearerTokenAuthorizer{Tokens: []string{"secret", "other"}}))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(srv.URL)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(re.Header.Get(WWWAuthenticate), Equals, "Bearer")
+
+	re, _, err = testutils.Get(proxy.URL, testutils.Header(Authorization, "Bearer wrong"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusForbidden)
+	c.Assert(atomic.LoadInt32(&forwarded), Equals, int32(0))
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header(Authorization, "Bearer other"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(atomic.LoadInt32(&forwarded), Equals, int32(1))
+
+	// the websocket upgrades go through the same check
+	wsURL := fmt.Sprintf("ws://%s/ws", proxy.Listener.Addr().String())
+	_, err = websocket.Dial(wsURL, "", "http://localhost")
+	c.Assert(err, NotNil)
+	c.Assert(atomic.LoadInt32(&forwarded), Equals, int32(1))
+
+	cfg, err := websocket.NewConfig(wsURL, "http://localhost")
+	c.Assert(err, IsNil)
+	cfg.Header.Set(Authorization, "Bearer secret")
+	conn, err := websocket.DialConfig(cfg)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	c.Assert(err, IsNil)
+	c.Assert(string(reply), Equals, "ping")
+	c.Assert(atomic.LoadInt32(&forwarded), Equals, int32(2))
+
+	// the errors without a status code are forbidden
+	f, err = New(Authorizer(authorizerFunc(func(*http.Request) error { return fmt.Errorf("nope") })))
+	c.Assert(err, IsNil)
+	re, _, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusForbidden)
+	c.Assert(re.Header.Get(WWWAuthenticate), Equals, "")
+
+	_, err = New(Authorizer(nil))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestDumpOnError(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	buf := &bytes.Buffer{}
+	f, err := New(DumpOnError(true), Logger(utils.NewFileLogger(buf, utils.INFO)))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().DumpOnError, Equals, true)
+
+	target := srv.URL
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path := req.URL.Path
+		req.URL = testutils.ParseURI(target)
+		req.URL.Path = path
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	headers := http.Header{Authorization: {"Bearer secret"}, Cookie: {"session=secret"}, "X-Request-Id": {"req-1"}}
+	re, _, err := testutils.Get(proxy.URL+"/ok", testutils.Headers(headers))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(buf.String(), Not(Matches), "(?s).*Failed request.*")
+
+	// the 5xx responses are dumped, with the sensitive headers redacted
+	re, _, err = testutils.Get(proxy.URL+"/fail", testutils.Headers(headers))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(buf.String(), Matches, `(?s).*Failed request GET http://.*/fail HTTP/1.1, status: 503, headers: .*Authorization: \[REDACTED\].*`)
+	c.Assert(buf.String(), Matches, `(?s).*Cookie: \[REDACTED\].*X-Request-Id: \[req-1\].*`)
+	c.Assert(strings.Contains(buf.String(), "secret"), Equals, false)
+
+	// and so are the round trip errors, with the configured headers redacted
+	buf.Reset()
+	f, err = New(DumpOnError(true), DumpRedactedHeaders("x-request-id"), Logger(utils.NewFileLogger(buf, utils.INFO)))
+	c.Assert(err, IsNil)
+	target = "http://localhost:63450"
+	re, _, err = testutils.Get(proxy.URL+"/down", testutils.Headers(headers))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(buf.String(), Matches, `(?s).*Failed request GET http://localhost:63450/down HTTP/1.1, error: .*connection refused.*`)
+	c.Assert(buf.String(), Matches, `(?s).*Authorization: \[Bearer secret\].*X-Request-Id: \[REDACTED\].*`)
+}
+
+type authorizerFunc func(*http.Request) error
+
+func (a authorizerFunc) Authorize(req *http.Request) error { return a(req) }
+
+func (s *FwdSuite) TestUpstreamTrace(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get(XOxyTrace)))
+	})
+	defer srv.Close()
+
+	// the last hop hides the backend
+	inner, err := New(UpstreamTrace(func(upstream *url.URL) string {
+		return "backend"
+	}))
+	c.Assert(err, IsNil)
+	innerProxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		inner.ServeHTTP(w, req)
+	})
+	defer innerProxy.Close()
+
+	outer, err := New(UpstreamTrace(nil))
+	c.Assert(err, IsNil)
+	outerProxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(innerProxy.URL)
+		outer.ServeHTTP(w, req)
+	})
+	defer outerProxy.Close()
+
+	trail := testutils.ParseURI(innerProxy.URL).Host + ", backend"
+	re, body, err := testutils.Get(outerProxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, trail)
+	c.Assert(re.Header.Get(XOxyTrace), Equals, trail)
+
+	// the hops left out don't show up
+	skip, err := New(UpstreamTrace(func(upstream *url.URL) string {
+		return ""
+	}))
+	c.Assert(err, IsNil)
+	skipProxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		skip.ServeHTTP(w, req)
+	})
+	defer skipProxy.Close()
+
+	re, body, err = testutils.Get(skipProxy.URL, testutils.Header(XOxyTrace, "edge"))
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "edge")
+	c.Assert(re.Header.Get(XOxyTrace), Equals, "")
+}
+
+func (s *FwdSuite) TestAllowedMethods(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New(AllowedMethods("GET", "HEAD"))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().AllowedMethods, DeepEquals, []string{"GET", "HEAD"})
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for _, method := range []string{"GET", "HEAD"} {
+		re, _, err := testutils.MakeRequest(proxy.URL, testutils.Method(method))
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+	}
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		re, _, err := testutils.MakeRequest(proxy.URL, testutils.Method(method))
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusMethodNotAllowed)
+		c.Assert(re.Header.Get(Allow), Equals, "GET, HEAD")
+	}
+
+	// websocket upgrades are GET requests
+	f, err = New(AllowedMethods("POST"))
+	c.Assert(err, IsNil)
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	req.Header.Set(Connection, "Upgrade")
+	req.Header.Set(Upgrade, "websocket")
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(w.Header().Get(Allow), Equals, "POST")
+
+	// all the methods are allowed by default
+	f, err = New(AllowedMethods())
+	c.Assert(err, IsNil)
+	re, _, err := testutils.MakeRequest(proxy.URL, testutils.Method("DELETE"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+
+	_, err = New(AllowedMethods(""))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestMaxRequestHeaderBytes(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New(MaxRequestHeaderBytes(200))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().MaxRequestHeaderBytes, Equals, 200)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Header("X-Small", strings.Repeat("a", 50)))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hello")
+
+	// the fields add up
+	re, _, err = testutils.Get(proxy.URL,
+		testutils.Header("X-Small", strings.Repeat("a", 50)),
+		testutils.Header("X-Other", strings.Repeat("a", 100)))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusRequestHeaderFieldsTooLarge)
+
+	c.Assert(headerSize(http.Header{"A": {"bc"}, "De": {"f", "gh"}}), Equals, 10)
+
+	_, err = New(MaxRequestHeaderBytes(0))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestConnectionReuseRatio(c *C) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	f, err := New(RoundTripper(&http.Transport{}), LatencyHistograms(nil))
+	c.Assert(err, IsNil)
+
+	keepAlive := true
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, WithKeepAlive(req, keepAlive))
+	})
+	defer proxy.Close()
+
+	ratio, err := f.ConnectionReuseRatio()
+	c.Assert(err, IsNil)
+	c.Assert(ratio, Equals, 0.0)
+
+	// the first request dials, the next three reuse the connection
+	for i := 0; i < 4; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+	}
+	ratio, err = f.ConnectionReuseRatio()
+	c.Assert(err, IsNil)
+	c.Assert(ratio, Equals, 0.75)
+
+	// the backend connections are closed after each request,
+	// only the first one picks the idle connection
+	keepAlive = false
+	for i := 0; i < 4; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+	}
+	ratio, err = f.ConnectionReuseRatio()
+	c.Assert(err, IsNil)
+	c.Assert(ratio, Equals, 0.5)
+
+	f, err = New()
+	c.Assert(err, IsNil)
+	_, err = f.ConnectionReuseRatio()
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestDiscardHeadBody(c *C) {
+	// the backend wrongly sends a body along with the HEAD response
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{ContentLength: []string{"5"}},
+			ContentLength: 5,
+			Body:          ioutil.NopCloser(strings.NewReader("hello")),
+		}, nil
+	})
+
+	send := func(f *Forwarder) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", "http://localhost", nil)
+		req.URL = testutils.ParseURI("http://backend")
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(w.Header().Get(ContentLength), Equals, "5")
+		return w
+	}
+
+	f, err := New(RoundTripper(rt), DiscardHeadBody(true), BufferResponse(1024))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().DiscardHeadBody, Equals, true)
+	c.Assert(send(f).Body.String(), Equals, "")
+
+	// passed through by default
+	f, err = New(RoundTripper(rt))
+	c.Assert(err, IsNil)
+	c.Assert(send(f).Body.String(), Equals, "hello")
+}
+
+func (s *FwdSuite) TestVerboseErrors(c *C) {
+	f, err := New(VerboseErrors(true))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().VerboseErrors, Equals, true)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost:63450")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(re.Header.Get(XProxyError), Equals, ErrorCategoryDial)
+	c.Assert(strings.HasPrefix(string(body), "Bad Gateway: dial tcp"), Equals, true)
+	c.Assert(strings.Contains(string(body), "connection refused"), Equals, true)
+
+	// the errors of the forwarder itself are reported too
+	f, err = New(VerboseErrors(true), AllowedMethods("GET"))
+	c.Assert(err, IsNil)
+	re, body, err = testutils.MakeRequest(proxy.URL, testutils.Method("POST"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusMethodNotAllowed)
+	c.Assert(re.Header.Get(XProxyError), Equals, ErrorCategoryProxy)
+	c.Assert(string(body), Equals, "Method Not Allowed: POST")
+
+	// the details are hidden by default
+	f, err = New()
+	c.Assert(err, IsNil)
+	re, body, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(re.Header.Get(XProxyError), Equals, "")
+	c.Assert(string(body), Equals, "Bad Gateway")
+}
+
+func (s *FwdSuite) TestVerboseErrorsCategories(c *C) {
+	send := func(f *Forwarder, target string) *http.Response {
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(target)
+			f.ServeHTTP(w, req)
+		})
+		defer proxy.Close()
+		re, _, err := testutils.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		return re
+	}
+
+	// the certificate of the backend is not trusted
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer tlsSrv.Close()
+	f, err := New(VerboseErrors(true))
+	c.Assert(err, IsNil)
+	re := send(f, tlsSrv.URL)
+	c.Assert(re.Header.Get(XProxyError), Equals, ErrorCategoryTLS)
+
+	// the backend is too slow
+	slow := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("hello"))
+	})
+	defer slow.Close()
+	f, err = New(VerboseErrors(true), RoundTripper(&http.Transport{ResponseHeaderTimeout: 10 * time.Millisecond}))
+	c.Assert(err, IsNil)
+	re = send(f, slow.URL)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(re.Header.Get(XProxyError), Equals, ErrorCategoryTimeout)
+
+	// the errors are classified through their wrappers
+	verifyErr := &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}
+	wrapped := &url.Error{Op: "Get", URL: "https://localhost", Err: &net.OpError{Op: "remote error", Err: verifyErr}}
+	c.Assert(errorCategory(wrapped), Equals, ErrorCategoryTLS)
+	c.Assert(errorCategory(fmt.Errorf("handshake: %w", x509.HostnameError{})), Equals, ErrorCategoryTLS)
+	c.Assert(errorCategory(&url.Error{Op: "Get", URL: "http://localhost", Err: io.ErrUnexpectedEOF}), Equals, ErrorCategoryClosed)
+}
+
+func (s *FwdSuite) TestForwardClientCert(c *C) {
+	var subject, fingerprint string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		subject = req.Header.Get(XClientCertSubject)
+		fingerprint = req.Header.Get(XClientCertFingerprint)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(ForwardClientCert(true))
+	c.Assert(err, IsNil)
+
+	clientCert, clientX509 := newTestCertificate(c)
+	pool := x509.NewCertPool()
+	pool.AddCert(clientX509)
+
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	proxy.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	send := func(certs []tls.Certificate) {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs}}
+		req, err := http.NewRequest("GET", proxy.URL, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set(XClientCertSubject, "CN=admin")
+		req.Header.Set(XClientCertFingerprint, "spoofed")
+		re, err := transport.RoundTrip(req)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+	}
+
+	send([]tls.Certificate{clientCert})
+	c.Assert(subject, Equals, "CN=oxy client")
+	sum := sha256.Sum256(clientX509.Raw)
+	c.Assert(fingerprint, Equals, hex.EncodeToString(sum[:]))
+
+	// the spoofed headers are dropped without a certificate
+	send(nil)
+	c.Assert(subject, Equals, "")
+	c.Assert(fingerprint, Equals, "")
+}
+
+func (s *FwdSuite) TestCloseConnOnStatus(c *C) {
+	var mutex sync.Mutex
+	conns := map[string]bool{}
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		conns[req.RemoteAddr] = true
+		mutex.Unlock()
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	connCount := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(conns)
+	}
+
+	send := func(f *Forwarder, path string) {
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+		defer proxy.Close()
+		re, body, err := testutils.Get(proxy.URL + path)
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, "hello")
+		if path == "/fail" {
+			c.Assert(re.StatusCode, Equals, http.StatusInternalServerError)
+		}
+	}
+
+	// the connection is reused after a 500 by default
+	f, err := New(RoundTripper(&http.Transport{}))
+	c.Assert(err, IsNil)
+	send(f, "/")
+	send(f, "/fail")
+	send(f, "/")
+	c.Assert(connCount(), Equals, 1)
+
+	// and closed when enabled
+	conns = map[string]bool{}
+	f, err = New(RoundTripper(&http.Transport{}), CloseConnOnStatus(http.StatusInternalServerError))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().CloseConnOnStatus, DeepEquals, []int{http.StatusInternalServerError})
+	send(f, "/")
+	send(f, "/fail")
+	send(f, "/")
+	send(f, "/")
+	c.Assert(connCount(), Equals, 2)
+
+	_, err = New(CloseConnOnStatus(1000))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestCloseConnOnStatusConcurrent(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		// the requests sent on a reused connection wait for their response when it is closed
+		time.Sleep(5 * time.Millisecond)
+		switch req.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("failed"))
+		case "/empty":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte("hello"))
+		}
+	})
+	defer srv.Close()
+
+	f, err := New(RoundTripper(&http.Transport{MaxConnsPerHost: 2}), CloseConnOnStatus(http.StatusInternalServerError))
+	c.Assert(err, IsNil)
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// the requests with a body are not retried by the transport, so a request sent on
+	// a pooled connection closed by another one fails
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 20}}
+	paths := []string{"/", "/fail", "/empty"}
+	expected := map[string]string{"/": "200 hello", "/fail": "500 failed", "/empty": "500 "}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10*10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				path := paths[(i+j)%len(paths)]
+				re, err := client.Post(proxy.URL+path, "text/plain", strings.NewReader("payload"))
+				if err != nil {
+					errs <- err
+					continue
+				}
+				body, _ := ioutil.ReadAll(re.Body)
+				re.Body.Close()
+				if got := fmt.Sprintf("%v %s", re.StatusCode, body); got != expected[path] {
+					errs <- fmt.Errorf("%v: %v", path, got)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Error(err)
+	}
+}
+
+func (s *FwdSuite) TestObserver(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	// the observers are called once the response is sent
+	events := make(chan Event, 1)
+	observer := ObserverFunc(func(e Event) {
+		events <- e
+	})
+	f, err := New(AddObserver(observer), StreamResponse(true))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.MakeRequest(proxy.URL, testutils.Method("POST"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusCreated)
+	c.Assert(string(body), Equals, "hello")
+
+	e := <-events
+	c.Assert(e.Method, Equals, "POST")
+	c.Assert(e.URL.String(), Equals, srv.URL)
+	c.Assert(e.StatusCode, Equals, http.StatusCreated)
+	c.Assert(e.Bytes, Equals, int64(5))
+	c.Assert(e.Backend, Equals, testutils.ParseURI(srv.URL).Host)
+	c.Assert(e.Streamed, Equals, true)
+	c.Assert(e.Websocket, Equals, false)
+	c.Assert(e.Start.IsZero(), Equals, false)
+	c.Assert(e.Start.Before(time.Now()), Equals, true)
+	c.Assert(e.TTFB > 0, Equals, true)
+	c.Assert(e.Duration >= e.TTFB, Equals, true)
+
+	_, err = New(AddObserver(nil))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestObserverBackendStats(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.Write([]byte("world!"))
+	})
+	defer srv.Close()
+
+	events := make(chan Event, 1)
+	// a fresh transport so the dial isn't skipped by a pooled connection
+	f, err := New(RoundTripper(&http.Transport{}), AddObserver(ObserverFunc(func(e Event) {
+		events <- e
+	})))
+	c.Assert(err, IsNil)
+
+	var target string
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(target)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	target = srv.URL
+	re, body, err := testutils.MakeRequest(proxy.URL, testutils.Method("POST"), testutils.Body("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "world!")
+
+	e := <-events
+	c.Assert(e.StatusCode, Equals, http.StatusOK)
+	c.Assert(e.BytesIn, Equals, int64(5))
+	c.Assert(e.Bytes, Equals, int64(6))
+	c.Assert(e.Err, IsNil)
+	c.Assert(e.Connect > 0, Equals, true)
+	c.Assert(e.UpstreamFirstByte >= e.Connect, Equals, true)
+	c.Assert(e.Duration >= e.UpstreamFirstByte, Equals, true)
+
+	// the errors are reported with the status sent to the client
+	srv.Close()
+	re, _, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+
+	e = <-events
+	c.Assert(e.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(e.Err, NotNil)
+	c.Assert(e.UpstreamFirstByte, Equals, time.Duration(0))
+}
+
+func (s *FwdSuite) TestPreserveReasonPhrase(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		if req.URL.Path == "/unknown-length" {
+			conn.Write([]byte("HTTP/1.1 503 Back Soon\r\nConnection: close\r\n\r\nhello"))
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 404 Gone Fishing\r\nContent-Length: 5\r\nX-Test: yes\r\n\r\nhello"))
+	})
+	defer srv.Close()
+
+	get := func(f *Forwarder, path string) (*http.Response, string) {
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+		defer proxy.Close()
+		re, body, err := testutils.Get(proxy.URL + path)
+		c.Assert(err, IsNil)
+		return re, string(body)
+	}
+
+	// the canonical reason phrase is sent by default
+	f, err := New()
+	c.Assert(err, IsNil)
+	re, body := get(f, "/")
+	c.Assert(re.Status, Equals, "404 Not Found")
+	c.Assert(body, Equals, "hello")
+
+	f, err = New(PreserveReasonPhrase(true))
+	c.Assert(err, IsNil)
+	c.Assert(f.Config().PreserveReasonPhrase, Equals, true)
+	re, body = get(f, "/")
+	c.Assert(re.Status, Equals, "404 Gone Fishing")
+	c.Assert(re.Header.Get("X-Test"), Equals, "yes")
+	c.Assert(re.ContentLength, Equals, int64(5))
+	c.Assert(re.Close, Equals, true)
+	c.Assert(body, Equals, "hello")
+
+	re, body = get(f, "/unknown-length")
+	c.Assert(re.Status, Equals, "503 Back Soon")
+	c.Assert(body, Equals, "hello")
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type rewriterFunc func(req *http.Request)
+
+func (f rewriterFunc) Rewrite(req *http.Request) {
+	f(req)
+}
+
+func (s *FwdSuite) TestStreamingRequest(c *C) {
+	var outHeader string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outHeader = req.Header.Get(XProxyStream)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(BufferResponse(1024))
+	c.Assert(err, IsNil)
+
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		req.URL = testutils.ParseURI(srv.URL)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(w.Body.String(), Equals, "hello")
+		return w
+	}
+
+	w := send(httptest.NewRequest("GET", "http://localhost", nil))
+	c.Assert(w.Flushed, Equals, false)
+
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	req.Header.Set(XProxyStream, "true")
+	w = send(req)
+	c.Assert(w.Flushed, Equals, true)
+	c.Assert(outHeader, Equals, "")
+
+	req = httptest.NewRequest("GET", "http://localhost", nil)
+	req.Header.Set(XProxyStream, "false")
+	w = send(req)
+	c.Assert(w.Flushed, Equals, false)
+
+	w = send(WithStreaming(httptest.NewRequest("GET", "http://localhost", nil)))
+	c.Assert(w.Flushed, Equals, true)
+}
+
+func (s *FwdSuite) TestConnectionWaitHistogram(c *C) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(RoundTripper(&http.Transport{MaxConnsPerHost: 1}), LatencyHistograms(nil))
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// the requests queue for the single backend connection
+	done := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func() {
+			re, _, err := testutils.Get(proxy.URL)
+			c.Assert(err, IsNil)
+			c.Assert(re.StatusCode, Equals, http.StatusOK)
+			done <- true
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+
+	wait, err := f.LatencyHistogram(ConnectionWaitMetric)
+	c.Assert(err, IsNil)
+	c.Assert(time.Duration(wait.ValueAtQuantile(100)) >= 40*time.Millisecond, Equals, true)
+}
+
+func (s *FwdSuite) TestWebsocketOrigin(c *C) {
+	origins := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			origins <- req.Header.Get(Origin)
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		},
+	})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		mux.ServeHTTP(w, req)
+	})
+	defer srv.Close()
+
+	pass, err := New()
+	c.Assert(err, IsNil)
+	rewrite, err := New(WebsocketOrigin(func(origin string) string {
+		if origin == "http://localhost" {
+			return "http://backend.local"
+		}
+		return origin
+	}))
+	c.Assert(err, IsNil)
+	strip, err := New(WebsocketOrigin(func(string) string { return "" }))
+	c.Assert(err, IsNil)
+
+	for f, expected := range map[*Forwarder]string{pass: "http://localhost", rewrite: "http://backend.local", strip: ""} {
+		fwd := f
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			path := req.URL.Path
+			req.URL = testutils.ParseURI(srv.URL)
+			req.URL.Path = path
+			fwd.ServeHTTP(w, req)
+		})
+
+		resp, err := sendWebsocketRequest(proxy.Listener.Addr().String(), "/ws", "echo", c)
+		proxy.Close()
+		c.Assert(err, IsNil)
+		c.Assert(resp, Equals, "ok")
+		c.Assert(<-origins, Equals, expected)
+	}
+}
+
+func (s *FwdSuite) TestSetErrorHandler(c *C) {
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost:63450")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	maintenance := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// swap the handler while serving requests
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			re, _, err := testutils.Get(proxy.URL)
+			c.Assert(err, IsNil)
+			c.Assert(re.StatusCode == http.StatusBadGateway || re.StatusCode == http.StatusServiceUnavailable, Equals, true)
+		}
+		done <- true
+	}()
+	f.SetErrorHandler(maintenance)
+	<-done
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+func (s *FwdSuite) TestWithKeepAlive(c *C) {
+	var closed bool
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		closed = req.Close
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	for _, keepAlive := range []bool{true, false} {
+		req := WithKeepAlive(httptest.NewRequest("GET", "http://localhost", nil), keepAlive)
+		req.URL = testutils.ParseURI(srv.URL)
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(closed, Equals, !keepAlive)
+	}
+}
+
+func (s *FwdSuite) TestGRPCMode(c *C) {
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.ProtoMajor, Equals, 2)
+		c.Assert(req.Header.Get(ContentType), Equals, "application/grpc")
+		// like the gRPC servers, reject the clients not accepting the trailers
+		if req.Header.Get(Te) != "trailers" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// echo the length-prefixed message back
+		msg, err := ioutil.ReadAll(req.Body)
+		c.Assert(err, IsNil)
+		w.Header().Set(ContentType, "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Write(msg)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "")
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	f, err := New(GRPCMode(true))
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}), &http2.Server{}))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	msg := append([]byte{0, 0, 0, 0, 5}, []byte("hello")...)
+	req, err := http.NewRequest("POST", proxy.URL+"/echo.Echo/Say", bytes.NewReader(msg))
+	c.Assert(err, IsNil)
+	req.Header.Set(ContentType, "application/grpc")
+	req.Header.Set(Te, "trailers")
+
+	re, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.ProtoMajor, Equals, 2)
+	c.Assert(re.Header.Get(ContentType), Equals, "application/grpc")
+	c.Assert(body, DeepEquals, msg)
+	c.Assert(re.Trailer.Get("Grpc-Status"), Equals, "0")
+}
+
+func (s *FwdSuite) TestGRPCModeBadOptions(c *C) {
+	_, err := New(GRPCMode(true), BufferResponse(1024))
+	c.Assert(err, NotNil)
+
+	_, err = New(GRPCMode(true), ConnMaxLifetime(time.Second))
+	c.Assert(err, NotNil)
+}
+
+func (s *FwdSuite) TestH2StreamingRequestBody(c *C) {
+	received := make(chan string)
+	// an HTTP/1.1 backend, reached with the default http.Transport
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.ProtoMajor, Equals, 1)
+		c.Assert(req.TransferEncoding, DeepEquals, []string{"chunked"})
+		buf := make([]byte, 1024)
+		total := 0
+		for {
+			n, err := req.Body.Read(buf)
+			if n > 0 {
+				total += n
+				received <- string(buf[:n])
+			}
+			if err != nil {
+				break
+			}
+		}
+		fmt.Fprintf(w, "%d", total)
+	})
+	defer srv.Close()
+
+	f, err := New()
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}), &http2.Server{}))
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", proxy.URL+"/upload", pr)
+	c.Assert(err, IsNil)
+
+	type result struct {
+		re  *http.Response
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		re, err := client.Do(req)
+		done <- result{re, err}
+	}()
+
+	// every chunk reaches the backend before the next one is written, the client is still sending
+	for i := 0; i < 10; i++ {
+		chunk := fmt.Sprintf("chunk-%d", i)
+		_, err := pw.Write([]byte(chunk))
+		c.Assert(err, IsNil)
+		select {
+		case got := <-received:
+			c.Assert(got, Equals, chunk)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("chunk %d was not streamed to the backend", i)
+		}
+	}
+	pw.Close()
+
+	r := <-done
+	c.Assert(r.err, IsNil)
+	defer r.re.Body.Close()
+	body, err := ioutil.ReadAll(r.re.Body)
+	c.Assert(err, IsNil)
+	c.Assert(r.re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "70")
+}
+
+// the reader and the writer hide io.WriterTo and io.ReaderFrom, as the response bodies and writers do,
+// so the copies go through the buffers
+type benchmarkReader struct{ r io.Reader }
+
+func (b *benchmarkReader) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+type benchmarkWriter struct{ n int64 }
+
+func (b *benchmarkWriter) Write(p []byte) (int, error) {
+	b.n += int64(len(p))
+	return len(p), nil
+}
+
+// benchmarkCopies copies a mix of tiny, medium and huge bodies in parallel
+func benchmarkCopies(b *testing.B, pool *bufferPool) {
+	sizes := []int{512, 512, 512, 2 * 1024, 16 * 1024, 24 * 1024, 1 << 20}
+	bodies := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		bodies[i] = bytes.Repeat([]byte("x"), size)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			body := bodies[i%len(bodies)]
+			i++
+			w := &benchmarkWriter{}
+			if _, err := pool.copy(w, &benchmarkReader{bytes.NewReader(body)}, int64(len(body))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCopyUnpooled(b *testing.B) {
+	benchmarkCopies(b, nil)
+}
+
+func BenchmarkCopySingleSizePool(b *testing.B) {
+	benchmarkCopies(b, newBufferPool([]int{32 * 1024}))
+}
+
+func BenchmarkCopyTieredPool(b *testing.B) {
+	benchmarkCopies(b, newBufferPool([]int{4 * 1024, 32 * 1024, 256 * 1024}))
+}
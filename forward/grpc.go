@@ -0,0 +1,57 @@
+package forward
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// GRPCMode sets up the forwarder for gRPC, which requires HTTP/2 end to end: the backends are reached
+// over HTTP/2 (cleartext h2c for the http scheme), the responses are streamed and the trailers forwarded.
+// The client connections have to be HTTP/2 as well, which is up to the server running the forwarder.
+func GRPCMode(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.grpc = b
+		return nil
+	}
+}
+
+// acceptsTrailers tells whether the client sent TE: trailers, the only TE value allowed over HTTP/2
+func acceptsTrailers(req *http.Request) bool {
+	for _, value := range req.Header[Te] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// grpcTransport picks the HTTP/2 transport matching the backend scheme
+type grpcTransport struct {
+	h2  *http2.Transport
+	h2c *http2.Transport
+}
+
+func (f *httpForwarder) newGRPCTransport() http.RoundTripper {
+	return &grpcTransport{
+		h2: &http2.Transport{TLSClientConfig: f.clientTLSConfig()},
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+}
+
+func (t *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.h2.RoundTrip(req)
+}
@@ -0,0 +1,43 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// MaxRequestHeaderBytes rejects the requests whose headers exceed n bytes with 431 Request Header Fields
+// Too Large before forwarding them, to protect the backends from the clients sending huge headers. The
+// size is the sum of the lengths of the names and values of all the header fields. Unlike
+// http.Server.MaxHeaderBytes it doesn't cover the request line and the framing, and it applies to
+// every protocol.
+func MaxRequestHeaderBytes(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n <= 0 {
+			return fmt.Errorf("max request header bytes should be > 0, got %v", n)
+		}
+		f.maxHeaderBytes = n
+		return nil
+	}
+}
+
+// headerSize returns the total length of the names and values of the header fields
+func headerSize(h http.Header) int {
+	size := 0
+	for k, vv := range h {
+		for _, v := range vv {
+			size += len(k) + len(v)
+		}
+	}
+	return size
+}
+
+// rejectLargeHeaders replies with 431 when the headers are over the limit
+func (f *Forwarder) rejectLargeHeaders(w http.ResponseWriter, req *http.Request) bool {
+	size := headerSize(req.Header)
+	if size <= f.maxHeaderBytes {
+		return false
+	}
+	f.log.Infof("Rejecting request to %v, its headers are %v bytes over the limit of %v", req.URL, size-f.maxHeaderBytes, f.maxHeaderBytes)
+	f.errHandler.ServeHTTP(w, req, &StatusError{Code: http.StatusRequestHeaderFieldsTooLarge, Reason: "request headers too large"})
+	return true
+}
@@ -15,6 +15,24 @@ const (
 	Upgrade            = "Upgrade"
 	ContentLength      = "Content-Length"
 	ContentType        = "Content-Type"
+	ServerTimingHeader = "Server-Timing"
+	XProxyStream       = "X-Proxy-Stream"
+	Origin             = "Origin"
+	Allow              = "Allow"
+	XProxyError        = "X-Proxy-Error"
+	RetryAfter         = "Retry-After"
+	AcceptEncoding     = "Accept-Encoding"
+	AltSvc             = "Alt-Svc"
+	Authorization      = "Authorization"
+	WWWAuthenticate    = "Www-Authenticate"
+	Cookie             = "Cookie"
+	// XOxyTrace lists the upstreams selected by the proxies, see UpstreamTrace
+	XOxyTrace = "X-Oxy-Trace"
+	// SecWebsocketProtocol is canonicalized, as "Sec-WebSocket-Protocol" in the RFC
+	SecWebsocketProtocol = "Sec-Websocket-Protocol"
+	// The client certificate headers are set by ForwardClientCert
+	XClientCertSubject     = "X-Client-Cert-Subject"
+	XClientCertFingerprint = "X-Client-Cert-Fingerprint"
 )
 
 // Hop-by-hop headers. These are removed when sent to the backend.
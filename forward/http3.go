@@ -0,0 +1,21 @@
+//go:build h3
+// +build h3
+
+package forward
+
+import (
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// HTTP3Backend makes the forwarder reach the backends over HTTP/3 using the quic-go round tripper.
+// The backend URLs should use the https scheme. It is only available when built with the h3 build tag,
+// so that users not needing HTTP/3 do not pull in the quic-go dependency. It is mutually exclusive with GRPCMode.
+func HTTP3Backend(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.http3 = b
+		if b {
+			f.httpForwarder.roundTripper = &http3.RoundTripper{}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,59 @@
+//go:build h3
+// +build h3
+
+package forward
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *FwdSuite) TestHTTP3Backend(c *C) {
+	var proto string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+		w.Write([]byte("hello"))
+	})
+	// borrow the test certificate of the httptest package
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	srv := &http3.Server{
+		Server: &http.Server{
+			Handler:   handler,
+			TLSConfig: &tls.Config{Certificates: tlsSrv.TLS.Certificates},
+		},
+	}
+	go srv.Serve(conn)
+	defer srv.Close()
+
+	f, err := New(HTTP3Backend(true))
+	c.Assert(err, IsNil)
+	f.httpForwarder.roundTripper = &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("https://" + conn.LocalAddr().String())
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "hello")
+	c.Assert(proto, Equals, "HTTP/3.0")
+}
+
+func (s *FwdSuite) TestHTTP3BackendGRPCMode(c *C) {
+	_, err := New(HTTP3Backend(true), GRPCMode(true))
+	c.Assert(err, NotNil)
+}
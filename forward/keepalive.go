@@ -0,0 +1,20 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+)
+
+type keepAliveKey struct{}
+
+// WithKeepAlive returns a copy of the request overriding whether the connection to the backend
+// is kept alive after the request, e.g. to work around backends mishandling keep-alive.
+// The forwarder keeps the backend connections alive by default.
+func WithKeepAlive(req *http.Request, enabled bool) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), keepAliveKey{}, enabled))
+}
+
+func isKeepAlive(req *http.Request) bool {
+	enabled, ok := req.Context().Value(keepAliveKey{}).(bool)
+	return !ok || enabled
+}
@@ -0,0 +1,73 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// MaxConcurrentPerKey limits the number of requests in flight per client key, e.g. per API key, so
+// a single client can't monopolize the backends. Unlike a rate limit it caps the concurrency rather
+// than the throughput. Requests over the limit are rejected with 429 Too Many Requests, the requests
+// with an empty key are not limited.
+func MaxConcurrentPerKey(keyFunc func(*http.Request) string, limit int) optSetter {
+	return func(f *Forwarder) error {
+		if keyFunc == nil {
+			return fmt.Errorf("key function can't be nil")
+		}
+		if limit <= 0 {
+			return fmt.Errorf("max concurrent requests per key should be > 0, got %v", limit)
+		}
+		f.keyLimiter = &keyLimiter{
+			key:   keyFunc,
+			limit: limit,
+			mutex: &sync.Mutex{},
+			slots: make(map[string]chan struct{}),
+		}
+		return nil
+	}
+}
+
+// keyLimiter holds a semaphore per key with requests in flight, the idle keys are dropped
+type keyLimiter struct {
+	key   func(*http.Request) string
+	limit int
+
+	mutex *sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func (l *keyLimiter) acquire(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	slots, ok := l.slots[key]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.slots[key] = slots
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *keyLimiter) release(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	slots := l.slots[key]
+	<-slots
+	if len(slots) == 0 {
+		delete(l.slots, key)
+	}
+}
+
+// keys returns the number of keys with requests in flight
+func (l *keyLimiter) keys() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.slots)
+}
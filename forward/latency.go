@@ -0,0 +1,193 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+const (
+	// BackendTimeMetric is the time spent waiting for the backend response headers, in nanoseconds
+	BackendTimeMetric = "backend.time.ns"
+	// ProxyOverheadMetric is the time the forwarder spends rewriting the request, buffering
+	// the response and copying the headers, in nanoseconds
+	ProxyOverheadMetric = "proxy.overhead.ns"
+	// ConnectionWaitMetric is the time spent waiting to acquire a backend connection from the
+	// transport, which grows when the connection pool is saturated, in nanoseconds
+	ConnectionWaitMetric = "connection.wait.ns"
+	// ConnectionReuseRatioMetric is the share of the requests sent over a reused keep-alive
+	// backend connection over the last minute
+	ConnectionReuseRatioMetric = "connection.reuse.ratio"
+)
+
+// LatencyHistograms records the backend time and the proxy overhead into separate histograms,
+// to tell whether the proxy itself is the bottleneck. newHist creates the histograms,
+// nil uses one minute range histograms rolling over a minute. See LatencyHistogram.
+func LatencyHistograms(newHist memmetrics.NewRollingHistogramFn) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.latency = &latencyMetrics{newHist: newHist}
+		return nil
+	}
+}
+
+// LatencyHistogram returns the histogram recorded under the name,
+// one of BackendTimeMetric, ProxyOverheadMetric or ConnectionWaitMetric
+func (f *Forwarder) LatencyHistogram(name string) (*memmetrics.HDRHistogram, error) {
+	m := f.httpForwarder.latency
+	if m == nil {
+		return nil, fmt.Errorf("latency histograms are not enabled")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	switch name {
+	case BackendTimeMetric:
+		return m.backend.Merged()
+	case ProxyOverheadMetric:
+		return m.overhead.Merged()
+	case ConnectionWaitMetric:
+		return m.connWait.Merged()
+	}
+	return nil, fmt.Errorf("unknown latency histogram %v", name)
+}
+
+// ConnectionReuseRatio returns the ConnectionReuseRatioMetric gauge, between 0 and 1. A low ratio means
+// the keep-alive to the backends isn't working, e.g. Connection: close is leaking through or the
+// transport keeps too few idle connections. It is 0 until a connection is used.
+func (f *Forwarder) ConnectionReuseRatio() (float64, error) {
+	m := f.httpForwarder.latency
+	if m == nil {
+		return 0, fmt.Errorf("latency histograms are not enabled")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.reuse.Ratio(), nil
+}
+
+type latencyMetrics struct {
+	newHist memmetrics.NewRollingHistogramFn
+
+	mutex    *sync.Mutex
+	backend  *memmetrics.RollingHDRHistogram
+	overhead *memmetrics.RollingHDRHistogram
+	connWait *memmetrics.RollingHDRHistogram
+	// reused connections are counted as A, new ones as B
+	reuse *memmetrics.RatioCounter
+
+	// dial times and errors by backend address
+	dials      map[string]*memmetrics.RollingHDRHistogram
+	dialErrors map[string]int64
+
+	// histograms by metrics tag, see MetricsTag
+	tagged map[string]*taggedLatency
+}
+
+func (m *latencyMetrics) init(ctx *handlerContext) error {
+	if m.newHist == nil {
+		m.newHist = func() (*memmetrics.RollingHDRHistogram, error) {
+			return memmetrics.NewRollingHDRHistogram(1, int64(time.Minute), 2, 10*time.Second, 6, memmetrics.RollingClock(ctx.clock))
+		}
+	}
+	backend, err := m.newHist()
+	if err != nil {
+		return err
+	}
+	overhead, err := m.newHist()
+	if err != nil {
+		return err
+	}
+	connWait, err := m.newHist()
+	if err != nil {
+		return err
+	}
+	reuse, err := memmetrics.NewRatioCounter(6, 10*time.Second, memmetrics.RatioClock(ctx.clock))
+	if err != nil {
+		return err
+	}
+	m.mutex = &sync.Mutex{}
+	m.reuse = reuse
+	m.backend = backend
+	m.overhead = overhead
+	m.connWait = connWait
+	m.dials = make(map[string]*memmetrics.RollingHDRHistogram)
+	m.dialErrors = make(map[string]int64)
+	m.tagged = make(map[string]*taggedLatency)
+	return nil
+}
+
+// traceConnections returns a copy of the request recording the time spent acquiring the connection
+// and dialing the backend. The dials are only visible to the trace when the transport uses net.Dialer.
+func (m *latencyMetrics) traceConnections(req *http.Request, ctx *handlerContext) *http.Request {
+	var start time.Time
+	addr := backendAddr(req.URL)
+	// the dialer may try several addresses in parallel
+	dials := struct {
+		sync.Mutex
+		starts map[string]time.Time
+	}{starts: make(map[string]time.Time)}
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(network, ip string) {
+			dials.Lock()
+			defer dials.Unlock()
+			dials.starts[ip] = ctx.clock.UtcNow()
+		},
+		ConnectDone: func(network, ip string, err error) {
+			dials.Lock()
+			dialStart, ok := dials.starts[ip]
+			dials.Unlock()
+			if ok {
+				m.recordDial(addr, ctx.clock.UtcNow().Sub(dialStart), err, ctx)
+			}
+		},
+		GetConn: func(hostPort string) {
+			start = ctx.clock.UtcNow()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			if info.Reused {
+				m.reuse.IncA(1)
+			} else {
+				m.reuse.IncB(1)
+			}
+			if start.IsZero() {
+				return
+			}
+			wait := ctx.clock.UtcNow().Sub(start)
+			if err := m.connWait.RecordValues(int64(wait), 1); err != nil {
+				ctx.log.Warningf("Failed to record connection wait %v: %v", wait, err)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func (m *latencyMetrics) record(tag string, backend, overhead time.Duration, ctx *handlerContext) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.backend.RecordValues(int64(backend), 1); err != nil {
+		ctx.log.Warningf("Failed to record backend time %v: %v", backend, err)
+	}
+	if err := m.overhead.RecordValues(int64(overhead), 1); err != nil {
+		ctx.log.Warningf("Failed to record proxy overhead %v: %v", overhead, err)
+	}
+	if tag == "" {
+		return
+	}
+	t, err := m.taggedHistograms(tag)
+	if err != nil {
+		ctx.log.Warningf("Failed to create the histograms of metrics tag %v: %v", tag, err)
+		return
+	}
+	if err := t.backend.RecordValues(int64(backend), 1); err != nil {
+		ctx.log.Warningf("Failed to record backend time %v of %v: %v", backend, tag, err)
+	}
+	if err := t.overhead.RecordValues(int64(overhead), 1); err != nil {
+		ctx.log.Warningf("Failed to record proxy overhead %v of %v: %v", overhead, tag, err)
+	}
+}
@@ -0,0 +1,144 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// lifetimeTransport closes the connections of the transport once they are older than maxLifetime.
+// The transport is unaware of the connection ages, so the connections are tracked with the client
+// trace to avoid closing them in the middle of a request.
+type lifetimeTransport struct {
+	*http.Transport
+	maxLifetime time.Duration
+
+	mutex *sync.Mutex
+	// connections indexed by their local address, which is also available
+	// when the transport wraps them into TLS connections
+	conns map[string]*agedConn
+}
+
+func newLifetimeTransport(t *http.Transport, maxLifetime time.Duration) *lifetimeTransport {
+	lt := &lifetimeTransport{
+		Transport:   t,
+		maxLifetime: maxLifetime,
+		mutex:       &sync.Mutex{},
+		conns:       make(map[string]*agedConn),
+	}
+	dial := t.DialContext
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return lt.track(conn), nil
+	}
+	return lt
+}
+
+func (t *lifetimeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *agedConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = t.find(info.Conn)
+			if conn != nil {
+				conn.acquire()
+			}
+		},
+	}
+	re, err := t.Transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if conn == nil {
+		return re, err
+	}
+	if err != nil {
+		conn.release()
+		return re, err
+	}
+	re.Body = &releasingBody{ReadCloser: re.Body, release: conn.release}
+	return re, nil
+}
+
+func (t *lifetimeTransport) track(conn net.Conn) *agedConn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := conn.LocalAddr().String()
+	c := &agedConn{Conn: conn, mutex: &sync.Mutex{}}
+	c.forget = func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if t.conns[key] == c {
+			delete(t.conns, key)
+		}
+	}
+	c.mutex.Lock()
+	c.timer = time.AfterFunc(t.maxLifetime, c.expire)
+	c.mutex.Unlock()
+	t.conns[key] = c
+	return c
+}
+
+func (t *lifetimeTransport) find(conn net.Conn) *agedConn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.conns[conn.LocalAddr().String()]
+}
+
+// agedConn is closed once its lifetime expires and no request uses it
+type agedConn struct {
+	net.Conn
+	timer  *time.Timer
+	forget func()
+
+	mutex   *sync.Mutex
+	busy    int
+	expired bool
+}
+
+func (c *agedConn) acquire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.busy++
+}
+
+func (c *agedConn) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.busy--
+	if c.expired && c.busy == 0 {
+		c.Close()
+	}
+}
+
+func (c *agedConn) expire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.expired = true
+	if c.busy == 0 {
+		c.Close()
+	}
+}
+
+func (c *agedConn) Close() error {
+	c.timer.Stop()
+	c.forget()
+	return c.Conn.Close()
+}
+
+// releasingBody releases the connection once the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,51 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AllowedMethods restricts the forwarded requests to the given methods, e.g. GET and HEAD for a read-only
+// proxy tier. Other requests are rejected with 405 Method Not Allowed and an Allow header listing the methods.
+// Websocket upgrades are GET requests. All the methods are allowed when none is given.
+func AllowedMethods(methods ...string) optSetter {
+	return func(f *Forwarder) error {
+		if len(methods) == 0 {
+			f.methods = nil
+			return nil
+		}
+		m := &methodFilter{allowed: make(map[string]bool, len(methods))}
+		for _, method := range methods {
+			if method == "" {
+				return fmt.Errorf("allowed methods can't be empty")
+			}
+			if !m.allowed[method] {
+				m.allowed[method] = true
+				m.list = append(m.list, method)
+			}
+		}
+		m.allow = strings.Join(m.list, ", ")
+		f.methods = m
+		return nil
+	}
+}
+
+// methodFilter rejects the requests with the methods outside the allowlist
+type methodFilter struct {
+	allowed map[string]bool
+	list    []string
+	// allow is the Allow header value
+	allow string
+}
+
+// reject replies with 405 when the method is not allowed
+func (m *methodFilter) reject(w http.ResponseWriter, req *http.Request, ctx *handlerContext) bool {
+	if m.allowed[req.Method] {
+		return false
+	}
+	ctx.log.Infof("Rejecting %v request to %v, the method is not allowed", req.Method, req.URL)
+	w.Header().Set(Allow, m.allow)
+	ctx.errHandler.ServeHTTP(w, req, &StatusError{Code: http.StatusMethodNotAllowed, Reason: req.Method})
+	return true
+}
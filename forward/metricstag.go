@@ -0,0 +1,107 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+type metricsTagKey struct{}
+
+// WithMetricsTag returns a copy of the request whose latencies are also recorded under the tag,
+// e.g. the name of the service picked by the router. It overrides the MetricsTag function.
+func WithMetricsTag(req *http.Request, tag string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), metricsTagKey{}, tag))
+}
+
+// MetricsTag partitions the latency histograms by the tag the function returns for every request,
+// e.g. the service name in a gateway, on top of the histograms of all the requests. The requests
+// with an empty tag are only recorded in the latter. The histograms of a tag are created on its
+// first request, so the function should return a bounded set of tags. It requires LatencyHistograms.
+func MetricsTag(fn func(req *http.Request) string) optSetter {
+	return func(f *Forwarder) error {
+		if fn == nil {
+			return fmt.Errorf("metrics tag function can't be nil")
+		}
+		f.httpForwarder.metricsTag = fn
+		return nil
+	}
+}
+
+// metricsTagOf returns the tag of the request, the tag set with WithMetricsTag first
+func (f *httpForwarder) metricsTagOf(req *http.Request) string {
+	if tag, ok := req.Context().Value(metricsTagKey{}).(string); ok {
+		return tag
+	}
+	if f.metricsTag != nil {
+		return f.metricsTag(req)
+	}
+	return ""
+}
+
+// MetricsTags returns the sorted tags recorded so far
+func (f *Forwarder) MetricsTags() []string {
+	m := f.httpForwarder.latency
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	tags := make([]string, 0, len(m.tagged))
+	for tag := range m.tagged {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// TaggedLatencyHistogram returns the histogram recorded under the name for the requests with the tag,
+// one of BackendTimeMetric or ProxyOverheadMetric
+func (f *Forwarder) TaggedLatencyHistogram(tag, name string) (*memmetrics.HDRHistogram, error) {
+	m := f.httpForwarder.latency
+	if m == nil {
+		return nil, fmt.Errorf("latency histograms are not enabled")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	t, ok := m.tagged[tag]
+	if !ok {
+		return nil, fmt.Errorf("unknown metrics tag %v", tag)
+	}
+	switch name {
+	case BackendTimeMetric:
+		return t.backend.Merged()
+	case ProxyOverheadMetric:
+		return t.overhead.Merged()
+	}
+	return nil, fmt.Errorf("unknown tagged latency histogram %v", name)
+}
+
+// taggedLatency holds the histograms of the requests sharing a tag
+type taggedLatency struct {
+	backend  *memmetrics.RollingHDRHistogram
+	overhead *memmetrics.RollingHDRHistogram
+}
+
+// taggedHistograms returns the histograms of the tag, creating them on its first request.
+// It should be called under the lock.
+func (m *latencyMetrics) taggedHistograms(tag string) (*taggedLatency, error) {
+	if t, ok := m.tagged[tag]; ok {
+		return t, nil
+	}
+	backend, err := m.newHist()
+	if err != nil {
+		return nil, err
+	}
+	overhead, err := m.newHist()
+	if err != nil {
+		return nil, err
+	}
+	t := &taggedLatency{backend: backend, overhead: overhead}
+	m.tagged[tag] = t
+	return t, nil
+}
@@ -0,0 +1,160 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// Event describes a request completed by the forwarder, rejected requests included
+type Event struct {
+	// Method is the method of the request
+	Method string
+	// URL is the URL of the backend
+	URL *url.URL
+	// StatusCode is the status sent to the client, zero for the websocket sessions
+	StatusCode int
+	// Bytes is the size of the response body sent to the client
+	Bytes int64
+	// Start is the time the forwarder got the request
+	Start time.Time
+	// Duration is the time to complete the request, TTFB the time to send the first byte
+	// of the response to the client
+	Duration time.Duration
+	TTFB     time.Duration
+	// Backend is the host of the backend
+	Backend string
+	// Streamed is set when the response was flushed to the client as it arrived
+	Streamed bool
+	// Websocket is set for the websocket sessions, the status and size are then unknown
+	Websocket bool
+	// DNS, Connect and TLS are the phases of the backend connection, zero when a pooled
+	// connection is reused. The dials are only visible when the transport uses net.Dialer.
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	// UpstreamFirstByte is the time until the first byte of the backend response
+	UpstreamFirstByte time.Duration
+	// BytesIn is the size of the request body sent to the backend
+	BytesIn int64
+	// Err is the error ending the request, forwarding or copying the response
+	Err error
+}
+
+// Observer is notified of every request completed by the forwarder, e.g. to log or measure them.
+// It is called synchronously once the response is sent, so it should be quick.
+type Observer interface {
+	Observe(e Event)
+}
+
+// ObserverFunc adapts a function to the Observer interface
+type ObserverFunc func(e Event)
+
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+// AddObserver registers an observer of the completed requests, the observers are called in the
+// order they are added
+func AddObserver(o Observer) optSetter {
+	return func(f *Forwarder) error {
+		if o == nil {
+			return fmt.Errorf("observer can't be nil")
+		}
+		f.observers = append(f.observers, o)
+		return nil
+	}
+}
+
+// observe notifies the observers once the request is served
+func (f *Forwarder) observe(w http.ResponseWriter, req *http.Request) {
+	rec := &recorder{ResponseWriter: w, clock: f.clock, start: f.clock.UtcNow()}
+	stats := &statsTracker{clock: f.clock, start: rec.start}
+	f.forward(rec, withStats(req, stats))
+
+	e := Event{
+		Method:     req.Method,
+		URL:        req.URL,
+		StatusCode: rec.code,
+		Bytes:      rec.bytes,
+		Start:      rec.start,
+		Duration:   f.clock.UtcNow().Sub(rec.start),
+		Backend:    req.URL.Host,
+		Streamed:   rec.flushed,
+		Websocket:  rec.hijacked,
+	}
+	if !rec.firstByte.IsZero() {
+		e.TTFB = rec.firstByte.Sub(rec.start)
+	}
+	if e.StatusCode == 0 && !rec.hijacked {
+		e.StatusCode = http.StatusOK
+	}
+	stats.fill(&e)
+	for _, o := range f.observers {
+		o.Observe(e)
+	}
+}
+
+var (
+	_ http.Hijacker      = &recorder{}
+	_ http.Flusher       = &recorder{}
+	_ http.CloseNotifier = &recorder{}
+)
+
+// recorder records the response sent to the client for the observers
+type recorder struct {
+	http.ResponseWriter
+	clock timetools.TimeProvider
+
+	start     time.Time
+	firstByte time.Time
+	code      int
+	bytes     int64
+	flushed   bool
+	hijacked  bool
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+		r.firstByte = r.clock.UtcNow()
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *recorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		r.flushed = true
+		flusher.Flush()
+	}
+}
+
+func (r *recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the ResponseWriter doesn't support the Hijacker interface")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		r.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (r *recorder) CloseNotify() <-chan bool {
+	return r.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
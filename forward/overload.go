@@ -0,0 +1,193 @@
+package forward
+
+import (
+	"container/heap"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxConcurrentRequests caps the number of HTTP requests the forwarder has in flight across all the
+// backends, as a last line of defense against overload. The requests over the limit are rejected with
+// 503 Service Unavailable and a Retry-After header, or wait for a slot up to OverloadQueueTimeout.
+// The websocket sessions are long lived and not counted.
+func MaxConcurrentRequests(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n <= 0 {
+			return fmt.Errorf("max concurrent requests should be > 0, got %v", n)
+		}
+		f.httpForwarder.overload = &overloadLimiter{max: n}
+		return nil
+	}
+}
+
+// OverloadQueueTimeout makes the requests over MaxConcurrentRequests wait up to d for a slot before
+// they are rejected, to absorb the short bursts. They are rejected right away by default.
+func OverloadQueueTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("overload queue timeout should be >= 0, got %v", d)
+		}
+		f.httpForwarder.overloadWait = d
+		return nil
+	}
+}
+
+// QueuePriority orders the requests waiting for a slot of MaxConcurrentRequests by the priority fn
+// returns, e.g. to let the interactive requests jump ahead of the batch ones: the freed slots go to
+// the waiting request with the highest priority, and to the longest waiting one among those of the
+// same priority. The requests are served in their arrival order by default. It requires
+// OverloadQueueTimeout.
+func QueuePriority(fn func(req *http.Request) int) optSetter {
+	return func(f *Forwarder) error {
+		if fn == nil {
+			return fmt.Errorf("queue priority can't be nil")
+		}
+		f.httpForwarder.queuePriority = fn
+		return nil
+	}
+}
+
+// OverloadRejections returns the number of requests rejected by MaxConcurrentRequests, the ones
+// giving up while waiting in the queue of OverloadQueueTimeout included
+func (f *Forwarder) OverloadRejections() int64 {
+	if f.httpForwarder.overload == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&f.httpForwarder.overload.rejected)
+}
+
+// overloadLimiter is the semaphore of the requests in flight, the freed slots are handed over to the
+// waiting requests in the order of their priority and arrival
+type overloadLimiter struct {
+	mutex    sync.Mutex
+	max      int
+	inFlight int
+	waiting  overloadQueue
+	// seq numbers the waiting requests in their arrival order
+	seq uint64
+	// rejected is accessed atomically
+	rejected int64
+}
+
+// overloadWaiter is a request waiting for a slot, ready is closed once the slot is handed over
+type overloadWaiter struct {
+	priority int
+	seq      uint64
+	index    int
+	ready    chan struct{}
+}
+
+// acquire takes a slot, waiting up to wait for one. It returns false when the client went away
+// or no slot was freed in time.
+func (l *overloadLimiter) acquire(req *http.Request, wait time.Duration, priority int) bool {
+	l.mutex.Lock()
+	if l.inFlight < l.max && len(l.waiting) == 0 {
+		l.inFlight++
+		l.mutex.Unlock()
+		return true
+	}
+	if wait == 0 {
+		l.mutex.Unlock()
+		return false
+	}
+	l.seq++
+	waiter := &overloadWaiter{priority: priority, seq: l.seq, ready: make(chan struct{})}
+	heap.Push(&l.waiting, waiter)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+		return true
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if waiter.index < 0 {
+		// the slot was handed over while giving up, it goes to the next request
+		l.releaseLocked()
+		return false
+	}
+	heap.Remove(&l.waiting, waiter.index)
+	return false
+}
+
+func (l *overloadLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.releaseLocked()
+}
+
+// releaseLocked hands the slot over to the first waiting request, if any
+func (l *overloadLimiter) releaseLocked() {
+	if len(l.waiting) == 0 {
+		l.inFlight--
+		return
+	}
+	waiter := heap.Pop(&l.waiting).(*overloadWaiter)
+	close(waiter.ready)
+}
+
+// overloadQueue is the heap of the waiting requests, by decreasing priority and increasing arrival
+type overloadQueue []*overloadWaiter
+
+func (q overloadQueue) Len() int { return len(q) }
+
+func (q overloadQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q overloadQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *overloadQueue) Push(x interface{}) {
+	waiter := x.(*overloadWaiter)
+	waiter.index = len(*q)
+	*q = append(*q, waiter)
+}
+
+func (q *overloadQueue) Pop() interface{} {
+	old := *q
+	waiter := old[len(old)-1]
+	old[len(old)-1] = nil
+	waiter.index = -1
+	*q = old[:len(old)-1]
+	return waiter
+}
+
+// rejectOverload replies with 503, the clients are asked to retry once a queued request would have given up
+func (f *httpForwarder) rejectOverload(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
+	atomic.AddInt64(&f.overload.rejected, 1)
+	if req.Context().Err() != nil {
+		ctx.log.Infof("Client went away while waiting for a slot to forward %v", req.URL)
+		return
+	}
+	ctx.log.Warningf("Rejecting request to %v, the forwarder reached the concurrency limit", req.URL)
+	retryAfter := int64((f.overloadWait + time.Second - 1) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set(RetryAfter, strconv.FormatInt(retryAfter, 10))
+	ctx.errHandler.ServeHTTP(w, req, &StatusError{Code: http.StatusServiceUnavailable, Reason: "overloaded"})
+}
+
+// priorityOf returns the queue priority of the request, 0 without QueuePriority
+func (f *httpForwarder) priorityOf(req *http.Request) int {
+	if f.queuePriority == nil {
+		return 0
+	}
+	return f.queuePriority(req)
+}
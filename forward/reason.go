@@ -0,0 +1,62 @@
+package forward
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// PreserveReasonPhrase relays the custom reason phrases of the backends, e.g. "404 Gone Fishing",
+// for the legacy clients parsing them. http.ResponseWriter always writes the canonical phrase, so
+// the client connection is hijacked to write these responses: this only works for HTTP/1 clients,
+// the connection is closed after the response and the response trailers are dropped. The responses
+// with the canonical phrase are forwarded as usual.
+func PreserveReasonPhrase(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.preserveReason = b
+		return nil
+	}
+}
+
+// hasCustomReason returns true when the backend sent a reason phrase other than the canonical one
+func hasCustomReason(response *http.Response) bool {
+	canonical := strconv.Itoa(response.StatusCode) + " " + http.StatusText(response.StatusCode)
+	return response.Status != "" && response.Status != canonical
+}
+
+// writeWithReason writes the response with its reason phrase on the hijacked client connection,
+// it returns false when the connection can't be hijacked and nothing was written
+func writeWithReason(w http.ResponseWriter, req *http.Request, response *http.Response, body *bodyReader, ctx *handlerContext) bool {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok || req.ProtoMajor != 1 {
+		return false
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		ctx.log.Warningf("Unable to hijack the connection to preserve the reason phrase: %v", err)
+		return false
+	}
+	defer conn.Close()
+
+	// the length is known once the response is buffered
+	if length, err := strconv.ParseInt(w.Header().Get(ContentLength), 10, 64); err == nil {
+		response.ContentLength = length
+	}
+
+	out := &http.Response{
+		Status:        response.Status,
+		StatusCode:    response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.Header(),
+		Body:          ioutil.NopCloser(body),
+		ContentLength: response.ContentLength,
+		Close:         true,
+		Request:       req,
+	}
+	if err := out.Write(conn); err != nil {
+		ctx.log.Errorf("Error writing the response with its reason phrase: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+type statsKey struct{}
+
+// statsTracker collects the backend side of the request for its Event, the trace hooks may be called
+// from the dialing goroutines. Its methods are no-ops on a nil tracker, when there are no observers.
+type statsTracker struct {
+	clock timetools.TimeProvider
+	start time.Time
+
+	mutex     sync.Mutex
+	dns       time.Duration
+	connect   time.Duration
+	tls       time.Duration
+	firstByte time.Duration
+	err       error
+	dnsStart  time.Time
+	dialed    time.Time
+	tlsStart  time.Time
+	bytesIn   int64
+}
+
+// withStats returns a copy of the request carrying the tracker to the HTTP forwarder
+func withStats(req *http.Request, t *statsTracker) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), statsKey{}, t))
+}
+
+// statsFrom returns the tracker of the request, nil when it is not tracked
+func statsFrom(req *http.Request) *statsTracker {
+	t, _ := req.Context().Value(statsKey{}).(*statsTracker)
+	return t
+}
+
+// trace returns a copy of the request reporting its connection phases and body size to the tracker
+func (t *statsTracker) trace(outReq *http.Request) *http.Request {
+	if t == nil {
+		return outReq
+	}
+	since := func(start time.Time) time.Duration {
+		if start.IsZero() {
+			return 0
+		}
+		return t.clock.UtcNow().Sub(start)
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.dnsStart = t.clock.UtcNow()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.dns = since(t.dnsStart)
+		},
+		// the dialer may try several addresses, the connect phase spans all of them
+		ConnectStart: func(network, addr string) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if t.dialed.IsZero() {
+				t.dialed = t.clock.UtcNow()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.connect = since(t.dialed)
+		},
+		TLSHandshakeStart: func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.tlsStart = t.clock.UtcNow()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.tls = since(t.tlsStart)
+		},
+		GotFirstResponseByte: func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.firstByte = since(t.start)
+		},
+	}
+	outReq = outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), trace))
+	if outReq.Body != nil && outReq.Body != http.NoBody {
+		outReq.Body = &countingBody{ReadCloser: outReq.Body, n: &t.bytesIn}
+	}
+	return outReq
+}
+
+// fail records the error ending the request
+func (t *statsTracker) fail(err error) {
+	if t == nil || err == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.err = err
+}
+
+// fill sets the backend side of the request on its event
+func (t *statsTracker) fill(e *Event) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	e.DNS, e.Connect, e.TLS = t.dns, t.connect, t.tls
+	e.UpstreamFirstByte = t.firstByte
+	e.BytesIn = atomic.LoadInt64(&t.bytesIn)
+	e.Err = t.err
+}
+
+// countingBody counts the bytes of the request body read by the transport
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
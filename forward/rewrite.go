@@ -32,11 +32,7 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 		req.Header.Set(XForwardedProto, "http")
 	}
 
-	if xfh := req.Header.Get(XForwardedHost); xfh != "" && rw.TrustForwardHeader {
-		req.Header.Set(XForwardedHost, xfh)
-	} else if req.Host != "" {
-		req.Header.Set(XForwardedHost, req.Host)
-	}
+	rw.setForwardedHost(req, req)
 
 	if rw.Hostname != "" {
 		req.Header.Set(XForwardedServer, rw.Hostname)
@@ -46,3 +42,13 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 	// connection, regardless of what the client sent to us.
 	utils.RemoveHeaders(req.Header, HopHeaders...)
 }
+
+// setForwardedHost sets X-Forwarded-Host of the outgoing request to the Host of the client request,
+// unless a trusted previous proxy already set it
+func (rw *HeaderRewriter) setForwardedHost(outReq, req *http.Request) {
+	if xfh := req.Header.Get(XForwardedHost); xfh != "" && rw.TrustForwardHeader {
+		outReq.Header.Set(XForwardedHost, xfh)
+	} else if req.Host != "" {
+		outReq.Header.Set(XForwardedHost, req.Host)
+	}
+}
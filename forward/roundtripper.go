@@ -0,0 +1,23 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+)
+
+type roundTripperKey struct{}
+
+// WithRoundTripper returns a copy of the request sent with rt instead of the round tripper of the
+// forwarder, e.g. the transport specific to the backend picked by the load balancer, with its own
+// TLS settings, proxy or timeouts. A nil round tripper restores the one of the forwarder.
+func WithRoundTripper(req *http.Request, rt http.RoundTripper) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), roundTripperKey{}, rt))
+}
+
+// roundTripperFor returns the round tripper of the request, falling back to the one of the forwarder
+func (f *httpForwarder) roundTripperFor(req *http.Request) http.RoundTripper {
+	if rt, ok := req.Context().Value(roundTripperKey{}).(http.RoundTripper); ok && rt != nil {
+		return rt
+	}
+	return f.roundTripper
+}
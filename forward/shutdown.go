@@ -0,0 +1,163 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// Shutdown stops forwarding new requests, which are rejected with 503 Service Unavailable, including
+// the websocket upgrades, and waits for the HTTP requests in flight to complete. The websocket tunnels
+// left are then closed, as they would keep the shutdown waiting for as long as the clients stay
+// connected, and Shutdown returns once their handlers are done. It returns the context error if the
+// context is done before, after closing the tunnels all the same.
+func (f *Forwarder) Shutdown(ctx context.Context) error {
+	return f.drainer.shutdown(ctx)
+}
+
+// HandleSignals shuts the forwarder down once any of the signals is received, giving the requests
+// in flight the grace period to complete. The returned channel receives the result of the shutdown.
+func (f *Forwarder) HandleSignals(grace time.Duration, sig ...os.Signal) <-chan error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig...)
+	done := make(chan error, 1)
+	go func() {
+		defer signal.Stop(signals)
+		done <- f.shutdownOn(signals, grace)
+	}()
+	return done
+}
+
+func (f *Forwarder) shutdownOn(signals <-chan os.Signal, grace time.Duration) error {
+	sig := <-signals
+	f.log.Infof("Received %v, shutting down with grace period %v", sig, grace)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	return f.Shutdown(ctx)
+}
+
+// drainer tracks the requests in flight, and the websocket tunnels among them
+type drainer struct {
+	mutex    *sync.Mutex
+	draining bool
+	active   int
+	// closers of the open tunnels, called on shutdown once the other requests are drained
+	tunnels     map[int]func()
+	nextTunnel  int
+	closeTunnel bool
+	// closed once draining and only tunnels are left in flight
+	requestsDrained chan struct{}
+	// closed once draining and no requests are left in flight
+	drained chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{
+		mutex:           &sync.Mutex{},
+		tunnels:         map[int]func(){},
+		requestsDrained: make(chan struct{}),
+		drained:         make(chan struct{}),
+	}
+}
+
+// enter returns false when the request should be rejected because of the shutdown
+func (d *drainer) enter() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.draining {
+		return false
+	}
+	d.active++
+	return true
+}
+
+func (d *drainer) leave() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.active--
+	d.checkDrained()
+}
+
+// track registers the closer of a tunnel opened by a request in flight, the returned function
+// unregisters it once the tunnel is closed
+func (d *drainer) track(closer func()) func() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closeTunnel {
+		// the tunnels were closed while this one was being opened
+		closer()
+		return func() {}
+	}
+	id := d.nextTunnel
+	d.nextTunnel++
+	d.tunnels[id] = closer
+	d.checkDrained()
+	return func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		delete(d.tunnels, id)
+	}
+}
+
+// checkDrained signals the drained stages, it is called with the mutex held
+func (d *drainer) checkDrained() {
+	if !d.draining {
+		return
+	}
+	if d.active == len(d.tunnels) {
+		closeOnce(d.requestsDrained)
+	}
+	if d.active == 0 {
+		closeOnce(d.drained)
+	}
+}
+
+func closeOnce(c chan struct{}) {
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
+
+// shutdown waits for the requests other than the tunnels, then closes the tunnels and waits for all
+func (d *drainer) shutdown(ctx context.Context) error {
+	d.mutex.Lock()
+	d.draining = true
+	d.checkDrained()
+	d.mutex.Unlock()
+
+	var err error
+	select {
+	case <-d.requestsDrained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	d.closeTunnels()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-d.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeTunnels closes the open tunnels and the ones opened from now on
+func (d *drainer) closeTunnels() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.closeTunnel = true
+	for _, closer := range d.tunnels {
+		closer()
+	}
+}
+
+func (f *Forwarder) rejectShutdown(w http.ResponseWriter, req *http.Request) {
+	f.errHandler.ServeHTTP(w, req, &StatusError{Code: http.StatusServiceUnavailable, Reason: "shutting down"})
+}
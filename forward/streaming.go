@@ -0,0 +1,54 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+type streamingKey struct{}
+
+// WithStreaming returns a copy of the request opting into the streamed response,
+// even if the forwarder does not stream the responses otherwise. Clients can
+// opt in as well by sending the X-Proxy-Stream: true header.
+func WithStreaming(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), streamingKey{}, true))
+}
+
+func isStreamingRequest(req *http.Request) bool {
+	if stream, ok := req.Context().Value(streamingKey{}).(bool); ok && stream {
+		return true
+	}
+	stream, err := strconv.ParseBool(req.Header.Get(XProxyStream))
+	return err == nil && stream
+}
+
+// StreamDecider decides for every response whether it is streamed to the client or buffered, when the
+// forwarder doesn't stream all the responses and the request didn't opt into streaming. It is called
+// once the response headers are received, e.g. to stream the gRPC and the large downloads but buffer
+// the small JSON responses. DefaultStreamDecider is used when it is not set.
+func StreamDecider(fn func(response *http.Response) bool) optSetter {
+	return func(f *Forwarder) error {
+		if fn == nil {
+			return fmt.Errorf("stream decider can't be nil")
+		}
+		f.httpForwarder.streamDecider = fn
+		return nil
+	}
+}
+
+// DefaultStreamDecider streams the server-sent events, the clients expect them as they are sent
+func DefaultStreamDecider(response *http.Response) bool {
+	contentType, err := utils.GetHeaderMediaType(response.Header, ContentType)
+	return err == nil && contentType == "text/event-stream"
+}
+
+func (f *httpForwarder) decideStream(response *http.Response) bool {
+	if f.streamDecider != nil {
+		return f.streamDecider(response)
+	}
+	return DefaultStreamDecider(response)
+}
@@ -0,0 +1,43 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// WebsocketAllowedSubprotocols restricts the websocket subprotocols the clients may request. The upgrades
+// asking for any other subprotocol are rejected with 400 Bad Request before dialing the backend, the
+// upgrades asking for none are forwarded. All the subprotocols are allowed when none is given.
+func WebsocketAllowedSubprotocols(names ...string) optSetter {
+	return func(f *Forwarder) error {
+		if len(names) == 0 {
+			f.websocketForwarder.subprotocols = nil
+			return nil
+		}
+		allowed := make(map[string]bool, len(names))
+		for _, name := range names {
+			if name == "" {
+				return fmt.Errorf("allowed subprotocols can't be empty")
+			}
+			allowed[name] = true
+		}
+		f.websocketForwarder.subprotocols = allowed
+		return nil
+	}
+}
+
+// disallowedSubprotocol returns the first subprotocol requested by the client outside the allowlist
+func (f *websocketForwarder) disallowedSubprotocol(req *http.Request) (string, bool) {
+	if f.subprotocols == nil {
+		return "", false
+	}
+	for _, v := range req.Header[SecWebsocketProtocol] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" && !f.subprotocols[name] {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
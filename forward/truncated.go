@@ -0,0 +1,65 @@
+package forward
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// ResponseTruncatedMetric counts the upstream responses cut short by the backend
+const ResponseTruncatedMetric = "response.truncated"
+
+// RetryTruncatedResponses retries once the idempotent requests without a body whose upstream
+// response is cut short before anything was sent to the client. The response is only held back
+// until it's complete with BufferResponse, a truncated streamed response aborts the client connection.
+func RetryTruncatedResponses(b bool) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.retryTruncated = b
+		return nil
+	}
+}
+
+// TruncatedResponses returns the number of upstream responses the backend cut short
+func (f *Forwarder) TruncatedResponses() int64 {
+	return atomic.LoadInt64(&f.httpForwarder.truncated)
+}
+
+// bodyReader remembers the upstream read error to tell it apart from the client write errors
+type bodyReader struct {
+	io.Reader
+	err error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// isTruncated tells whether the backend closed the connection partway through the body
+func isTruncated(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNRESET
+}
+
+// canRetry tells whether the request can be sent again
+func canRetry(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.ContentLength == 0
+	}
+	return false
+}
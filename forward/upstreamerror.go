@@ -0,0 +1,30 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+)
+
+type upstreamErrorKey struct{}
+
+// WithUpstreamError returns a copy of the request the forwarder records the upstream failure on, when it
+// replies with an error because the upstream could not be reached or failed before responding. It tells
+// these replies apart from the same statuses sent by the upstream, e.g. a 502, see UpstreamError.
+func WithUpstreamError(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), upstreamErrorKey{}, new(error)))
+}
+
+// UpstreamError returns the upstream failure the forwarder replied with an error for, nil when the
+// response came from the upstream or the request was not returned by WithUpstreamError
+func UpstreamError(req *http.Request) error {
+	if failure, ok := req.Context().Value(upstreamErrorKey{}).(*error); ok {
+		return *failure
+	}
+	return nil
+}
+
+func recordUpstreamError(req *http.Request, err error) {
+	if failure, ok := req.Context().Value(upstreamErrorKey{}).(*error); ok {
+		*failure = err
+	}
+}
@@ -0,0 +1,48 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpstreamTrace records the upstream selected by every proxy of a chain in the X-Oxy-Trace header, to
+// debug the routing across proxy layers. The label of the upstream is appended to the request header,
+// so the next hop sees the trail so far, and prepended to the response header, so the client gets the
+// whole trail in the order of the hops. label returns the label of the upstream, "" leaves the hop out,
+// e.g. to hide the internal URLs. A nil label uses the host of the upstream.
+func UpstreamTrace(label func(upstream *url.URL) string) optSetter {
+	return func(f *Forwarder) error {
+		if label == nil {
+			label = func(upstream *url.URL) string {
+				return upstream.Host
+			}
+		}
+		f.httpForwarder.traceLabel = label
+		return nil
+	}
+}
+
+// appendTrace adds the hop to the trail of the header, after the hops of the previous proxies
+func appendTrace(h http.Header, hop string) {
+	if prior, ok := h[XOxyTrace]; ok {
+		hop = strings.Join(prior, ", ") + ", " + hop
+	}
+	h.Set(XOxyTrace, hop)
+}
+
+// prependTrace adds the hop to the trail of the header, before the hops of the next proxies
+func prependTrace(h http.Header, hop string) {
+	if next, ok := h[XOxyTrace]; ok {
+		hop = hop + ", " + strings.Join(next, ", ")
+	}
+	h.Set(XOxyTrace, hop)
+}
+
+// traceHop returns the label of the upstream, "" when it is left out or the trace is off
+func (f *httpForwarder) traceHop(u *url.URL) string {
+	if f.traceLabel == nil {
+		return ""
+	}
+	return f.traceLabel(u)
+}
@@ -0,0 +1,51 @@
+package forward
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// WebsocketGoroutinesMetric is the number of goroutines running the websocket tunnels, each tunnel
+// runs three of them: a pump per direction and the handler waiting for them
+const WebsocketGoroutinesMetric = "ws.goroutines"
+
+// goroutinesPerTunnel is the number of goroutines running a websocket tunnel
+const goroutinesPerTunnel = 3
+
+// MaxWebsocketConnections caps the number of websocket tunnels open at once, which bounds their goroutines
+// to three times n, see WebsocketGoroutines. The upgrades over the limit are rejected with 503 Service
+// Unavailable before dialing the backend.
+func MaxWebsocketConnections(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n <= 0 {
+			return fmt.Errorf("max websocket connections should be > 0, got %v", n)
+		}
+		f.websocketForwarder.maxTunnels = int64(n)
+		return nil
+	}
+}
+
+// WebsocketGoroutines returns the WebsocketGoroutinesMetric gauge
+func (f *Forwarder) WebsocketGoroutines() int64 {
+	return atomic.LoadInt64(&f.websocketForwarder.goroutines)
+}
+
+// acquireTunnel takes a slot of the tunnel limit, it returns false when the limit is reached
+func (f *websocketForwarder) acquireTunnel() bool {
+	if n := atomic.AddInt64(&f.tunnels, 1); f.maxTunnels > 0 && n > f.maxTunnels {
+		atomic.AddInt64(&f.tunnels, -1)
+		return false
+	}
+	return true
+}
+
+func (f *websocketForwarder) releaseTunnel() {
+	atomic.AddInt64(&f.tunnels, -1)
+}
+
+// rejectTunnel replies with 503 when the tunnel limit is reached
+func (f *websocketForwarder) rejectTunnel(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
+	ctx.log.Warningf("Rejecting websocket upgrade to %v, %v tunnels are open", req.URL, f.maxTunnels)
+	ctx.errHandler.ServeHTTP(w, req, &StatusError{Code: http.StatusServiceUnavailable, Reason: "too many websocket connections"})
+}
@@ -0,0 +1,171 @@
+package memmetrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistogramSource returns the latency histogram to report, e.g. RTMetrics.LatencyHistogram
+type HistogramSource func() (*HDRHistogram, error)
+
+// reportedQuantiles are the quantiles published for every histogram, with the suffix of their gauge
+var reportedQuantiles = []struct {
+	suffix   string
+	quantile float64
+}{
+	{".p50", 50},
+	{".p95", 95},
+	{".p99", 99},
+}
+
+type prOptSetter func(r *PercentileReporter) error
+
+// ReporterPublish sets a hook called with every gauge once it is updated, e.g. to set the gauges
+// of the metrics library in use. It is called with the reporter locked, so it can't call the reporter.
+func ReporterPublish(publish func(name string, value time.Duration)) prOptSetter {
+	return func(r *PercentileReporter) error {
+		r.publish = publish
+		return nil
+	}
+}
+
+// ReporterAutoStart starts reporting as soon as the reporter is created
+func ReporterAutoStart() prOptSetter {
+	return func(r *PercentileReporter) error {
+		r.autoStart = true
+		return nil
+	}
+}
+
+// PercentileReporter periodically reads latency histograms and publishes their p50, p95 and p99 as
+// gauges named after the histogram, e.g. "backend.p99", so they can be alerted on directly.
+type PercentileReporter struct {
+	interval  time.Duration
+	publish   func(name string, value time.Duration)
+	autoStart bool
+
+	mutex   *sync.Mutex
+	sources map[string]HistogramSource
+	gauges  map[string]time.Duration
+	stop    chan struct{}
+}
+
+// NewPercentileReporter returns a reporter updating the gauges every interval
+func NewPercentileReporter(interval time.Duration, options ...prOptSetter) (*PercentileReporter, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval should be > 0, got %v", interval)
+	}
+	r := &PercentileReporter{
+		interval: interval,
+		mutex:    &sync.Mutex{},
+		sources:  make(map[string]HistogramSource),
+		gauges:   make(map[string]time.Duration),
+	}
+	for _, o := range options {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.autoStart {
+		r.Start()
+	}
+	return r, nil
+}
+
+// Add reports the percentiles of the histogram under the name, replacing the histogram with the same name
+func (r *PercentileReporter) Add(name string, source HistogramSource) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sources[name] = source
+}
+
+// Remove stops reporting the histogram and drops its gauges
+func (r *PercentileReporter) Remove(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.sources, name)
+	for _, q := range reportedQuantiles {
+		delete(r.gauges, name+q.suffix)
+	}
+}
+
+// Start updates the gauges every interval in the background until Stop is called
+func (r *PercentileReporter) Start() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	go r.run(r.stop)
+}
+
+// Stop stops the background updates, the gauges keep their last values
+func (r *PercentileReporter) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// Gauge returns the last value of the gauge
+func (r *PercentileReporter) Gauge(name string) (time.Duration, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	v, ok := r.gauges[name]
+	return v, ok
+}
+
+// Gauges returns a copy of the last values of the gauges
+func (r *PercentileReporter) Gauges() map[string]time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	out := make(map[string]time.Duration, len(r.gauges))
+	for k, v := range r.gauges {
+		out[k] = v
+	}
+	return out
+}
+
+func (r *PercentileReporter) run(stop chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.report()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// report updates the gauges of all the histograms, the histograms failing to merge are skipped.
+// It runs under the lock, so a histogram removed meanwhile doesn't get its gauges back.
+func (r *PercentileReporter) report() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	names := make([]string, 0, len(r.sources))
+	for name := range r.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h, err := r.sources[name]()
+		if err != nil || h == nil {
+			continue
+		}
+		for _, q := range reportedQuantiles {
+			gauge, value := name+q.suffix, h.LatencyAtQuantile(q.quantile)
+			r.gauges[gauge] = value
+			if r.publish != nil {
+				r.publish(gauge, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package memmetrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	. "gopkg.in/check.v1"
+)
+
+type PercentilesSuite struct {
+	tm *timetools.FreezedTime
+}
+
+var _ = Suite(&PercentilesSuite{})
+
+func (s *PercentilesSuite) SetUpSuite(c *C) {
+	s.tm = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *PercentilesSuite) TestReport(c *C) {
+	m, err := NewRTMetrics(RTClock(s.tm))
+	c.Assert(err, IsNil)
+	for i := 1; i <= 100; i++ {
+		m.Record(200, time.Duration(i)*time.Millisecond)
+	}
+
+	published := map[string]time.Duration{}
+	r, err := NewPercentileReporter(time.Minute, ReporterPublish(func(name string, value time.Duration) {
+		published[name] = value
+	}))
+	c.Assert(err, IsNil)
+	r.Add("backend", m.LatencyHistogram)
+
+	_, ok := r.Gauge("backend.p50")
+	c.Assert(ok, Equals, false)
+
+	r.report()
+	expected := map[string]time.Duration{
+		"backend.p50": 50 * time.Millisecond,
+		"backend.p95": 95 * time.Millisecond,
+		"backend.p99": 99 * time.Millisecond,
+	}
+	gauges := r.Gauges()
+	for name, value := range expected {
+		// the histogram keeps 2 significant figures
+		c.Assert(gauges[name].Round(time.Millisecond), Equals, value)
+	}
+	c.Assert(published, DeepEquals, gauges)
+
+	r.Remove("backend")
+	c.Assert(r.Gauges(), DeepEquals, map[string]time.Duration{})
+
+	_, err = NewPercentileReporter(0)
+	c.Assert(err, NotNil)
+}
+
+func (s *PercentilesSuite) TestReportRemove(c *C) {
+	m, err := NewRTMetrics(RTClock(s.tm))
+	c.Assert(err, IsNil)
+	m.Record(200, time.Millisecond)
+
+	r, err := NewPercentileReporter(time.Minute)
+	c.Assert(err, IsNil)
+
+	started, release := make(chan bool), make(chan bool)
+	r.Add("backend", func() (*HDRHistogram, error) {
+		started <- true
+		<-release
+		return m.LatencyHistogram()
+	})
+
+	reported := make(chan bool)
+	go func() {
+		r.report()
+		close(reported)
+	}()
+	<-started
+
+	// the histogram is removed while it is read
+	removed := make(chan bool)
+	go func() {
+		r.Remove("backend")
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-reported
+	<-removed
+
+	c.Assert(r.Gauges(), DeepEquals, map[string]time.Duration{})
+}
+
+func (s *PercentilesSuite) TestStartStop(c *C) {
+	m, err := NewRTMetrics()
+	c.Assert(err, IsNil)
+	m.Record(200, 10*time.Millisecond)
+
+	var once sync.Once
+	reported := make(chan struct{})
+	r, err := NewPercentileReporter(time.Millisecond, ReporterAutoStart(), ReporterPublish(func(string, time.Duration) {
+		once.Do(func() { close(reported) })
+	}))
+	c.Assert(err, IsNil)
+	r.Add("backend", m.LatencyHistogram)
+
+	select {
+	case <-reported:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the gauges were not reported")
+	}
+	r.Stop()
+	r.Stop()
+
+	v, ok := r.Gauge("backend.p99")
+	c.Assert(ok, Equals, true)
+	c.Assert(v.Round(time.Millisecond), Equals, 10*time.Millisecond)
+}
@@ -0,0 +1,96 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// StrategyAdaptive scales the weight of every server by its success rate over the sliding window,
+// so degrading servers naturally receive less traffic without being ejected from the pool.
+// Responses with 5xx status codes count as failures. The window has a one second resolution.
+func StrategyAdaptive(window time.Duration) LBOption {
+	return func(s *RoundRobin) error {
+		if window < time.Second {
+			return fmt.Errorf("window should be >= 1s, got %v", window)
+		}
+		s.adaptive = &adaptiveStrategy{window: window}
+		return nil
+	}
+}
+
+// adaptiveScale gives the effective weights enough granularity to reflect the success rates
+const adaptiveScale = 100
+
+type adaptiveStrategy struct {
+	window time.Duration
+}
+
+// newMeter returns the counter of failed (a) and successful (b) responses over the window
+func (a *adaptiveStrategy) newMeter(clock timetools.TimeProvider) (*memmetrics.RatioCounter, error) {
+	return memmetrics.NewRatioCounter(int(a.window/time.Second), time.Second, memmetrics.RatioClock(clock))
+}
+
+// effectiveWeight returns the weight the server is balanced with
+func (r *RoundRobin) effectiveWeight(s *server) int {
+	return r.effectiveWeightAt(s, r.clock.UtcNow())
+}
+
+// effectiveWeightAt returns the weight the server is balanced with at now
+func (r *RoundRobin) effectiveWeightAt(s *server, now time.Time) int {
+	if s.breaker != nil && s.breaker.current(now) == BreakerOpen {
+		return 0
+	}
+	if r.retryAfterMax != 0 && now.Before(s.unavailableUntil) {
+		return 0
+	}
+	// the weights are scaled as soon as any of them needs it, so they stay comparable
+	if w := s.baseWeight(); r.ramp == 0 && (w == 0 || (s.failures == nil && r.backpressure == nil && r.draining == 0)) {
+		return w
+	}
+	weight := r.rampedWeightAt(s, now) * adaptiveScale
+	if weight == 0 {
+		return 0
+	}
+	if s.drainOver > 0 {
+		ratio := r.drainRatio(s, now)
+		if ratio == 0 {
+			return 0
+		}
+		weight *= ratio
+	}
+	if s.failures != nil {
+		weight *= 1 - s.failures.Ratio()
+	}
+	if r.backpressure != nil && now.Before(s.pressuredUntil) {
+		weight *= r.backpressure.factor
+	}
+	// keep sending some traffic to the server to notice its recovery, unless it is drained
+	if weight < 1 {
+		if s.drainOver > 0 {
+			return 0
+		}
+		return 1
+	}
+	return int(weight)
+}
+
+// observe records the outcome of the request sent to the server
+func (r *RoundRobin) observe(u *url.URL, code int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, _ := r.findServerByURL(u)
+	if s == nil || s.failures == nil {
+		return
+	}
+	if code >= http.StatusInternalServerError {
+		s.failures.IncA(1)
+	} else {
+		s.failures.IncB(1)
+	}
+}
@@ -0,0 +1,88 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type AdaptiveSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&AdaptiveSuite{})
+
+func (s *AdaptiveSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *AdaptiveSuite) TestShiftsTrafficFromFailingServer(c *C) {
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, StrategyAdaptive(10*time.Second), RoundRobinClock(s.clock))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// no stats yet, servers are balanced equally
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "b"})
+
+	counts := map[string]int{}
+	for _, body := range seq(c, proxy.URL, 202) {
+		counts[body]++
+	}
+	c.Assert(counts["a"], Equals, 2)
+	c.Assert(counts["b"], Equals, 200)
+}
+
+func (s *AdaptiveSuite) TestEffectiveWeights(c *C) {
+	lb, err := New(nil, StrategyAdaptive(10*time.Second), RoundRobinClock(s.clock))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://a"), testutils.ParseURI("http://b")
+	c.Assert(lb.UpsertServer(a, Weight(2)), IsNil)
+	c.Assert(lb.UpsertServer(b), IsNil)
+
+	for i := 0; i < 10; i++ {
+		code := http.StatusOK
+		if i%4 == 0 {
+			code = http.StatusBadGateway
+		}
+		lb.observe(a, code)
+		lb.observe(b, http.StatusOK)
+	}
+	// 3 of 10 requests failed on a
+	c.Assert(lb.effectiveWeight(lb.servers[0]), Equals, 140)
+	c.Assert(lb.effectiveWeight(lb.servers[1]), Equals, 100)
+
+	// failures leave the window
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(11 * time.Second)
+	c.Assert(lb.effectiveWeight(lb.servers[0]), Equals, 200)
+}
+
+func (s *AdaptiveSuite) TestBadWindow(c *C) {
+	_, err := New(nil, StrategyAdaptive(time.Millisecond))
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,78 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Backpressure treats the 429 Too Many Requests responses as a request for less traffic rather than
+// as errors: the weight of the server is scaled by factor until the Retry-After delay elapses, or for
+// defaultDelay when the response has none. With unavailable, the 503 Service Unavailable responses
+// carrying a Retry-After header are treated the same way.
+func Backpressure(factor float64, defaultDelay time.Duration, unavailable bool) LBOption {
+	return func(s *RoundRobin) error {
+		if factor <= 0 || factor >= 1 {
+			return fmt.Errorf("backpressure factor should be in (0, 1), got %v", factor)
+		}
+		if defaultDelay <= 0 {
+			return fmt.Errorf("backpressure delay should be > 0, got %v", defaultDelay)
+		}
+		s.backpressure = &backpressure{factor: factor, defaultDelay: defaultDelay, unavailable: unavailable}
+		return nil
+	}
+}
+
+type backpressure struct {
+	factor       float64
+	defaultDelay time.Duration
+	unavailable  bool
+}
+
+// delay returns how long the server asked for less traffic, if it did
+func (b *backpressure) delay(code int, header http.Header, now time.Time) (time.Duration, bool) {
+	retryAfter := header.Get("Retry-After")
+	switch {
+	case code == http.StatusTooManyRequests:
+	case code == http.StatusServiceUnavailable && b.unavailable && retryAfter != "":
+	default:
+		return 0, false
+	}
+	if d, ok := parseRetryAfter(retryAfter, now); ok {
+		return d, true
+	}
+	return b.defaultDelay, true
+}
+
+// parseRetryAfter parses the Retry-After header, given in seconds or as a date
+func parseRetryAfter(retryAfter string, now time.Time) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(retryAfter); err == nil {
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+// observePressure lowers the weight of the server asking for less traffic
+func (r *RoundRobin) observePressure(u *url.URL, code int, header http.Header) {
+	now := r.clock.UtcNow()
+	d, ok := r.backpressure.delay(code, header, now)
+	if !ok {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, _ := r.findServerByURL(u)
+	if s == nil {
+		return
+	}
+	if until := now.Add(d); until.After(s.pressuredUntil) {
+		s.pressuredUntil = until
+		r.log.Infof("%v asked for less traffic until %v", u, until)
+	}
+}
@@ -0,0 +1,111 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type BackpressureSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&BackpressureSuite{})
+
+func (s *BackpressureSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *BackpressureSuite) TestTooManyRequests(c *C) {
+	var throttle int32 = 1
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.CompareAndSwapInt32(&throttle, 1, 0) {
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, Backpressure(0.1, time.Second, false), RoundRobinClock(s.clock))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// a answers the first request with 429
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "b"})
+
+	// a gets a tenth of the traffic of b for 10 seconds
+	counts := map[string]int{}
+	for _, body := range seq(c, proxy.URL, 110) {
+		counts[body]++
+	}
+	c.Assert(counts["a"], Equals, 10)
+	c.Assert(counts["b"], Equals, 100)
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(10 * time.Second)
+	counts = map[string]int{}
+	for _, body := range seq(c, proxy.URL, 10) {
+		counts[body]++
+	}
+	c.Assert(counts["a"], Equals, 5)
+	c.Assert(counts["b"], Equals, 5)
+}
+
+func (s *BackpressureSuite) TestDelay(c *C) {
+	now := s.clock.CurrentTime
+	retryAfter := func(v string) http.Header {
+		h := http.Header{}
+		if v != "" {
+			h.Set("Retry-After", v)
+		}
+		return h
+	}
+
+	bp := &backpressure{factor: 0.5, defaultDelay: time.Second}
+	d, ok := bp.delay(http.StatusTooManyRequests, retryAfter("5"), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, 5*time.Second)
+
+	d, ok = bp.delay(http.StatusTooManyRequests, retryAfter(now.Add(time.Minute).Format(http.TimeFormat)), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, time.Minute)
+
+	d, ok = bp.delay(http.StatusTooManyRequests, retryAfter(""), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(d, Equals, time.Second)
+
+	// 503 only counts when enabled, and with Retry-After
+	_, ok = bp.delay(http.StatusServiceUnavailable, retryAfter("5"), now)
+	c.Assert(ok, Equals, false)
+	bp.unavailable = true
+	_, ok = bp.delay(http.StatusServiceUnavailable, retryAfter("5"), now)
+	c.Assert(ok, Equals, true)
+	_, ok = bp.delay(http.StatusServiceUnavailable, retryAfter(""), now)
+	c.Assert(ok, Equals, false)
+
+	_, ok = bp.delay(http.StatusOK, retryAfter("5"), now)
+	c.Assert(ok, Equals, false)
+
+	_, err := New(nil, Backpressure(1, time.Second, false))
+	c.Assert(err, NotNil)
+}
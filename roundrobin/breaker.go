@@ -0,0 +1,162 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// CircuitBreaker gives every server its own circuit breaker. The breaker opens after failureThreshold
+// consecutive failed responses (5xx), and the server is not selected while it is open. After openDuration
+// the breaker is half-open: up to halfOpenProbes requests are sent to the server, the first successful
+// one closes the breaker while a failed one opens it again.
+func CircuitBreaker(failureThreshold int, openDuration time.Duration, halfOpenProbes int) LBOption {
+	return func(s *RoundRobin) error {
+		if failureThreshold <= 0 {
+			return fmt.Errorf("failure threshold should be > 0, got %v", failureThreshold)
+		}
+		if openDuration <= 0 {
+			return fmt.Errorf("open duration should be > 0, got %v", openDuration)
+		}
+		if halfOpenProbes <= 0 {
+			return fmt.Errorf("half-open probes should be > 0, got %v", halfOpenProbes)
+		}
+		s.breaker = &breakerSettings{threshold: failureThreshold, open: openDuration, probes: halfOpenProbes}
+		return nil
+	}
+}
+
+// BreakerState is the state of the circuit breaker of a server
+type BreakerState int
+
+const (
+	// BreakerClosed means the server is selected as usual
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means the server failed and is not selected
+	BreakerOpen
+	// BreakerHalfOpen means a few probe requests are sent to the server to check its recovery
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "undefined"
+}
+
+type breakerSettings struct {
+	threshold int
+	open      time.Duration
+	probes    int
+}
+
+// breaker is the circuit breaker of a server, guarded by the lock of the load balancer
+type breaker struct {
+	settings *breakerSettings
+	state    BreakerState
+	// Consecutive failures while closed
+	failures int
+	// End of the open state
+	openUntil time.Time
+	// Probes sent while half-open
+	probes int
+}
+
+// current returns the state of the breaker, turning it half-open once the open duration elapsed
+func (b *breaker) current(now time.Time) BreakerState {
+	if b.state == BreakerOpen && !now.Before(b.openUntil) {
+		b.state = BreakerHalfOpen
+		b.probes = 0
+	}
+	return b.state
+}
+
+// ready returns false when the server should be skipped, nil breakers are always ready
+func (b *breaker) ready(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	switch b.current(now) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return b.probes < b.settings.probes
+	}
+	return true
+}
+
+// take counts the request sent to the selected server
+func (b *breaker) take() {
+	if b != nil && b.state == BreakerHalfOpen {
+		b.probes++
+	}
+}
+
+// release gives back the probe of a request whose outcome is not recorded
+func (b *breaker) release() {
+	if b != nil && b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// record updates the state with the outcome of a request and returns the new state
+func (b *breaker) record(failed bool, now time.Time) BreakerState {
+	switch b.current(now) {
+	case BreakerClosed:
+		if !failed {
+			b.failures = 0
+		} else if b.failures++; b.failures >= b.settings.threshold {
+			b.trip(now)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.trip(now)
+		} else {
+			b.state = BreakerClosed
+			b.failures = 0
+		}
+	}
+	return b.state
+}
+
+func (b *breaker) trip(now time.Time) {
+	b.state = BreakerOpen
+	b.failures = 0
+	b.openUntil = now.Add(b.settings.open)
+}
+
+// tripped returns true when the circuit breaker of the server is open, so the sticky sessions
+// and the hash fallbacks move off it. It is called with the lock held.
+func (r *RoundRobin) tripped(srv *server) bool {
+	return srv.breaker != nil && srv.breaker.current(r.clock.UtcNow()) == BreakerOpen
+}
+
+// observeBreaker updates the circuit breaker of the server with the status code of its response
+func (r *RoundRobin) observeBreaker(u *url.URL, code int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, _ := r.findServerByURL(u)
+	if s == nil || s.breaker == nil {
+		return
+	}
+	before := s.breaker.current(r.clock.UtcNow())
+	after := s.breaker.record(code >= http.StatusInternalServerError, r.clock.UtcNow())
+	if before == after {
+		return
+	}
+	if after == BreakerOpen {
+		r.log.Warningf("%v circuit breaker is open until %v", u, s.breaker.openUntil)
+	} else {
+		r.log.Infof("%v circuit breaker is %v", u, after)
+	}
+	// the open servers are excluded from the weights
+	r.resetIterator()
+}
@@ -0,0 +1,158 @@
+package roundrobin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type BreakerSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&BreakerSuite{})
+
+func (s *BreakerSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *BreakerSuite) TestCircuitBreaker(c *C) {
+	var failing int32 = 1
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, CircuitBreaker(2, 10*time.Second, 1), RoundRobinClock(s.clock))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	state := func() BreakerState {
+		return lb.ServerInfos()[0].Breaker
+	}
+
+	// the breaker opens after 2 consecutive failures
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "b"})
+	c.Assert(state(), Equals, BreakerClosed)
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "b"})
+	c.Assert(state(), Equals, BreakerOpen)
+
+	// a is not selected while open
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"b", "b", "b"})
+
+	// then a failed probe opens the breaker again
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(10 * time.Second)
+	c.Assert(state(), Equals, BreakerHalfOpen)
+	c.Assert(seq(c, proxy.URL, 1), DeepEquals, []string{"a"})
+	c.Assert(state(), Equals, BreakerOpen)
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"b", "b", "b"})
+
+	// and a successful one closes it
+	atomic.StoreInt32(&failing, 0)
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(10 * time.Second)
+	c.Assert(seq(c, proxy.URL, 1), DeepEquals, []string{"a"})
+	c.Assert(state(), Equals, BreakerClosed)
+	c.Assert(seq(c, proxy.URL, 4), DeepEquals, []string{"a", "b", "a", "b"})
+
+	// a success resets the consecutive failures
+	atomic.StoreInt32(&failing, 1)
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "b"})
+	atomic.StoreInt32(&failing, 0)
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "b"})
+	atomic.StoreInt32(&failing, 1)
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "b"})
+	c.Assert(state(), Equals, BreakerClosed)
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "b"})
+	c.Assert(state(), Equals, BreakerOpen)
+
+	// only a limited number of probes is sent while half-open
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(10 * time.Second)
+	servers := []string{}
+	for i := 0; i < 3; i++ {
+		u, err := lb.NextServer()
+		c.Assert(err, IsNil)
+		servers = append(servers, u.String())
+	}
+	c.Assert(servers, DeepEquals, []string{a.URL, b.URL, b.URL})
+}
+
+func (s *BreakerSuite) TestCircuitBreakerSticky(c *C) {
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")), CircuitBreaker(2, 10*time.Second, 1), RoundRobinClock(s.clock))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	send := func() (string, []*http.Cookie) {
+		req, err := http.NewRequest("GET", proxy.URL, nil)
+		c.Assert(err, IsNil)
+		req.AddCookie(&http.Cookie{Name: "test", Value: a.URL})
+		re, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer re.Body.Close()
+		body, err := ioutil.ReadAll(re.Body)
+		c.Assert(err, IsNil)
+		return string(body), re.Cookies()
+	}
+
+	// the sticky client stays on a until its breaker opens
+	body, _ := send()
+	c.Assert(body, Equals, "a")
+	body, _ = send()
+	c.Assert(body, Equals, "a")
+	c.Assert(lb.ServerInfos()[0].Breaker, Equals, BreakerOpen)
+
+	// then moves to b, which it sticks to
+	body, cookies := send()
+	c.Assert(body, Equals, "b")
+	c.Assert(len(cookies), Equals, 1)
+	c.Assert(cookies[0].Value, Equals, b.URL)
+}
+
+func (s *BreakerSuite) TestCircuitBreakerBadParams(c *C) {
+	_, err := New(nil, CircuitBreaker(0, time.Second, 1))
+	c.Assert(err, NotNil)
+	_, err = New(nil, CircuitBreaker(1, 0, 1))
+	c.Assert(err, NotNil)
+	_, err = New(nil, CircuitBreaker(1, time.Second, 0))
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,53 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RequestBudget bounds the whole request, including the retry attempts and the backoffs between them,
+// with a deadline set when the request enters the balancer. Each attempt gets the remaining budget,
+// and the client gets 504 Gateway Timeout once the budget is exhausted.
+func RequestBudget(total time.Duration) LBOption {
+	return func(s *RoundRobin) error {
+		if total <= 0 {
+			return fmt.Errorf("request budget should be > 0, got %v", total)
+		}
+		s.budget = total
+		return nil
+	}
+}
+
+// BudgetExhaustedError is returned when the request budget runs out before the response is sent
+type BudgetExhaustedError struct {
+	Budget time.Duration
+}
+
+func (e *BudgetExhaustedError) Error() string {
+	return fmt.Sprintf("request budget of %v exhausted", e.Budget)
+}
+
+// StatusCode returns the status code to reply with
+func (e *BudgetExhaustedError) StatusCode() int {
+	return http.StatusGatewayTimeout
+}
+
+// Timeout and Temporary make it a net.Error, so the error handlers reply with 504 as for other timeouts
+func (e *BudgetExhaustedError) Timeout() bool   { return true }
+func (e *BudgetExhaustedError) Temporary() bool { return true }
+
+// withBudget returns the request with the budget deadline
+func (r *RoundRobin) withBudget(req *http.Request) (*http.Request, context.CancelFunc) {
+	if r.budget == 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), r.budget)
+	return req.WithContext(ctx), cancel
+}
+
+// budgetExhausted tells whether the request ran out of budget, as opposed to the client going away
+func (r *RoundRobin) budgetExhausted(req *http.Request) bool {
+	return r.budget != 0 && req.Context().Err() == context.DeadlineExceeded
+}
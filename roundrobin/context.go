@@ -0,0 +1,38 @@
+package roundrobin
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/vulcand/oxy/forward"
+)
+
+type serverKey struct{}
+
+// ServerFromContext returns the server the load balancer selected for the request,
+// so the next handlers can read it while processing the request
+func ServerFromContext(ctx context.Context) (*url.URL, bool) {
+	u, ok := ctx.Value(serverKey{}).(*url.URL)
+	return u, ok
+}
+
+// withServer points the request to the server and records it into the request context
+func (r *RoundRobin) withServer(req *http.Request, u *url.URL) {
+	disabled := r.keepAliveDisabled(u)
+	// the retries may switch from a server with keep-alive disabled
+	prev, _ := ServerFromContext(req.Context())
+	if disabled || (prev != nil && r.keepAliveDisabled(prev)) {
+		*req = *forward.WithKeepAlive(req, !disabled)
+	}
+	headers := r.serverHeaders(u)
+	if headers != nil || (prev != nil && r.serverHeaders(prev) != nil) {
+		*req = *forward.WithHeaders(req, headers)
+	}
+	rt := r.serverRoundTripper(u)
+	if rt != nil || (prev != nil && r.serverRoundTripper(prev) != nil) {
+		*req = *forward.WithRoundTripper(req, rt)
+	}
+	*req = *req.WithContext(context.WithValue(req.Context(), serverKey{}, u))
+	req.URL = u
+}
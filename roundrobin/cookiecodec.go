@@ -0,0 +1,189 @@
+package roundrobin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// CookieCodec encodes the backend into the sticky cookie value and decodes it back
+type CookieCodec interface {
+	// Encode returns the cookie value pointing to the backend
+	Encode(backend *url.URL) (string, error)
+	// Decode returns the server the cookie value points to, or nil if it isn't one of the servers
+	Decode(value string, servers []*url.URL) (*url.URL, error)
+}
+
+// PlainCookieCodec stores the backend URL as is in the cookie, it is the default codec
+type PlainCookieCodec struct {
+}
+
+func (PlainCookieCodec) Encode(backend *url.URL) (string, error) {
+	return backend.String(), nil
+}
+
+func (PlainCookieCodec) Decode(value string, servers []*url.URL) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	return findURL(u, servers), nil
+}
+
+// SignedCookieCodec stores the backend URL along with its HMAC-SHA256 signature, so the clients
+// can't pick the backend. The values with an invalid signature are ignored, which makes rotating
+// the key only reset the affinity.
+type SignedCookieCodec struct {
+	key []byte
+}
+
+func NewSignedCookieCodec(key []byte) (*SignedCookieCodec, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("signing key can't be empty")
+	}
+	return &SignedCookieCodec{key: key}, nil
+}
+
+func (c *SignedCookieCodec) Encode(backend *url.URL) (string, error) {
+	value := backend.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." +
+		base64.RawURLEncoding.EncodeToString(c.sign(value)), nil
+}
+
+func (c *SignedCookieCodec) Decode(value string, servers []*url.URL) (*url.URL, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, c.sign(string(raw))) {
+		return nil, nil
+	}
+	return PlainCookieCodec{}.Decode(string(raw), servers)
+}
+
+func (c *SignedCookieCodec) sign(value string) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// AESCookieCodec encrypts the backend URL with AES-GCM, so the clients can neither read nor pick
+// the backend. The values that fail to decrypt are ignored, as with SignedCookieCodec.
+type AESCookieCodec struct {
+	aead cipher.AEAD
+}
+
+// NewAESCookieCodec returns a codec encrypting with the key, which should be 16, 24 or 32 bytes long
+func NewAESCookieCodec(key []byte) (*AESCookieCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESCookieCodec{aead: aead}, nil
+}
+
+func (c *AESCookieCodec) Encode(backend *url.URL) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(backend.String()), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (c *AESCookieCodec) Decode(value string, servers []*url.URL) (*url.URL, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return nil, nil
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	raw, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, nil
+	}
+	return PlainCookieCodec{}.Decode(string(raw), servers)
+}
+
+// findURL returns the server matching the URL
+func findURL(needle *url.URL, haystack []*url.URL) *url.URL {
+	for _, s := range haystack {
+		if sameURL(needle, s) {
+			return s
+		}
+	}
+	return nil
+}
+
+// versionSeparator separates the version from the value encoded by its codec
+const versionSeparator = "~"
+
+// VersionedCookieCodec prefixes the cookie values with the version of their format, e.g. "v2~<value>",
+// so the format can be upgraded without breaking the sessions in flight: the new cookies are encoded
+// with the current version, while the cookies of the other versions still decode with their codec.
+// The codec registered for the empty version decodes the values without a version, e.g. the cookies
+// set before the versioning. The values of an unknown version are ignored, which only resets the
+// affinity, as with the invalid signatures of SignedCookieCodec.
+type VersionedCookieCodec struct {
+	current string
+	codecs  map[string]CookieCodec
+}
+
+// NewVersionedCookieCodec returns a codec encoding with the codec of the current version, and decoding
+// with the codecs of all the versions
+func NewVersionedCookieCodec(current string, codecs map[string]CookieCodec) (*VersionedCookieCodec, error) {
+	if current == "" {
+		return nil, fmt.Errorf("current cookie version can't be empty")
+	}
+	for version, codec := range codecs {
+		if strings.Contains(version, versionSeparator) {
+			return nil, fmt.Errorf("cookie version %q can't contain %q", version, versionSeparator)
+		}
+		if codec == nil {
+			return nil, fmt.Errorf("codec of cookie version %q can't be nil", version)
+		}
+	}
+	if codecs[current] == nil {
+		return nil, fmt.Errorf("no codec for the current cookie version %q", current)
+	}
+	c := &VersionedCookieCodec{current: current, codecs: make(map[string]CookieCodec, len(codecs))}
+	for version, codec := range codecs {
+		c.codecs[version] = codec
+	}
+	return c, nil
+}
+
+func (c *VersionedCookieCodec) Encode(backend *url.URL) (string, error) {
+	value, err := c.codecs[c.current].Encode(backend)
+	if err != nil {
+		return "", err
+	}
+	return c.current + versionSeparator + value, nil
+}
+
+func (c *VersionedCookieCodec) Decode(value string, servers []*url.URL) (*url.URL, error) {
+	if parts := strings.SplitN(value, versionSeparator, 2); len(parts) == 2 {
+		if codec, ok := c.codecs[parts[0]]; ok && parts[0] != "" {
+			return codec.Decode(parts[1], servers)
+		}
+	}
+	if codec, ok := c.codecs[""]; ok {
+		return codec.Decode(value, servers)
+	}
+	return nil, nil
+}
@@ -0,0 +1,106 @@
+package roundrobin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// DeadLetter hands the requests failing with a network error, once the retries of RetrySameServer are
+// exhausted when set, to the callback, e.g. to persist them and replay them out-of-band, the client still
+// gets the error. The callback runs asynchronously with a copy of the request detached from the client,
+// at most maxPending at once: the requests failing while the callbacks are busy are dropped and logged.
+// The request bodies up to 1MB are buffered for the copy, the larger ones are forwarded as they are read
+// and their requests are not handed off.
+func DeadLetter(fn func(*http.Request), maxPending int) LBOption {
+	return func(s *RoundRobin) error {
+		if fn == nil {
+			return fmt.Errorf("dead letter callback can't be nil")
+		}
+		if maxPending < 1 {
+			return fmt.Errorf("max pending dead letters should be >= 1, got %v", maxPending)
+		}
+		s.deadLetters = &deadLetters{fn: fn, pending: make(chan struct{}, maxPending)}
+		return nil
+	}
+}
+
+// maxDeadLetterBody caps the request bodies buffered for the dead letters
+const maxDeadLetterBody = 1 << 20
+
+type deadLetters struct {
+	fn func(*http.Request)
+	// Semaphore of the callbacks running
+	pending chan struct{}
+}
+
+// deadLetter hands a copy of the request to the callback, unless too many callbacks are running
+func (r *RoundRobin) deadLetter(req *http.Request) {
+	if r.deadLetters == nil {
+		return
+	}
+	select {
+	case r.deadLetters.pending <- struct{}{}:
+	default:
+		r.log.Warningf("Too many pending dead letters, dropping %v %v", req.Method, req.URL)
+		return
+	}
+	out := copyRequest(req)
+	if out == nil {
+		r.log.Warningf("Body of %v %v exceeds %v bytes, dropping the dead letter", req.Method, req.URL, maxDeadLetterBody)
+		<-r.deadLetters.pending
+		return
+	}
+	go func() {
+		defer func() { <-r.deadLetters.pending }()
+		r.deadLetters.fn(out)
+	}()
+}
+
+// bufferBody reads the request body up to maxDeadLetterBody, so a copy of it can be dead lettered with
+// GetBody. The larger bodies, and the ones failing to read, are forwarded as they are read.
+func bufferBody(req *http.Request) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxDeadLetterBody+1))
+	if err != nil || len(body) > maxDeadLetterBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// copyRequest returns a copy of the request outliving the client, ready to be sent with an http.Client
+// to the server it last failed on, nil when its body was not buffered.
+func copyRequest(req *http.Request) *http.Request {
+	out := req.WithContext(context.Background())
+	out.URL = utils.CopyURL(req.URL)
+	// the forwarder sends the path of the client request along the server URL
+	if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		out.URL.Path, out.URL.RawPath, out.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	}
+	out.RequestURI = ""
+	out.Header = make(http.Header, len(req.Header))
+	utils.CopyHeaders(out.Header, req.Header)
+	out.Body = http.NoBody
+	if req.GetBody != nil {
+		out.Body, _ = req.GetBody()
+	} else if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package roundrobin
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// GraduallyDrainServer ramps the traffic of the server down to zero over the given duration, then
+// removes it from the pool. Its effective weight decreases linearly, so the remaining servers pick
+// up the traffic progressively instead of all at once. The server is removed on the first selection
+// after the drain completes. The responses of the server ask the keep-alive clients to close their
+// connection meanwhile.
+func (r *RoundRobin) GraduallyDrainServer(u *url.URL, over time.Duration) error {
+	if over <= 0 {
+		return fmt.Errorf("drain duration should be > 0, got %v", over)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, _ := r.findServerByURL(u)
+	if s == nil {
+		return fmt.Errorf("server not found")
+	}
+	s.drainStart = r.clock.UtcNow()
+	s.drainOver = over
+	r.resetState()
+	return nil
+}
+
+// isDraining tells whether the server is being drained
+func (r *RoundRobin) isDraining(u *url.URL) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.draining == 0 {
+		return false
+	}
+	s, _ := r.findServerByURL(u)
+	return s != nil && s.drainOver > 0
+}
+
+// drainRatio returns the share of its traffic the draining server still gets
+func (r *RoundRobin) drainRatio(s *server, now time.Time) float64 {
+	elapsed := now.Sub(s.drainStart)
+	if elapsed >= s.drainOver {
+		return 0
+	}
+	return float64(s.drainOver-elapsed) / float64(s.drainOver)
+}
+
+// removeDrained removes the servers done draining
+func (r *RoundRobin) removeDrained() {
+	if r.draining == 0 {
+		return
+	}
+	now := r.clock.UtcNow()
+	servers := r.servers[:0]
+	for _, s := range r.servers {
+		if s.drainOver > 0 && r.drainRatio(s, now) == 0 {
+			r.log.Infof("%v is drained, removing it", s.url)
+			s.cancelWarmup()
+			continue
+		}
+		servers = append(servers, s)
+	}
+	if len(servers) != len(r.servers) {
+		r.servers = servers
+		r.resetState()
+	}
+}
+
+// closingWriter asks the keep-alive clients to close their connection with the responses of the draining
+// servers, so they reconnect and get routed away from them, e.g. by the load balancers in front of the proxy.
+// The header is set as the response is written, the forwarder drops the hop-by-hop headers before.
+type closingWriter struct {
+	http.ResponseWriter
+}
+
+func (w *closingWriter) WriteHeader(code int) {
+	w.ResponseWriter.Header().Set("Connection", "close")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *closingWriter) Write(p []byte) (int, error) {
+	// sets the header as WriteHeader would, it is ignored if the header is already written
+	w.ResponseWriter.Header().Set("Connection", "close")
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *closingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *closingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the ResponseWriter doesn't support the Hijacker interface")
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,159 @@
+package roundrobin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type DrainSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&DrainSuite{})
+
+func (s *DrainSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *DrainSuite) TestGraduallyDrainServer(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RoundRobinClock(s.clock))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	c.Assert(lb.GraduallyDrainServer(testutils.ParseURI(a.URL), 10*time.Second), IsNil)
+
+	counts := func(n int) map[string]int {
+		out := map[string]int{}
+		for _, body := range seq(c, proxy.URL, n) {
+			out[body]++
+		}
+		return out
+	}
+
+	// a still gets all its traffic at the start of the drain
+	c.Assert(counts(200), DeepEquals, map[string]int{"a": 100, "b": 100})
+
+	// then less and less
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(5 * time.Second)
+	c.Assert(counts(150), DeepEquals, map[string]int{"a": 50, "b": 100})
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(4 * time.Second)
+	c.Assert(counts(110), DeepEquals, map[string]int{"a": 10, "b": 100})
+
+	// and none once drained, when it is removed from the pool
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(time.Second)
+	c.Assert(counts(10), DeepEquals, map[string]int{"b": 10})
+	c.Assert(lb.Servers(), HasLen, 1)
+
+	c.Assert(lb.GraduallyDrainServer(testutils.ParseURI(a.URL), time.Second), NotNil)
+	c.Assert(lb.GraduallyDrainServer(testutils.ParseURI(b.URL), 0), NotNil)
+}
+
+// tickingClock moves forward on every reading, as a real clock does between the readings of a selection
+type tickingClock struct {
+	timetools.FreezedTime
+	tick time.Duration
+}
+
+func (t *tickingClock) UtcNow() time.Time {
+	t.CurrentTime = t.CurrentTime.Add(t.tick)
+	return t.CurrentTime
+}
+
+func (s *DrainSuite) TestDrainAllServersWhileClockAdvances(c *C) {
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	clock := &tickingClock{FreezedTime: *s.clock, tick: time.Millisecond}
+	lb, err := New(fwd, RoundRobinClock(clock))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	lb.UpsertServer(a)
+	lb.UpsertServer(b)
+	c.Assert(lb.GraduallyDrainServer(a, 300*time.Millisecond), IsNil)
+	c.Assert(lb.GraduallyDrainServer(b, 300*time.Millisecond), IsNil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			lb.NextServer()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("selecting the draining servers did not complete")
+	}
+	c.Assert(lb.Servers(), HasLen, 0)
+}
+
+func (s *DrainSuite) TestDrainClosesClientConnections(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RoundRobinClock(s.clock))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	get := func() (*http.Response, string) {
+		re, err := client.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		defer re.Body.Close()
+		body, err := ioutil.ReadAll(re.Body)
+		c.Assert(err, IsNil)
+		return re, string(body)
+	}
+
+	// the connections are kept alive before the drain
+	for i := 0; i < 2; i++ {
+		re, _ := get()
+		c.Assert(re.Close, Equals, false)
+	}
+
+	c.Assert(lb.GraduallyDrainServer(testutils.ParseURI(a.URL), 10*time.Second), IsNil)
+
+	closed := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		re, body := get()
+		closed[body] = re.Close
+	}
+	c.Assert(closed, DeepEquals, map[string]bool{"a": true, "b": false})
+}
@@ -0,0 +1,64 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// WeightFromHeader lets the servers report their weight in the response header, e.g. derived from
+// their load, so the overloaded servers shed traffic proactively. mapFn converts the header value into
+// a weight, the negative values are ignored. The reported weight replaces the configured one until the
+// next report, except for the servers configured with 0 weight which stay disabled. The reported weights
+// are at least 1, so a server reporting 0 keeps receiving the requests its recovery is reported with.
+func WeightFromHeader(name string, mapFn func(string) int) LBOption {
+	return func(s *RoundRobin) error {
+		if name == "" {
+			return fmt.Errorf("weight header name can't be empty")
+		}
+		if mapFn == nil {
+			return fmt.Errorf("weight header mapping function can't be nil")
+		}
+		s.feedback = &weightFeedback{header: http.CanonicalHeaderKey(name), mapFn: mapFn}
+		return nil
+	}
+}
+
+type weightFeedback struct {
+	header string
+	mapFn  func(string) int
+}
+
+// baseWeight returns the weight reported by the server or its configured weight
+func (s *server) baseWeight() int {
+	if s.reported && s.weight != 0 {
+		return s.reportedWeight
+	}
+	return s.weight
+}
+
+// observeFeedback records the weight reported in the response of the server
+func (r *RoundRobin) observeFeedback(u *url.URL, header http.Header) {
+	value := header.Get(r.feedback.header)
+	if value == "" {
+		return
+	}
+	weight := r.feedback.mapFn(value)
+	if weight < 0 {
+		return
+	}
+	if weight == 0 {
+		weight = 1
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, _ := r.findServerByURL(u)
+	if s == nil || (s.reported && s.reportedWeight == weight) {
+		return
+	}
+	r.log.Infof("%v reported weight %v", u, weight)
+	s.reported = true
+	s.reportedWeight = weight
+	r.resetIterator()
+}
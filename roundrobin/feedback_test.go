@@ -0,0 +1,92 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type FeedbackSuite struct{}
+
+var _ = Suite(&FeedbackSuite{})
+
+func (s *FeedbackSuite) TestWeightFromHeader(c *C) {
+	var load atomic.Value
+	load.Store("0.25")
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Backend-Load", load.Load().(string))
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	// the weight is the idle share of the server, in quarters
+	weight := func(value string) int {
+		load, err := strconv.ParseFloat(value, 64)
+		if err != nil || load < 0 || load > 1 {
+			return -1
+		}
+		return int((1 - load) * 4)
+	}
+	lb, err := New(fwd, WeightFromHeader("x-backend-load", weight), DefaultWeight(2))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	counts := func(n int) map[string]int {
+		out := map[string]int{}
+		for _, body := range seq(c, proxy.URL, n) {
+			out[body]++
+		}
+		return out
+	}
+
+	// a reports a weight of 3 with its first response
+	c.Assert(seq(c, proxy.URL, 1), DeepEquals, []string{"a"})
+	c.Assert(lb.ServerInfos()[0].EffectiveWeight, Equals, 3)
+	c.Assert(counts(50), DeepEquals, map[string]int{"a": 30, "b": 20})
+
+	// then sheds traffic once loaded
+	load.Store("0.75")
+	c.Assert(seq(c, proxy.URL, 1), DeepEquals, []string{"a"})
+	c.Assert(lb.ServerInfos()[0].EffectiveWeight, Equals, 1)
+	c.Assert(counts(30), DeepEquals, map[string]int{"a": 10, "b": 20})
+
+	// the invalid values are ignored
+	load.Store("high")
+	c.Assert(counts(3), DeepEquals, map[string]int{"a": 1, "b": 2})
+	c.Assert(lb.ServerInfos()[0].EffectiveWeight, Equals, 1)
+
+	// a server reporting 0 keeps a share of the traffic, so it recovers with its next report
+	load.Store("1")
+	c.Assert(counts(3), DeepEquals, map[string]int{"a": 1, "b": 2})
+	c.Assert(lb.ServerInfos()[0].EffectiveWeight, Equals, 1)
+	load.Store("0.5")
+	counts(3)
+	c.Assert(lb.ServerInfos()[0].EffectiveWeight, Equals, 2)
+	c.Assert(counts(40), DeepEquals, map[string]int{"a": 20, "b": 20})
+
+	// and the servers with 0 weight stay disabled
+	lb.UpsertServer(testutils.ParseURI(a.URL), Weight(0))
+	c.Assert(lb.ServerInfos()[0].EffectiveWeight, Equals, 0)
+
+	_, err = New(fwd, WeightFromHeader("", weight))
+	c.Assert(err, NotNil)
+	_, err = New(fwd, WeightFromHeader("X-Backend-Load", nil))
+	c.Assert(err, NotNil)
+}
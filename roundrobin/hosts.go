@@ -0,0 +1,119 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Balancer is a pool of servers balancing the requests between them, with its own strategy.
+// RoundRobin and Rebalancer implement it.
+type Balancer interface {
+	http.Handler
+	Servers() []*url.URL
+	UpsertServer(u *url.URL, options ...ServerOption) error
+	RemoveServer(u *url.URL) error
+}
+
+// HostRouter routes the requests to the pools of their virtual hosts,
+// the requests for unknown hosts are handled by the default host handler.
+type HostRouter struct {
+	mutex          *sync.RWMutex
+	hosts          map[string]http.Handler
+	defaultHandler http.Handler
+}
+
+type HostRouterOption func(*HostRouter) error
+
+// DefaultHostHandler sets the handler of the requests whose Host matches no virtual host,
+// by default they are rejected with 404 Not Found
+func DefaultHostHandler(h http.Handler) HostRouterOption {
+	return func(r *HostRouter) error {
+		if h == nil {
+			return fmt.Errorf("default host handler can't be nil")
+		}
+		r.defaultHandler = h
+		return nil
+	}
+}
+
+func NewHostRouter(opts ...HostRouterOption) (*HostRouter, error) {
+	r := &HostRouter{
+		mutex: &sync.RWMutex{},
+		hosts: make(map[string]http.Handler),
+	}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.defaultHandler == nil {
+		r.defaultHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		})
+	}
+	return r, nil
+}
+
+// UpsertHost routes the requests for the host, e.g. a RoundRobin pool
+func (r *HostRouter) UpsertHost(host string, h http.Handler) error {
+	if h == nil {
+		return fmt.Errorf("handler of host %v can't be nil", host)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hosts[normalizeHost(host)] = h
+	return nil
+}
+
+// UpsertBalancer routes the requests for the host to the balancer, so every host can have
+// its own pool and strategy, e.g. sticky sessions for one and plain round robin for another
+func (r *HostRouter) UpsertBalancer(host string, b Balancer) error {
+	if b == nil {
+		return fmt.Errorf("balancer of host %v can't be nil", host)
+	}
+	return r.UpsertHost(host, b)
+}
+
+// Balancer returns the balancer of the host, to manage its servers
+func (r *HostRouter) Balancer(host string) (Balancer, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	b, ok := r.hosts[normalizeHost(host)].(Balancer)
+	return b, ok
+}
+
+func (r *HostRouter) RemoveHost(host string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	host = normalizeHost(host)
+	if _, ok := r.hosts[host]; !ok {
+		return fmt.Errorf("host %v not found", host)
+	}
+	delete(r.hosts, host)
+	return nil
+}
+
+func (r *HostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.RLock()
+	h, ok := r.hosts[normalizeHost(req.Host)]
+	r.mutex.RUnlock()
+
+	if !ok {
+		h = r.defaultHandler
+	}
+	h.ServeHTTP(w, req)
+}
+
+// normalizeHost strips the port and lower cases the host
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
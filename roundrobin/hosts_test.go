@@ -0,0 +1,125 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type HostRouterSuite struct{}
+
+var _ = Suite(&HostRouterSuite{})
+
+func (s *HostRouterSuite) TestRouting(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	router, err := NewHostRouter()
+	c.Assert(err, IsNil)
+	c.Assert(router.UpsertHost("Example.com", lb), IsNil)
+
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Host("example.com:8080"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "a")
+
+	re, _, err = testutils.Get(proxy.URL, testutils.Host("unknown.com"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+
+	c.Assert(router.RemoveHost("example.com"), IsNil)
+	c.Assert(router.RemoveHost("example.com"), NotNil)
+
+	re, _, err = testutils.Get(proxy.URL, testutils.Host("example.com"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *HostRouterSuite) TestDefaultHostHandler(c *C) {
+	router, err := NewHostRouter(DefaultHostHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no such site: " + req.Host))
+	})))
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Host("unknown.com"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(string(body), Equals, "no such site: unknown.com")
+
+	_, err = NewHostRouter(DefaultHostHandler(nil))
+	c.Assert(err, NotNil)
+}
+
+func (s *HostRouterSuite) TestBalancerPerHost(c *C) {
+	a1 := testutils.NewResponder("a1")
+	defer a1.Close()
+	a2 := testutils.NewResponder("a2")
+	defer a2.Close()
+	b1 := testutils.NewResponder("b1")
+	defer b1.Close()
+	b2 := testutils.NewResponder("b2")
+	defer b2.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	// a.com is plain round robin, b.com uses sticky sessions
+	lbA, err := New(fwd)
+	c.Assert(err, IsNil)
+	lbB, err := New(fwd, EnableStickySession(NewStickySession("b")))
+	c.Assert(err, IsNil)
+
+	router, err := NewHostRouter()
+	c.Assert(err, IsNil)
+	c.Assert(router.UpsertBalancer("a.com", lbA), IsNil)
+	c.Assert(router.UpsertBalancer("b.com", lbB), IsNil)
+	c.Assert(router.UpsertBalancer("c.com", nil), NotNil)
+
+	for host, servers := range map[string][]string{"a.com": {a1.URL, a2.URL}, "b.com": {b1.URL, b2.URL}} {
+		b, ok := router.Balancer(host)
+		c.Assert(ok, Equals, true)
+		for _, u := range servers {
+			c.Assert(b.UpsertServer(testutils.ParseURI(u)), IsNil)
+		}
+	}
+	_, ok := router.Balancer("unknown.com")
+	c.Assert(ok, Equals, false)
+
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	var out []string
+	for i := 0; i < 4; i++ {
+		_, body, err := testutils.Get(proxy.URL, testutils.Host("a.com"))
+		c.Assert(err, IsNil)
+		out = append(out, string(body))
+	}
+	c.Assert(out, DeepEquals, []string{"a1", "a2", "a1", "a2"})
+
+	re, body, err := testutils.Get(proxy.URL, testutils.Host("b.com"))
+	c.Assert(err, IsNil)
+	cookie := re.Cookies()[0]
+	for i := 0; i < 4; i++ {
+		_, next, err := testutils.Get(proxy.URL, testutils.Host("b.com"), testutils.Header("Cookie", cookie.String()))
+		c.Assert(err, IsNil)
+		c.Assert(string(next), Equals, string(body))
+	}
+}
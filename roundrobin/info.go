@@ -0,0 +1,92 @@
+package roundrobin
+
+import (
+	"net/url"
+)
+
+// ServerInfo is a snapshot of the state of a server in the pool
+type ServerInfo struct {
+	URL *url.URL
+	// Weight is the configured weight, EffectiveWeight the one scaled by the adaptive strategy
+	Weight          int
+	EffectiveWeight int
+	// Throttled is the number of times the server was skipped because of its rate limit
+	Throttled int64
+	// Streams is the number of requests in flight, MaxStreams their limit or 0
+	Streams    int64
+	MaxStreams int64
+
+	KeepAliveDisabled bool
+	// Breaker is the state of the circuit breaker, closed when there is none
+	Breaker BreakerState
+	// Tier is the priority tier of the server
+	Tier int
+}
+
+// ServerInfos returns the state of the servers in the pool
+func (rr *RoundRobin) ServerInfos() []ServerInfo {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	out := make([]ServerInfo, len(rr.servers))
+	for i, s := range rr.servers {
+		out[i] = rr.serverInfo(s)
+	}
+	return out
+}
+
+// RangeServers calls fn with the state of each server in the pool until it returns false. Unlike
+// ServerInfos it doesn't allocate, but the pool is locked meanwhile: fn should be quick and
+// must not call the balancer.
+func (rr *RoundRobin) RangeServers(fn func(ServerInfo) bool) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	for _, s := range rr.servers {
+		if !fn(rr.serverInfo(s)) {
+			return
+		}
+	}
+}
+
+func (rr *RoundRobin) serverInfo(s *server) ServerInfo {
+	info := ServerInfo{
+		URL:               s.url,
+		Weight:            s.weight,
+		EffectiveWeight:   rr.effectiveWeight(s),
+		Throttled:         s.throttled,
+		Streams:           s.streams,
+		MaxStreams:        s.maxStreams,
+		KeepAliveDisabled: s.disableKeepAlive,
+		Tier:              s.tier,
+	}
+	if s.breaker != nil {
+		info.Breaker = s.breaker.current(rr.clock.UtcNow())
+	}
+	return info
+}
+
+// IteratorState is a snapshot of the position of the weighted round robin, for diagnostics
+type IteratorState struct {
+	// Index is the index of the last selected server, -1 before the first selection
+	Index int
+	// CurrentWeight is the minimal effective weight a server needs to be selected in the current pass
+	CurrentWeight int
+	// Gcd and MaxWeight are computed over the effective weights, -1 when the pool is empty
+	Gcd       int
+	MaxWeight int
+}
+
+// IteratorState returns the current position of the weighted round robin. It doesn't change it.
+func (rr *RoundRobin) IteratorState() IteratorState {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	weights := rr.selectionWeights(rr.clock.UtcNow())
+	return IteratorState{
+		Index:         rr.index,
+		CurrentWeight: rr.currentWeight,
+		Gcd:           weightGcd(weights),
+		MaxWeight:     maxWeight(weights),
+	}
+}
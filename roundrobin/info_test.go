@@ -0,0 +1,114 @@
+package roundrobin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type InfoSuite struct{}
+
+var _ = Suite(&InfoSuite{})
+
+func (s *InfoSuite) TestServerInfos(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI("http://a"), Weight(3))
+	lb.UpsertServer(testutils.ParseURI("http://b"), MaxConcurrentStreams(10), DisableKeepAlive(true))
+
+	infos := lb.ServerInfos()
+	c.Assert(len(infos), Equals, 2)
+	c.Assert(infos[0].URL.String(), Equals, "http://a")
+	c.Assert(infos[0].Weight, Equals, 3)
+	c.Assert(infos[0].EffectiveWeight, Equals, 3)
+	c.Assert(infos[1].URL.String(), Equals, "http://b")
+	c.Assert(infos[1].Weight, Equals, 1)
+	c.Assert(infos[1].MaxStreams, Equals, int64(10))
+	c.Assert(infos[1].KeepAliveDisabled, Equals, true)
+}
+
+func (s *InfoSuite) TestRangeServers(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI("http://a"))
+	lb.UpsertServer(testutils.ParseURI("http://b"))
+	lb.UpsertServer(testutils.ParseURI("http://c"))
+
+	var visited []string
+	lb.RangeServers(func(info ServerInfo) bool {
+		visited = append(visited, info.URL.String())
+		return true
+	})
+	c.Assert(visited, DeepEquals, []string{"http://a", "http://b", "http://c"})
+
+	// stops when the callback returns false
+	visited = nil
+	lb.RangeServers(func(info ServerInfo) bool {
+		visited = append(visited, info.URL.String())
+		return info.URL.Host != "b"
+	})
+	c.Assert(visited, DeepEquals, []string{"http://a", "http://b"})
+}
+
+func (s *InfoSuite) TestIteratorState(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.IteratorState(), DeepEquals, IteratorState{Index: -1, CurrentWeight: 0, Gcd: -1, MaxWeight: -1})
+
+	lb.UpsertServer(testutils.ParseURI("http://a"), Weight(4))
+	lb.UpsertServer(testutils.ParseURI("http://b"), Weight(2))
+	c.Assert(lb.IteratorState(), DeepEquals, IteratorState{Index: -1, CurrentWeight: 0, Gcd: 2, MaxWeight: 4})
+
+	_, err = lb.NextServer()
+	c.Assert(err, IsNil)
+	c.Assert(lb.IteratorState(), DeepEquals, IteratorState{Index: 0, CurrentWeight: 4, Gcd: 2, MaxWeight: 4})
+
+	// reading the state doesn't move the iterator
+	c.Assert(lb.IteratorState(), DeepEquals, IteratorState{Index: 0, CurrentWeight: 4, Gcd: 2, MaxWeight: 4})
+
+	u, err := lb.NextServer()
+	c.Assert(err, IsNil)
+	c.Assert(u.String(), Equals, "http://a")
+	c.Assert(lb.IteratorState(), DeepEquals, IteratorState{Index: 0, CurrentWeight: 2, Gcd: 2, MaxWeight: 4})
+}
+
+func newBenchmarkPool(b *testing.B) *RoundRobin {
+	lb, err := New(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		lb.UpsertServer(testutils.ParseURI(fmt.Sprintf("http://server-%d", i)))
+	}
+	return lb
+}
+
+func BenchmarkServerInfos(b *testing.B) {
+	lb := newBenchmarkPool(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		weight := 0
+		for _, info := range lb.ServerInfos() {
+			weight += info.Weight
+		}
+	}
+}
+
+func BenchmarkRangeServers(b *testing.B) {
+	lb := newBenchmarkPool(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		weight := 0
+		lb.RangeServers(func(info ServerInfo) bool {
+			weight += info.Weight
+			return true
+		})
+	}
+}
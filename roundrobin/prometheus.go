@@ -0,0 +1,87 @@
+package roundrobin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// PrometheusCollector reports the state of every server of the pool as gauges labeled by the server URL,
+// in the Prometheus text exposition format:
+//
+//	oxy_backend_healthy   1 when the server gets new traffic, 0 otherwise
+//	oxy_backend_weight    the configured weight of the server
+//	oxy_backend_inflight  the requests in flight to the server
+//
+// It serves the gauges as a scrape target, or writes them along other metrics with WriteTo.
+type PrometheusCollector struct {
+	rr *RoundRobin
+}
+
+// NewPrometheusCollector returns the collector of the state of the pool
+func NewPrometheusCollector(rr *RoundRobin) *PrometheusCollector {
+	return &PrometheusCollector{rr: rr}
+}
+
+// prometheusContentType is the content type of the text exposition format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func (p *PrometheusCollector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	p.WriteTo(w)
+}
+
+// WriteTo writes the gauges of all the servers, the samples of each gauge are grouped as the format requires
+func (p *PrometheusCollector) WriteTo(w io.Writer) (int64, error) {
+	infos := p.rr.ServerInfos()
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	gauges := []struct {
+		name, help string
+		value      func(ServerInfo) int64
+	}{
+		{"oxy_backend_healthy", "Whether the backend gets new traffic.", func(i ServerInfo) int64 {
+			if i.EffectiveWeight > 0 {
+				return 1
+			}
+			return 0
+		}},
+		{"oxy_backend_weight", "Configured weight of the backend.", func(i ServerInfo) int64 {
+			return int64(i.Weight)
+		}},
+		{"oxy_backend_inflight", "Requests in flight to the backend.", func(i ServerInfo) int64 {
+			return i.Streams
+		}},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, info := range infos {
+			fmt.Fprintf(cw, "%s{upstream=\"%s\"} %d\n", g.name, labelEscaper.Replace(info.URL.String()), g.value(info))
+		}
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// countingWriter counts the bytes written and keeps the first error
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,44 @@
+package roundrobin
+
+import (
+	"net/http/httptest"
+
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type PrometheusSuite struct{}
+
+var _ = Suite(&PrometheusSuite{})
+
+func (s *PrometheusSuite) TestPrometheusCollector(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI("http://a"), Weight(3))
+	lb.UpsertServer(testutils.ParseURI("http://b"))
+	// new servers get the default weight instead of 0
+	lb.UpsertServer(testutils.ParseURI("http://b"), Weight(0))
+	lb.updateStreams(testutils.ParseURI("http://a"), 2)
+
+	proxy := httptest.NewServer(NewPrometheusCollector(lb))
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.Header.Get("Content-Type"), Equals, "text/plain; version=0.0.4; charset=utf-8")
+	c.Assert(string(body), Equals, `# HELP oxy_backend_healthy Whether the backend gets new traffic.
+# TYPE oxy_backend_healthy gauge
+oxy_backend_healthy{upstream="http://a"} 1
+oxy_backend_healthy{upstream="http://b"} 0
+# HELP oxy_backend_weight Configured weight of the backend.
+# TYPE oxy_backend_weight gauge
+oxy_backend_weight{upstream="http://a"} 3
+oxy_backend_weight{upstream="http://b"} 0
+# HELP oxy_backend_inflight Requests in flight to the backend.
+# TYPE oxy_backend_inflight gauge
+oxy_backend_inflight{upstream="http://a"} 2
+oxy_backend_inflight{upstream="http://b"} 0
+`)
+}
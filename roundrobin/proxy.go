@@ -0,0 +1,40 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/vulcand/oxy/forward"
+)
+
+// Proxy is a load balancing reverse proxy, the Balancer picks the server
+// and the Forwarder sends the request to it. Both can be tuned further.
+type Proxy struct {
+	Balancer  *RoundRobin
+	Forwarder *forward.Forwarder
+}
+
+// BuildProxy wires a RoundRobin balancing between the servers in front of the forwarder.
+// A forwarder with the default settings is created when fwd is nil.
+func BuildProxy(servers []*url.URL, fwd *forward.Forwarder, opts ...LBOption) (*Proxy, error) {
+	if fwd == nil {
+		var err error
+		if fwd, err = forward.New(); err != nil {
+			return nil, err
+		}
+	}
+	lb, err := New(fwd, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range servers {
+		if err := lb.UpsertServer(u); err != nil {
+			return nil, err
+		}
+	}
+	return &Proxy{Balancer: lb, Forwarder: fwd}, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.Balancer.ServeHTTP(w, req)
+}
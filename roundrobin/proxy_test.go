@@ -0,0 +1,60 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProxySuite struct{}
+
+var _ = Suite(&ProxySuite{})
+
+func (s *ProxySuite) TestBuildProxy(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	p, err := BuildProxy([]*url.URL{testutils.ParseURI(a.URL), testutils.ParseURI(b.URL)}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(p.Forwarder, NotNil)
+
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"a", "b", "a"})
+
+	// the balancer can be tuned further
+	c.Assert(p.Balancer.RemoveServer(testutils.ParseURI(a.URL)), IsNil)
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"b", "b"})
+}
+
+func (s *ProxySuite) TestBuildProxyOptions(c *C) {
+	fwd, err := forward.New(forward.ServerTiming(true))
+	c.Assert(err, IsNil)
+
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	p, err := BuildProxy([]*url.URL{testutils.ParseURI(a.URL)}, fwd, ErrorHandler(defaultErrHandler))
+	c.Assert(err, IsNil)
+	c.Assert(p.Forwarder, Equals, fwd)
+
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.Header.Get(forward.ServerTimingHeader), Not(Equals), "")
+
+	_, err = BuildProxy([]*url.URL{nil}, fwd)
+	c.Assert(err, NotNil)
+}
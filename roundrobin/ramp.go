@@ -0,0 +1,47 @@
+package roundrobin
+
+import (
+	"fmt"
+	"time"
+)
+
+// WeightRamp spreads the weight changes of the servers over the given duration: when a server
+// is upserted with a new weight, its effective weight moves linearly from the old weight to the
+// new one, so the traffic shifts smoothly instead of all at once. A change made during a ramp
+// starts a new ramp from the weight reached so far.
+func WeightRamp(over time.Duration) LBOption {
+	return func(s *RoundRobin) error {
+		if over <= 0 {
+			return fmt.Errorf("weight ramp duration should be > 0, got %v", over)
+		}
+		s.ramp = over
+		return nil
+	}
+}
+
+// rampedWeight returns the weight of the server interpolated along its ramp
+func (r *RoundRobin) rampedWeight(s *server) float64 {
+	return r.rampedWeightAt(s, r.clock.UtcNow())
+}
+
+// rampedWeightAt returns the weight of the server at now, see rampedWeight
+func (r *RoundRobin) rampedWeightAt(s *server, now time.Time) float64 {
+	if s.rampStart.IsZero() {
+		return float64(s.baseWeight())
+	}
+	elapsed := now.Sub(s.rampStart)
+	if elapsed >= r.ramp {
+		return float64(s.baseWeight())
+	}
+	ratio := float64(elapsed) / float64(r.ramp)
+	return s.rampFrom + (float64(s.baseWeight())-s.rampFrom)*ratio
+}
+
+// startRamp ramps the weight of the server from the weight it had before the update
+func (r *RoundRobin) startRamp(s *server, before float64) {
+	if r.ramp == 0 || before == float64(s.baseWeight()) {
+		return
+	}
+	s.rampFrom = before
+	s.rampStart = r.clock.UtcNow()
+}
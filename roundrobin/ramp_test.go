@@ -0,0 +1,119 @@
+package roundrobin
+
+import (
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type RampSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&RampSuite{})
+
+func (s *RampSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *RampSuite) TestWeightRamp(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RoundRobinClock(s.clock), WeightRamp(10*time.Second))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL), Weight(1))
+	lb.UpsertServer(testutils.ParseURI(b.URL), Weight(1))
+
+	weight := func() int {
+		for _, info := range lb.ServerInfos() {
+			if info.URL.Host == testutils.ParseURI(a.URL).Host {
+				return info.EffectiveWeight
+			}
+		}
+		return -1
+	}
+	c.Assert(weight(), Equals, 100)
+
+	// the increase is ramped
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL), Weight(3)), IsNil)
+	c.Assert(weight(), Equals, 100)
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(5 * time.Second)
+	c.Assert(weight(), Equals, 200)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	counts := map[string]int{}
+	for _, body := range seq(c, proxy.URL, 300) {
+		counts[body]++
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"a": 200, "b": 100})
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(5 * time.Second)
+	c.Assert(weight(), Equals, 300)
+
+	// and so is the decrease
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL), Weight(0)), IsNil)
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(7500 * time.Millisecond)
+	c.Assert(weight(), Equals, 75)
+
+	// a change during a ramp starts from the weight reached so far
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL), Weight(2)), IsNil)
+	c.Assert(weight(), Equals, 75)
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(5 * time.Second)
+	c.Assert(weight(), Equals, 137)
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(5 * time.Second)
+	c.Assert(weight(), Equals, 200)
+
+	_, err = New(fwd, WeightRamp(0))
+	c.Assert(err, NotNil)
+}
+
+func (s *RampSuite) TestWeightRampDownAllServers(c *C) {
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	clock := &tickingClock{FreezedTime: *s.clock, tick: time.Millisecond}
+	lb, err := New(fwd, RoundRobinClock(clock), WeightRamp(300*time.Millisecond))
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://localhost:5000"), testutils.ParseURI("http://localhost:5001")
+	lb.UpsertServer(a, Weight(3))
+	lb.UpsertServer(b, Weight(3))
+	c.Assert(lb.UpsertServer(a, Weight(1)), IsNil)
+	c.Assert(lb.UpsertServer(b, Weight(1)), IsNil)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 500; i++ {
+			if _, err := lb.NextServer(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("selecting the servers ramping down did not complete")
+	}
+}
@@ -0,0 +1,108 @@
+package roundrobin
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// RateLimit is an optional functional argument that limits the rate of requests sent to the server.
+// Once the server has used up its burst, the balancer picks another server, and if all servers are over
+// their limits, the request is rejected with RateLimitedError.
+func RateLimit(rps float64, burst int) ServerOption {
+	return func(s *server) error {
+		if rps <= 0 {
+			return fmt.Errorf("rps should be > 0, got %v", rps)
+		}
+		if burst <= 0 {
+			return fmt.Errorf("burst should be > 0, got %v", burst)
+		}
+		s.limiter = newRateLimiter(rps, burst)
+		return nil
+	}
+}
+
+// RateLimitedError is returned when all servers in the pool are over their rate limits
+type RateLimitedError struct {
+	// RetryAfter is the time until the first server can accept requests again
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("all servers are rate limited, retry after %v", e.RetryAfter)
+}
+
+// StatusCode returns the status code to reply with
+func (e *RateLimitedError) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// ThrottledCount returns the number of times the server was skipped because it was over its rate limit
+func (rr *RoundRobin) ThrottledCount(u *url.URL) (int64, bool) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if s, _ := rr.findServerByURL(u); s != nil {
+		return s.throttled, true
+	}
+	return -1, false
+}
+
+// rateLimiter is a token bucket that allows fractional rates
+type rateLimiter struct {
+	rps        float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rps:    rps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// take consumes a token if one is available, otherwise it returns the time
+// to wait until the next token becomes available
+func (l *rateLimiter) take(now time.Time) (time.Duration, bool) {
+	if l.lastRefill.IsZero() {
+		l.lastRefill = now
+	}
+	if passed := now.Sub(l.lastRefill); passed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+passed.Seconds()*l.rps)
+		l.lastRefill = now
+	}
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - l.tokens) / l.rps * float64(time.Second)), false
+}
+
+// RRErrHandler is the default error handler of the load balancer, it replies
+// with 429 and Retry-After to rate limited requests
+type RRErrHandler struct {
+}
+
+func (e *RRErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if rerr, ok := err.(*RateLimitedError); ok {
+		seconds := int(math.Ceil(rerr.RetryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+}
+
+var defaultErrHandler = &RRErrHandler{}
@@ -0,0 +1,140 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct{}
+
+var _ = Suite(&RateLimitSuite{})
+
+func (s *RateLimitSuite) TestSkipsLimitedServer(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL), RateLimit(0.001, 1)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	c.Assert(seq(c, proxy.URL, 4), DeepEquals, []string{"a", "b", "b", "b"})
+
+	// a was skipped by the third and the fourth request
+
+	throttled, ok := lb.ThrottledCount(testutils.ParseURI(a.URL))
+	c.Assert(ok, Equals, true)
+	c.Assert(throttled, Equals, int64(2))
+
+	throttled, ok = lb.ThrottledCount(testutils.ParseURI(b.URL))
+	c.Assert(ok, Equals, true)
+	c.Assert(throttled, Equals, int64(0))
+}
+
+func (s *RateLimitSuite) TestAllServersLimited(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL), RateLimit(0.5, 1)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL), RateLimit(0.5, 1), Weight(2)), IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"b", "a"})
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusTooManyRequests)
+	c.Assert(re.Header.Get("Retry-After"), Equals, "2")
+
+	_, err = lb.NextServer()
+	rerr, ok := err.(*RateLimitedError)
+	c.Assert(ok, Equals, true)
+	c.Assert(rerr.RetryAfter > time.Second && rerr.RetryAfter <= 2*time.Second, Equals, true)
+}
+
+func (s *RateLimitSuite) TestRefillWithClock(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	lb, err := New(fwd, RoundRobinClock(clock))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL), RateLimit(1, 1)), IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL)), IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"a", "b", "b"})
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"a", "b", "b"})
+}
+
+func (s *RateLimitSuite) TestRefill(c *C) {
+	start := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	l := newRateLimiter(10, 2)
+
+	_, ok := l.take(start)
+	c.Assert(ok, Equals, true)
+	_, ok = l.take(start)
+	c.Assert(ok, Equals, true)
+	wait, ok := l.take(start)
+	c.Assert(ok, Equals, false)
+	c.Assert(wait, Equals, 100*time.Millisecond)
+
+	_, ok = l.take(start.Add(100 * time.Millisecond))
+	c.Assert(ok, Equals, true)
+
+	// tokens never exceed the burst
+	now := start.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		_, ok = l.take(now)
+		c.Assert(ok, Equals, true)
+	}
+	_, ok = l.take(now)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RateLimitSuite) TestBadOptions(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), RateLimit(0, 1)), NotNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://localhost:5000"), RateLimit(1, 0)), NotNil)
+}
@@ -0,0 +1,45 @@
+package roundrobin
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// IteratorResetPolicy sets where the round robin resumes after the pool is reconfigured
+type IteratorResetPolicy int
+
+const (
+	// ResetToFirst restarts from the first server, the default. Frequent reconfigurations
+	// then favor the first server.
+	ResetToFirst IteratorResetPolicy = iota
+	// ResetCarryOver resumes after the last selected server
+	ResetCarryOver
+	// ResetRandom resumes from a random server
+	ResetRandom
+)
+
+// IteratorReset sets where the round robin resumes after the pool is reconfigured, e.g. when the
+// servers are upserted or their weights change. The pass over the weights restarts in any case.
+func IteratorReset(policy IteratorResetPolicy) LBOption {
+	return func(s *RoundRobin) error {
+		switch policy {
+		case ResetToFirst, ResetCarryOver, ResetRandom:
+			s.iteratorReset = policy
+			return nil
+		}
+		return fmt.Errorf("unsupported iterator reset policy %v", policy)
+	}
+}
+
+func (r *RoundRobin) resetIterator() {
+	r.currentWeight = 0
+	switch {
+	case len(r.servers) == 0 || r.iteratorReset == ResetToFirst:
+		r.index = -1
+	case r.iteratorReset == ResetRandom:
+		r.index = rand.Intn(len(r.servers)) - 1
+	case r.index >= len(r.servers):
+		// the pool shrunk
+		r.index %= len(r.servers)
+	}
+}
@@ -0,0 +1,212 @@
+package roundrobin
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+)
+
+// RetrySameServer replays idempotent requests that failed with a network error against the originally
+// selected server, waiting for backoff between the attempts. It is meant for transient backend hiccups,
+// attempts is the total number of attempts including the first one. The network errors are the ones the
+// forward.Forwarder replies with when the upstream can't be reached, not the 502 or 504 of the upstream.
+func RetrySameServer(attempts int, backoff time.Duration) LBOption {
+	return func(s *RoundRobin) error {
+		if attempts < 1 {
+			return fmt.Errorf("attempts should be >= 1, got %v", attempts)
+		}
+		b, err := utils.NewBackoff(backoff, backoff, 0)
+		if err != nil {
+			return err
+		}
+		s.retry = &retryPolicy{attempts: attempts, backoff: b}
+		return nil
+	}
+}
+
+// RetryOnStatuses extends the retry policy to the idempotent requests the upstream answered with
+// any of the status codes, e.g. 503 while the backends are rolling. Unlike the network errors, these
+// are replayed against the next server picked by the balancer. It requires RetrySameServer.
+func RetryOnStatuses(codes ...int) LBOption {
+	return func(s *RoundRobin) error {
+		if len(codes) == 0 {
+			return fmt.Errorf("at least one status code is required")
+		}
+		s.retryStatuses = make(map[int]bool, len(codes))
+		for _, code := range codes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid status code %v", code)
+			}
+			s.retryStatuses[code] = true
+		}
+		return nil
+	}
+}
+
+// Backoff sets exponential backoff with jitter between the retry attempts, overriding
+// the fixed backoff of the retry policy
+func Backoff(base, max time.Duration, jitter float64) LBOption {
+	return func(s *RoundRobin) error {
+		b, err := utils.NewBackoff(base, max, jitter)
+		if err != nil {
+			return err
+		}
+		s.backoff = b
+		return nil
+	}
+}
+
+type retryPolicy struct {
+	attempts int
+	backoff  *utils.Backoff
+	// Status codes replayed against the next server
+	statuses map[int]bool
+}
+
+// canRetry tells whether the request can be safely replayed
+func (p *retryPolicy) canRetry(req *http.Request) bool {
+	if p == nil || p.attempts < 2 {
+		return false
+	}
+	if req.Header.Get("Upgrade") != "" || req.ContentLength != 0 {
+		return false
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// serveWithRetries sends the request to the next handler until it succeeds or the attempts are exhausted
+func (r *RoundRobin) serveWithRetries(w http.ResponseWriter, req *http.Request) {
+	for attempt := 1; ; attempt++ {
+		attemptReq := forward.WithUpstreamError(req)
+		rw := &retryWriter{w: w, req: attemptReq, header: make(http.Header), canRetry: attempt < r.retry.attempts, statuses: r.retry.statuses}
+		r.serveNext(rw, attemptReq)
+		if !rw.failed {
+			rw.writeTrailers()
+			// the last attempt is relayed as is
+			if isNetworkError(attemptReq) || r.retry.statuses[rw.code] {
+				r.deadLetter(req)
+			}
+			return
+		}
+		if r.retry.statuses[rw.code] {
+			srv, err := r.nextServer()
+			if err != nil {
+				r.errHandler.ServeHTTP(w, req, err)
+				r.deadLetter(req)
+				return
+			}
+			r.withServer(req, utils.CopyURL(srv.url))
+			if r.observer != nil {
+				r.observer(req.URL, SelectionRetry)
+			}
+		}
+		// the client went away or the budget ran out while waiting
+		if !r.retry.backoff.Wait(req.Context(), attempt) {
+			if r.budgetExhausted(req) {
+				r.errHandler.ServeHTTP(w, req, &BudgetExhaustedError{Budget: r.budget})
+				r.deadLetter(req)
+			}
+			return
+		}
+	}
+}
+
+// retryWriter discards the response of a failed attempt, so the request can be replayed
+type retryWriter struct {
+	w           http.ResponseWriter
+	req         *http.Request
+	header      http.Header
+	canRetry    bool
+	statuses    map[int]bool
+	failed      bool
+	code        int
+	wroteHeader bool
+}
+
+func (rw *retryWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *retryWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.code = code
+	// the body of the failed attempt is discarded by Write,
+	// so the upstream connection is drained and can be reused
+	if rw.canRetry && (isNetworkError(rw.req) || rw.statuses[code]) {
+		rw.failed = true
+		return
+	}
+	dst := rw.w.Header()
+	for k, vv := range rw.header {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+	rw.w.WriteHeader(code)
+}
+
+// writeTrailers copies the trailers set once the header is written, e.g. grpc-status
+func (rw *retryWriter) writeTrailers() {
+	if !rw.wroteHeader {
+		return
+	}
+	dst := rw.w.Header()
+	for k, vv := range rw.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			dst[k] = vv
+		}
+	}
+	for _, declared := range rw.header["Trailer"] {
+		for _, k := range strings.Split(declared, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if vv, ok := rw.header[k]; ok {
+				dst[k] = vv
+			}
+		}
+	}
+}
+
+func (rw *retryWriter) Write(buf []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.failed {
+		return len(buf), nil
+	}
+	return rw.w.Write(buf)
+}
+
+func (rw *retryWriter) Flush() {
+	if rw.failed {
+		return
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *retryWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the ResponseWriter doesn't support the Hijacker interface")
+	}
+	return hijacker.Hijack()
+}
+
+// isNetworkError tells whether the forwarder replied with an error because the upstream could not be reached
+func isNetworkError(req *http.Request) bool {
+	return forward.UpstreamError(req) != nil
+}
@@ -0,0 +1,409 @@
+package roundrobin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+// newFlaky returns a backend that drops the connection for the first failures requests
+func newFlaky(failures int32, body string) (*httptest.Server, *int32) {
+	var hits int32
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= failures {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(body))
+	})
+	return srv, &hits
+}
+
+func (s *RetrySuite) TestRetrySameServer(c *C) {
+	a, hits := newFlaky(1, "a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RetrySameServer(2, 10*time.Millisecond))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "a")
+	c.Assert(atomic.LoadInt32(hits), Equals, int32(2))
+}
+
+func (s *RetrySuite) TestRetrySameServerExhausted(c *C) {
+	a, hits := newFlaky(5, "a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RetrySameServer(3, 0))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(atomic.LoadInt32(hits), Equals, int32(3))
+}
+
+func (s *RetrySuite) TestRetrySameServerUpstreamError(c *C) {
+	var hits int32
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("upstream"))
+	})
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RetrySameServer(3, 0))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// the 502 of the upstream is not a network error, it is relayed as is
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(string(body), Equals, "upstream")
+	c.Assert(atomic.LoadInt32(&hits), Equals, int32(1))
+}
+
+func (s *RetrySuite) TestRetrySameServerTrailers(c *C) {
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("a"))
+		w.Header().Set("X-Checksum", "42")
+	})
+	defer a.Close()
+
+	// streamed, so the response is chunked and can carry trailers
+	fwd, err := forward.New(forward.StreamResponse(true))
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RetrySameServer(2, 0))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "a")
+	c.Assert(re.Trailer.Get("X-Checksum"), Equals, "42")
+}
+
+func (s *RetrySuite) TestNoRetryWithBody(c *C) {
+	a, hits := newFlaky(1, "a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RetrySameServer(2, 0))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, _, err := testutils.MakeRequest(proxy.URL, testutils.Method("POST"), testutils.Body("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(atomic.LoadInt32(hits), Equals, int32(1))
+}
+
+func (s *RetrySuite) TestRetryBackoff(c *C) {
+	a, hits := newFlaky(2, "a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, Backoff(20*time.Millisecond, time.Second, 0), RetrySameServer(3, 0))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	start := time.Now()
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "a")
+	c.Assert(atomic.LoadInt32(hits), Equals, int32(3))
+	// waited 20ms before the second attempt and 40ms before the third one
+	c.Assert(time.Since(start) >= 60*time.Millisecond, Equals, true)
+}
+
+func (s *RetrySuite) TestRetryOnStatuses(c *C) {
+	var hits int32
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("rolling"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RetrySameServer(2, 0), RetryOnStatuses(http.StatusServiceUnavailable))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// the first request hits a and is replayed against b
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "b")
+	c.Assert(atomic.LoadInt32(&hits), Equals, int32(1))
+
+	// non idempotent requests are not replayed
+	re, body, err = testutils.MakeRequest(proxy.URL, testutils.Method("POST"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(string(body), Equals, "rolling")
+}
+
+func (s *RetrySuite) TestRetryOnStatusesExhausted(c *C) {
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("rolling"))
+	})
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RetrySameServer(3, 0), RetryOnStatuses(http.StatusServiceUnavailable))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(string(body), Equals, "rolling")
+}
+
+func (s *RetrySuite) TestRetryOnStatusesBadOptions(c *C) {
+	_, err := New(nil, RetryOnStatuses(http.StatusServiceUnavailable))
+	c.Assert(err, NotNil)
+
+	_, err = New(nil, RetrySameServer(2, 0), RetryOnStatuses(42))
+	c.Assert(err, NotNil)
+
+	_, err = New(nil, RetrySameServer(2, 0), RetryOnStatuses())
+	c.Assert(err, NotNil)
+}
+
+func (s *RetrySuite) TestRequestBudget(c *C) {
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, RequestBudget(50*time.Millisecond))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	start := time.Now()
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(time.Since(start) < 200*time.Millisecond, Equals, true)
+
+	_, err = New(fwd, RequestBudget(0))
+	c.Assert(err, NotNil)
+}
+
+func (s *RetrySuite) TestRequestBudgetBackoff(c *C) {
+	a, hits := newFlaky(5, "a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	// the budget runs out while waiting for the second attempt
+	lb, err := New(fwd, RetrySameServer(3, 200*time.Millisecond), RequestBudget(50*time.Millisecond))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	start := time.Now()
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(atomic.LoadInt32(hits), Equals, int32(1))
+	c.Assert(time.Since(start) < 200*time.Millisecond, Equals, true)
+}
+
+func (s *RetrySuite) TestDeadLetter(c *C) {
+	a, hits := newFlaky(5, "a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	letters := make(chan *http.Request, 1)
+	lb, err := New(fwd, RetrySameServer(3, 0), DeadLetter(func(req *http.Request) {
+		letters <- req
+	}, 1))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL+"/orders?id=1", testutils.Header("X-Order", "1"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(atomic.LoadInt32(hits), Equals, int32(3))
+
+	select {
+	case req := <-letters:
+		c.Assert(req.Method, Equals, "GET")
+		c.Assert(req.URL.Path, Equals, "/orders")
+		c.Assert(req.URL.RawQuery, Equals, "id=1")
+		c.Assert(req.Header.Get("X-Order"), Equals, "1")
+		c.Assert(req.Context().Err(), IsNil)
+		body, err := ioutil.ReadAll(req.Body)
+		c.Assert(err, IsNil)
+		c.Assert(len(body), Equals, 0)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("the request was not dead lettered")
+	}
+
+	// the successful requests are not dead lettered
+	b := testutils.NewResponder("b")
+	defer b.Close()
+	lb.RemoveServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	re, _, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	select {
+	case <-letters:
+		c.Fatalf("unexpected dead letter")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *RetrySuite) TestDeadLetterBody(c *C) {
+	a, hits := newFlaky(1, "a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	letters := make(chan *http.Request, 1)
+	lb, err := New(fwd, DeadLetter(func(req *http.Request) {
+		letters <- req
+	}, 1))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// the requests with a body are not retried, but still dead lettered with their body
+	re, _, err := testutils.MakeRequest(proxy.URL+"/orders", testutils.Method("POST"), testutils.Body("id=1"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(atomic.LoadInt32(hits), Equals, int32(1))
+
+	select {
+	case req := <-letters:
+		c.Assert(req.Method, Equals, "POST")
+		c.Assert(req.URL.Path, Equals, "/orders")
+		body, err := ioutil.ReadAll(req.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, "id=1")
+
+		// and can be replayed
+		req.Body, err = req.GetBody()
+		c.Assert(err, IsNil)
+		re, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		c.Assert(re.StatusCode, Equals, http.StatusOK)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("the request was not dead lettered")
+	}
+}
+
+func (s *RetrySuite) TestDeadLetterOptions(c *C) {
+	_, err := New(nil, DeadLetter(nil, 1))
+	c.Assert(err, NotNil)
+
+	_, err = New(nil, DeadLetter(func(*http.Request) {}, 0))
+	c.Assert(err, NotNil)
+}
@@ -2,11 +2,16 @@
 package roundrobin
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/oxy/utils"
 )
 
@@ -21,6 +26,48 @@ func Weight(w int) ServerOption {
 	}
 }
 
+// DisableKeepAlive closes the connection to the server after every request,
+// a workaround for the backends mishandling keep-alive
+func DisableKeepAlive(b bool) ServerOption {
+	return func(s *server) error {
+		s.disableKeepAlive = b
+		return nil
+	}
+}
+
+// AddHeaders sets the headers on the requests forwarded to the server, e.g. a routing token
+// specific to the server. They replace the client headers of the same name.
+func AddHeaders(headers map[string]string) ServerOption {
+	return func(s *server) error {
+		// the requests in flight may still read the previous headers
+		h := make(http.Header, len(s.headers)+len(headers))
+		for k, vv := range s.headers {
+			h[k] = vv
+		}
+		for k, v := range headers {
+			if k == "" {
+				return fmt.Errorf("header name can't be empty")
+			}
+			h.Set(k, v)
+		}
+		s.headers = h
+		return nil
+	}
+}
+
+// ServerRoundTripper sends the requests forwarded to the server with rt instead of the round tripper
+// of the forwarder, e.g. for a backend reached over mutual TLS or through a proxy. It requires a
+// forward.Forwarder as the next handler.
+func ServerRoundTripper(rt http.RoundTripper) ServerOption {
+	return func(s *server) error {
+		if rt == nil {
+			return fmt.Errorf("round tripper can't be nil")
+		}
+		s.roundTripper = rt
+		return nil
+	}
+}
+
 // ErrorHandler is a functional argument that sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) LBOption {
 	return func(s *RoundRobin) error {
@@ -29,6 +76,65 @@ func ErrorHandler(h utils.ErrorHandler) LBOption {
 	}
 }
 
+// DefaultWeight is a functional argument that sets the weight of the servers added without an explicit weight
+func DefaultWeight(w int) LBOption {
+	return func(s *RoundRobin) error {
+		if w <= 0 {
+			return fmt.Errorf("Default weight should be > 0")
+		}
+		s.defaultWeight = w
+		return nil
+	}
+}
+
+// ProblemJSONErrors replies to errors with application/problem+json documents (RFC 7807)
+// using problem types relative to baseType
+func ProblemJSONErrors(baseType string) LBOption {
+	return func(s *RoundRobin) error {
+		s.errHandler = &utils.ProblemHandler{BaseType: baseType}
+		return nil
+	}
+}
+
+// RoundRobinClock sets the time provider used by the load balancer, so tests can control time
+func RoundRobinClock(clock timetools.TimeProvider) LBOption {
+	return func(s *RoundRobin) error {
+		s.clock = clock
+		return nil
+	}
+}
+
+// RoundRobinLogger sets the logger used by the load balancer
+func RoundRobinLogger(log utils.Logger) LBOption {
+	return func(s *RoundRobin) error {
+		s.log = log
+		return nil
+	}
+}
+
+// Reasons passed to the selection observer
+const (
+	// SelectionSticky means the server was picked from the sticky session cookie
+	SelectionSticky = "sticky"
+	// SelectionRoundRobin means the server was picked by the weighted round robin
+	SelectionRoundRobin = "round-robin"
+	// SelectionIPHash means the server was picked by hashing the client IP, see StickyIPFallback
+	SelectionIPHash = "ip-hash"
+	// SelectionHash means the server was picked by the consistent hash of the request, see StickyHashFallback
+	SelectionHash = "hash"
+	// SelectionRetry means the server was picked to retry a request, see RetryOnStatuses
+	SelectionRetry = "retry"
+)
+
+// SelectionObserver sets a hook called with the server chosen for every request
+// and the reason it was chosen, useful to debug the distribution of the traffic
+func SelectionObserver(observer func(chosen *url.URL, reason string)) LBOption {
+	return func(s *RoundRobin) error {
+		s.observer = observer
+		return nil
+	}
+}
+
 func EnableStickySession(ss *StickySession) LBOption {
 	return func(s *RoundRobin) error {
 		s.ss = ss
@@ -36,15 +142,85 @@ func EnableStickySession(ss *StickySession) LBOption {
 	}
 }
 
+// StickyIPFallback gives best-effort affinity to the clients not storing the sticky cookie.
+// Requests without the cookie are sent to the server picked by hashing the client IP,
+// and the cookie is set, so the clients accepting it switch to the cookie based affinity.
+func StickyIPFallback(b bool) LBOption {
+	return func(s *RoundRobin) error {
+		s.stickyIPFallback = b
+		return nil
+	}
+}
+
+// StickyRespectDrain controls whether sticky sessions keep hitting the servers with 0 weight.
+// It is true by default, so the sessions are drained gracefully. When false, the sessions
+// pinned to a server with 0 weight are immediately re-pinned to an active server.
+func StickyRespectDrain(b bool) LBOption {
+	return func(s *RoundRobin) error {
+		s.stickyIgnoreDrain = !b
+		return nil
+	}
+}
+
 type RoundRobin struct {
 	mutex      *sync.Mutex
 	next       http.Handler
 	errHandler utils.ErrorHandler
+	// Allows swapping the error handler at runtime
+	errHandlers *utils.SwappableErrorHandler
 	// Current index (starts from -1)
 	index         int
 	servers       []*server
 	currentWeight int
 	ss            *StickySession
+	// Re-pin the sticky sessions of the servers with 0 weight
+	stickyIgnoreDrain bool
+	// Hash the client IP when there is no sticky cookie
+	stickyIPFallback bool
+	// Optional key of the consistent hash picking the server when there is no sticky cookie
+	stickyHashKey func(*http.Request) string
+	// Weight assigned to the servers upserted without weight
+	defaultWeight int
+	// Optional policy replaying failed requests against the same server
+	retry *retryPolicy
+	// Optional backoff between the retries
+	backoff *utils.Backoff
+	// Optional status codes replayed against the next server
+	retryStatuses map[int]bool
+	// Optional callback of the requests failing all the retries
+	deadLetters *deadLetters
+	// Optional deadline of the whole request, retries included
+	budget time.Duration
+	// Optional warmup of the new servers
+	warmup *warmup
+	clock  timetools.TimeProvider
+	// Optional strategy scaling the weights by the success rates
+	adaptive *adaptiveStrategy
+	// Optional scaling of the weights of the servers asking for less traffic
+	backpressure *backpressure
+	// Optional cap of the time the servers answering 503 with Retry-After are skipped
+	retryAfterMax time.Duration
+	// Optional metrics split by the version of the servers
+	versions *versionMetrics
+	// Number of servers gradually drained
+	draining int
+	// Optional duration of the weight changes
+	ramp time.Duration
+	// Optional circuit breakers of the servers
+	breaker *breakerSettings
+	// Optional weights reported by the servers
+	feedback *weightFeedback
+	// Where the iterator resumes after a reset
+	iteratorReset IteratorResetPolicy
+	// Sorted priority tiers of the servers, nil when they are all in tier 0,
+	// and the tier of the last selection
+	tiers []int
+	tier  int
+	// Weight shared by all the servers when it can't change between the resets, 0 otherwise
+	equalWeight int
+	log         utils.Logger
+	// Optional hook observing the selected servers
+	observer func(chosen *url.URL, reason string)
 }
 
 func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
@@ -61,7 +237,44 @@ func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 		}
 	}
 	if rr.errHandler == nil {
-		rr.errHandler = utils.DefaultHandler
+		rr.errHandler = defaultErrHandler
+	}
+	rr.errHandlers = utils.NewSwappableErrorHandler(rr.errHandler)
+	rr.errHandler = rr.errHandlers
+	if rr.clock == nil {
+		rr.clock = &timetools.RealTime{}
+	}
+	if rr.stickyIPFallback && rr.ss == nil {
+		return nil, fmt.Errorf("StickyIPFallback requires EnableStickySession")
+	}
+	if rr.stickyHashKey != nil && rr.ss == nil {
+		return nil, fmt.Errorf("StickyHashFallback requires EnableStickySession")
+	}
+	if rr.stickyHashKey != nil && rr.stickyIPFallback {
+		return nil, fmt.Errorf("StickyHashFallback and StickyIPFallback are mutually exclusive")
+	}
+	if rr.retryStatuses != nil {
+		if rr.retry == nil {
+			return nil, fmt.Errorf("RetryOnStatuses requires RetrySameServer")
+		}
+		rr.retry.statuses = rr.retryStatuses
+	}
+	if rr.retry != nil {
+		if rr.backoff != nil {
+			rr.retry.backoff = rr.backoff
+		}
+		rr.retry.backoff.Clock = rr.clock
+	}
+	if rr.versions != nil {
+		if err := rr.versions.init(rr); err != nil {
+			return nil, err
+		}
+	}
+	if rr.defaultWeight == 0 {
+		rr.defaultWeight = defaultWeight
+	}
+	if rr.log == nil {
+		rr.log = utils.NullLogger
 	}
 	return rr, nil
 }
@@ -70,12 +283,19 @@ func (r *RoundRobin) Next() http.Handler {
 	return r.next
 }
 
+// SetErrorHandler swaps the error handler, the requests in flight may still use the previous one
+func (r *RoundRobin) SetErrorHandler(h utils.ErrorHandler) {
+	r.errHandlers.Set(h)
+}
+
 func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req, cancel := r.withBudget(req)
+	defer cancel()
 	// make shallow copy of request before chaning anything to avoid side effects
 	newReq := *req
 	stuck := false
 	if r.ss != nil {
-		cookie_url, present, err := r.ss.GetBackend(&newReq, r.Servers())
+		cookie_url, present, err := r.ss.GetBackend(&newReq, r.stickyServers())
 
 		if err != nil {
 			r.errHandler.ServeHTTP(w, req, err)
@@ -83,8 +303,29 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 
 		if present {
-			newReq.URL = cookie_url
+			r.withServer(&newReq, cookie_url)
 			stuck = true
+			if r.observer != nil {
+				r.observer(cookie_url, SelectionSticky)
+			}
+		} else if key := r.stickyKey(&newReq); key != "" {
+			if hash_url, ok := r.serverByHash(key); ok {
+				r.ss.StickBackend(hash_url, &w)
+				r.withServer(&newReq, hash_url)
+				stuck = true
+				if r.observer != nil {
+					r.observer(hash_url, SelectionHash)
+				}
+			}
+		} else if r.stickyIPFallback {
+			if ip_url, ok := r.ss.GetBackendByIP(&newReq, r.activeServers()); ok {
+				r.ss.StickBackend(ip_url, &w)
+				r.withServer(&newReq, ip_url)
+				stuck = true
+				if r.observer != nil {
+					r.observer(ip_url, SelectionIPHash)
+				}
+			}
 		}
 	}
 
@@ -98,9 +339,54 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		if r.ss != nil {
 			r.ss.StickBackend(url, &w)
 		}
-		newReq.URL = url
+		r.withServer(&newReq, url)
+		if r.observer != nil {
+			r.observer(url, SelectionRoundRobin)
+		}
+	}
+	if r.isDraining(newReq.URL) {
+		w = &closingWriter{ResponseWriter: w}
+	}
+	if r.adaptive != nil || r.backpressure != nil || r.versions != nil || r.breaker != nil || r.feedback != nil || r.retryAfterMax != 0 {
+		start := r.clock.UtcNow()
+		pw := &utils.ProxyWriter{W: w}
+		defer func() {
+			// the busy servers are not failing
+			busy := r.retryAfterMax != 0 && r.observeRetryAfter(newReq.URL, pw.StatusCode(), pw.Header())
+			if !busy {
+				r.observe(newReq.URL, pw.StatusCode())
+			}
+			if r.backpressure != nil {
+				r.observePressure(newReq.URL, pw.StatusCode(), pw.Header())
+			}
+			if r.versions != nil {
+				r.versions.record(r.serverVersion(newReq.URL), pw.StatusCode(), r.clock.UtcNow().Sub(start))
+			}
+			if r.breaker != nil && !busy {
+				r.observeBreaker(newReq.URL, pw.StatusCode())
+			}
+			if r.feedback != nil {
+				r.observeFeedback(newReq.URL, pw.Header())
+			}
+		}()
+		w = pw
+	}
+	if r.deadLetters != nil {
+		bufferBody(&newReq)
+	}
+	if r.retry.canRetry(&newReq) {
+		r.serveWithRetries(w, &newReq)
+		return
+	}
+	if r.deadLetters != nil {
+		attemptReq := forward.WithUpstreamError(&newReq)
+		r.serveNext(w, attemptReq)
+		if isNetworkError(attemptReq) {
+			r.deadLetter(&newReq)
+		}
+		return
 	}
-	r.next.ServeHTTP(w, &newReq)
+	r.serveNext(w, &newReq)
 }
 
 func (r *RoundRobin) NextServer() (*url.URL, error) {
@@ -115,37 +401,112 @@ func (r *RoundRobin) nextServer() (*server, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	r.removeDrained()
 	if len(r.servers) == 0 {
-		return nil, fmt.Errorf("no servers in the pool")
+		return nil, &NoServersError{Reason: "no servers in the pool"}
 	}
+	if r.tiers != nil {
+		return r.selectTier()
+	}
+	return r.selectServer()
+}
 
+// selectServer runs the weighted round robin over the servers of the current tier
+func (r *RoundRobin) selectServer() (*server, error) {
 	// The algo below may look messy, but is actually very simple
 	// it calculates the GCD  and subtracts it on every iteration, what interleaves servers
 	// and allows us not to build an iterator every time we readjust weights
 
-	// GCD across all enabled servers
-	gcd := r.weightGcd()
-	// Maximum weight across all enabled servers
-	max := r.maxWeight()
+	// with equal weights the GCD and the maximum are that weight, and the algo is a plain rotation
+	// the weights change while the servers drain or ramp, they are taken once for the whole selection
+	now := r.clock.UtcNow()
+	gcd, max, enabled := r.equalWeight, r.equalWeight, len(r.servers)
+	var weights []int
+	if r.equalWeight == 0 {
+		weights = r.selectionWeights(now)
+		// GCD across all enabled servers
+		gcd = weightGcd(weights)
+		// Maximum weight across all enabled servers
+		max = maxWeight(weights)
+		enabled = enabledServers(weights)
+	}
+	weight := func(i int) int {
+		if weights == nil {
+			return r.equalWeight
+		}
+		return weights[i]
+	}
+	// a full cycle of the weights visits every server max/gcd times, past it no server can be selected
+	cycle := len(r.servers) * 2
+	if gcd > 0 {
+		cycle = len(r.servers) * (max/gcd + 1)
+	}
+	// the weights may have dropped since the last selection
+	if r.currentWeight > max {
+		r.currentWeight = max
+	}
 
+	// servers skipped because of their rate or stream limits, allocated lazily
+	var limited []bool
+	skipped, throttled, below := 0, 0, 0
+	var retryAfter time.Duration
 	for {
 		r.index = (r.index + 1) % len(r.servers)
 		if r.index == 0 {
 			r.currentWeight = r.currentWeight - gcd
-			if r.currentWeight <= 0 {
-				r.currentWeight = max
-				if r.currentWeight == 0 {
-					return nil, fmt.Errorf("all servers have 0 weight")
-				}
+		}
+		// the pass restarts after a reset, which may resume from any server
+		if r.currentWeight <= 0 {
+			r.currentWeight = max
+			if r.currentWeight == 0 {
+				return nil, &NoServersError{Reason: "all servers have 0 weight"}
 			}
 		}
 		srv := r.servers[r.index]
-		if srv.weight >= r.currentWeight {
-			return srv, nil
+		if weight(r.index) < r.currentWeight {
+			if below++; below > cycle {
+				return nil, &NoServersError{Reason: "no server reaches the current weight"}
+			}
+			continue
+		}
+		var wait time.Duration
+		saturated := srv.saturated() || !srv.breaker.ready(now)
+		if !saturated {
+			if srv.limiter == nil {
+				srv.breaker.take()
+				return srv, nil
+			}
+			var ok bool
+			if wait, ok = srv.limiter.take(now); ok {
+				srv.breaker.take()
+				return srv, nil
+			}
+		}
+		if limited == nil {
+			limited = make([]bool, len(r.servers))
+		}
+		if !limited[r.index] {
+			limited[r.index] = true
+			skipped++
+			if !saturated {
+				srv.throttled++
+				throttled++
+				if retryAfter == 0 || wait < retryAfter {
+					retryAfter = wait
+				}
+			}
+		}
+		// We did full circle and found no available servers
+		if skipped == enabled {
+			if throttled == 0 && r.breaker != nil {
+				return nil, &NoServersError{Reason: "all servers are at their stream limit or probed by their circuit breaker"}
+			}
+			if throttled == 0 {
+				return nil, &NoServersError{Reason: "all servers are at their stream limit"}
+			}
+			return nil, &RateLimitedError{RetryAfter: retryAfter}
 		}
 	}
-	// We did full circle and found no available servers
-	return nil, fmt.Errorf("no available servers")
 }
 
 func (r *RoundRobin) RemoveServer(u *url.URL) error {
@@ -157,6 +518,7 @@ func (r *RoundRobin) RemoveServer(u *url.URL) error {
 		return fmt.Errorf("server not found")
 	}
 	r.servers = append(r.servers[:index], r.servers[index+1:]...)
+	e.cancelWarmup()
 	r.resetState()
 	return nil
 }
@@ -172,6 +534,64 @@ func (rr *RoundRobin) Servers() []*url.URL {
 	return out
 }
 
+func (rr *RoundRobin) keepAliveDisabled(u *url.URL) bool {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	s, _ := rr.findServerByURL(u)
+	return s != nil && s.disableKeepAlive
+}
+
+func (rr *RoundRobin) serverHeaders(u *url.URL) http.Header {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if s, _ := rr.findServerByURL(u); s != nil {
+		return s.headers
+	}
+	return nil
+}
+
+func (rr *RoundRobin) serverRoundTripper(u *url.URL) http.RoundTripper {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if s, _ := rr.findServerByURL(u); s != nil {
+		return s.roundTripper
+	}
+	return nil
+}
+
+// activeServers returns the servers receiving new traffic
+func (rr *RoundRobin) activeServers() []*url.URL {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	out := []*url.URL{}
+	for _, srv := range rr.servers {
+		if rr.effectiveWeight(srv) > 0 && !rr.tripped(srv) {
+			out = append(out, srv.url)
+		}
+	}
+	return out
+}
+
+// stickyServers returns the servers the sticky sessions stay on, the draining ones included
+// unless StickyIgnoreDrain is set, except the servers with an open circuit breaker
+func (rr *RoundRobin) stickyServers() []*url.URL {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	out := []*url.URL{}
+	for _, srv := range rr.servers {
+		if rr.tripped(srv) || (rr.stickyIgnoreDrain && rr.effectiveWeight(srv) <= 0) {
+			continue
+		}
+		out = append(out, srv.url)
+	}
+	return out
+}
+
 func (rr *RoundRobin) ServerWeight(u *url.URL) (int, bool) {
 	rr.mutex.Lock()
 	defer rr.mutex.Unlock()
@@ -192,38 +612,80 @@ func (rr *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 	}
 
 	if s, _ := rr.findServerByURL(u); s != nil {
+		before := rr.rampedWeight(s)
 		for _, o := range options {
 			if err := o(s); err != nil {
 				return err
 			}
 		}
+		rr.startRamp(s, before)
 		rr.resetState()
 		return nil
 	}
 
+	srv, err := rr.newServer(u, options)
+	if err != nil {
+		return err
+	}
+
+	rr.servers = append(rr.servers, srv)
+	rr.resetState()
+	rr.warm(srv)
+	return nil
+}
+
+func (rr *RoundRobin) newServer(u *url.URL, options []ServerOption) (*server, error) {
 	srv := &server{url: utils.CopyURL(u)}
 	for _, o := range options {
 		if err := o(srv); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	if srv.weight == 0 {
-		srv.weight = defaultWeight
+		srv.weight = rr.defaultWeight
 	}
 
-	rr.servers = append(rr.servers, srv)
-	rr.resetState()
-	return nil
-}
-
-func (r *RoundRobin) resetIterator() {
-	r.index = -1
-	r.currentWeight = 0
+	if rr.adaptive != nil {
+		meter, err := rr.adaptive.newMeter(rr.clock)
+		if err != nil {
+			return nil, err
+		}
+		srv.failures = meter
+	}
+	if rr.breaker != nil {
+		srv.breaker = &breaker{settings: rr.breaker}
+	}
+	return srv, nil
 }
 
 func (r *RoundRobin) resetState() {
 	r.resetIterator()
+	r.draining = 0
+	for _, s := range r.servers {
+		if s.drainOver > 0 {
+			r.draining++
+		}
+	}
+	r.resetTiers()
+	r.equalWeight = r.staticEqualWeight()
+}
+
+// staticEqualWeight returns the weight of the servers when they all have the same one and nothing
+// changes their effective weights between the resets, 0 otherwise
+func (r *RoundRobin) staticEqualWeight() int {
+	dynamic := r.adaptive != nil || r.backpressure != nil || r.breaker != nil || r.feedback != nil ||
+		r.retryAfterMax != 0 || r.ramp != 0 || r.draining != 0 || r.tiers != nil
+	if dynamic || len(r.servers) == 0 {
+		return 0
+	}
+	weight := r.servers[0].weight
+	for _, s := range r.servers[1:] {
+		if s.weight != weight {
+			return 0
+		}
+	}
+	return weight
 }
 
 func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
@@ -238,23 +700,33 @@ func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
 	return nil, -1
 }
 
-func (rr *RoundRobin) maxWeight() int {
+func enabledServers(weights []int) int {
+	count := 0
+	for _, w := range weights {
+		if w > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func maxWeight(weights []int) int {
 	max := -1
-	for _, s := range rr.servers {
-		if s.weight > max {
-			max = s.weight
+	for _, w := range weights {
+		if w > max {
+			max = w
 		}
 	}
 	return max
 }
 
-func (rr *RoundRobin) weightGcd() int {
+func weightGcd(weights []int) int {
 	divisor := -1
-	for _, s := range rr.servers {
+	for _, w := range weights {
 		if divisor == -1 {
-			divisor = s.weight
+			divisor = w
 		} else {
-			divisor = gcd(divisor, s.weight)
+			divisor = gcd(divisor, w)
 		}
 	}
 	return divisor
@@ -278,10 +750,60 @@ type server struct {
 	url *url.URL
 	// Relative weight for the enpoint to other enpoints in the load balancer
 	weight int
+	// Optional limit of the request rate sent to the server
+	limiter *rateLimiter
+	// Number of times the server was skipped because of the rate limit
+	throttled int64
+	// Failed and successful responses, only tracked by the adaptive strategy
+	failures *memmetrics.RatioCounter
+	// Close the connection after every request
+	disableKeepAlive bool
+	// Optional headers set on the forwarded requests
+	headers http.Header
+	// Optional round tripper of the forwarded requests
+	roundTripper http.RoundTripper
+	// Requests in flight and their optional limit
+	streams    int64
+	maxStreams int64
+	// The server asked for less traffic until then, see Backpressure
+	pressuredUntil time.Time
+	// The server answered 503 with Retry-After, it is skipped until then, see SkipOnRetryAfter
+	unavailableUntil time.Time
+	// Optional version of the application run by the server
+	version string
+	// Start and duration of the gradual drain
+	drainStart time.Time
+	drainOver  time.Duration
+	// Start and initial weight of the last weight ramp, see WeightRamp
+	rampStart time.Time
+	rampFrom  float64
+	// Optional circuit breaker, see CircuitBreaker
+	breaker *breaker
+	// Last weight reported by the server, see WeightFromHeader
+	reported       bool
+	reportedWeight int
+	// Priority tier, see Tier
+	tier int
+	// Cancels the warmup requests, see Warmup
+	stopWarmup context.CancelFunc
 }
 
 const defaultWeight = 1
 
+// NoServersError is returned when there are no servers to send the request to
+type NoServersError struct {
+	Reason string
+}
+
+func (e *NoServersError) Error() string {
+	return e.Reason
+}
+
+// StatusCode returns the status code to reply with
+func (e *NoServersError) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
 func sameURL(a, b *url.URL) bool {
 	return a.Path == b.Path && a.Host == b.Host && a.Scheme == b.Scheme
 }
@@ -1,9 +1,14 @@
 package roundrobin
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/testutils"
@@ -60,6 +65,23 @@ func (s *RRSuite) TestCustomErrHandler(c *C) {
 	c.Assert(re.StatusCode, Equals, http.StatusTeapot)
 }
 
+func (s *RRSuite) TestProblemJSONErrors(c *C) {
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, ProblemJSONErrors("https://example.com/problems"))
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(re.Header.Get("Content-Type"), Equals, "application/problem+json")
+	c.Assert(string(body), Equals, `{"type":"https://example.com/problems/service-unavailable","title":"Service Unavailable","status":503,"detail":"no servers in the pool"}`+"\n")
+}
+
 func (s *RRSuite) TestOneServer(c *C) {
 	a := testutils.NewResponder("a")
 	defer a.Close()
@@ -205,6 +227,71 @@ func (s *RRSuite) TestWeighted(c *C) {
 	c.Assert(ok, Equals, false)
 }
 
+func (s *RRSuite) TestEqualWeights(c *C) {
+	fast, err := New(nil)
+	c.Assert(err, IsNil)
+	slow, err := New(nil)
+	c.Assert(err, IsNil)
+	for i := 0; i < 5; i++ {
+		u := testutils.ParseURI(fmt.Sprintf("http://server-%d", i))
+		fast.UpsertServer(u, Weight(2))
+		slow.UpsertServer(u, Weight(2))
+	}
+	c.Assert(fast.equalWeight, Equals, 2)
+
+	// the rotation picks the servers in the same order as the weighted round robin
+	slow.equalWeight = 0
+	for i := 0; i < 23; i++ {
+		a, err := fast.NextServer()
+		c.Assert(err, IsNil)
+		b, err := slow.NextServer()
+		c.Assert(err, IsNil)
+		c.Assert(a.String(), Equals, b.String())
+		c.Assert(a.String(), Equals, fmt.Sprintf("http://server-%d", i%5))
+	}
+
+	fast.UpsertServer(testutils.ParseURI("http://server-0"), Weight(3))
+	c.Assert(fast.equalWeight, Equals, 0)
+	fast.UpsertServer(testutils.ParseURI("http://server-0"), Weight(2))
+	c.Assert(fast.equalWeight, Equals, 2)
+
+	// the weights changing between the resets turn the rotation off
+	lb, err := New(nil, CircuitBreaker(3, time.Second, 1))
+	c.Assert(err, IsNil)
+	lb.UpsertServer(testutils.ParseURI("http://server-0"))
+	lb.UpsertServer(testutils.ParseURI("http://server-1"))
+	c.Assert(lb.equalWeight, Equals, 0)
+}
+
+func (s *RRSuite) TestDefaultWeight(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, DefaultWeight(3))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL), Weight(1))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	c.Assert(seq(c, proxy.URL, 4), DeepEquals, []string{"a", "a", "a", "b"})
+
+	w, ok := lb.ServerWeight(testutils.ParseURI(a.URL))
+	c.Assert(w, Equals, 3)
+	c.Assert(ok, Equals, true)
+
+	_, err = New(fwd, DefaultWeight(0))
+	c.Assert(err, NotNil)
+}
+
 func seq(c *C, url string, repeat int) []string {
 	out := []string{}
 	for i := 0; i < repeat; i++ {
@@ -214,3 +301,286 @@ func seq(c *C, url string, repeat int) []string {
 	}
 	return out
 }
+
+func (s *RRSuite) TestSelectionObserver(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	var reasons []string
+	var chosen []string
+	observer := func(u *url.URL, reason string) {
+		chosen = append(chosen, u.String())
+		reasons = append(reasons, reason)
+	}
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")), SelectionObserver(observer))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	_, _, err = testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+
+	_, _, err = testutils.Get(proxy.URL, testutils.Header("Cookie", (&http.Cookie{Name: "test", Value: b.URL}).String()))
+	c.Assert(err, IsNil)
+
+	c.Assert(chosen, DeepEquals, []string{a.URL, b.URL})
+	c.Assert(reasons, DeepEquals, []string{SelectionRoundRobin, SelectionSticky})
+}
+
+func (s *RRSuite) TestServerFromContext(c *C) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	var selected *url.URL
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var ok bool
+		selected, ok = ServerFromContext(req.Context())
+		c.Assert(ok, Equals, true)
+		fwd.ServeHTTP(w, req)
+	})
+
+	lb, err := New(next)
+	c.Assert(err, IsNil)
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	_, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "a")
+	c.Assert(selected.String(), Equals, a.URL)
+
+	_, ok := ServerFromContext(context.Background())
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RRSuite) TestSetErrorHandler(c *C) {
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	maintenance := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	// swap the handler while serving requests
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			re, _, err := testutils.Get(proxy.URL)
+			c.Assert(err, IsNil)
+			c.Assert(re.StatusCode == http.StatusServiceUnavailable || re.StatusCode == http.StatusTeapot, Equals, true)
+		}
+		done <- true
+	}()
+	lb.SetErrorHandler(maintenance)
+	<-done
+
+	re, _, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusTeapot)
+}
+
+func (s *RRSuite) TestDisableKeepAlive(c *C) {
+	closing := func(name string) *httptest.Server {
+		return testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(fmt.Sprintf("%v:%v", name, req.Close)))
+		})
+	}
+	a, b := closing("a"), closing("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL), DisableKeepAlive(true))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	c.Assert(seq(c, proxy.URL, 4), DeepEquals, []string{"a:true", "b:false", "a:true", "b:false"})
+}
+
+func (s *RRSuite) TestAddHeaders(c *C) {
+	echo := func(name string) *httptest.Server {
+		return testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(fmt.Sprintf("%v:%v", name, req.Header.Get("X-Route-Token"))))
+		})
+	}
+	a, b, d := echo("a"), echo("b"), echo("d")
+	defer a.Close()
+	defer b.Close()
+	defer d.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL), AddHeaders(map[string]string{"x-route-token": "token-a"}))
+	lb.UpsertServer(testutils.ParseURI(b.URL), AddHeaders(map[string]string{"X-Route-Token": "token-b"}))
+	lb.UpsertServer(testutils.ParseURI(d.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// the client value is replaced, and passed to the servers without headers
+	get := func() string {
+		_, body, err := testutils.Get(proxy.URL, testutils.Header("X-Route-Token", "client"))
+		c.Assert(err, IsNil)
+		return string(body)
+	}
+	c.Assert([]string{get(), get(), get()}, DeepEquals, []string{"a:token-a", "b:token-b", "d:client"})
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL), AddHeaders(map[string]string{"": "token"})), NotNil)
+}
+
+func (s *RRSuite) TestServerRoundTripper(c *C) {
+	echo := func(name string) *httptest.Server {
+		return testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(fmt.Sprintf("%v:%v", name, req.Header.Get("X-Transport"))))
+		})
+	}
+	a, b := echo("a"), echo("b")
+	defer a.Close()
+	defer b.Close()
+
+	var sent int32
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&sent, 1)
+		req.Header.Set("X-Transport", "custom")
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL), ServerRoundTripper(rt))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// the servers without round tripper use the one of the forwarder
+	c.Assert(seq(c, proxy.URL, 4), DeepEquals, []string{"a:custom", "b:", "a:custom", "b:"})
+	c.Assert(atomic.LoadInt32(&sent), Equals, int32(2))
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(b.URL), ServerRoundTripper(nil)), NotNil)
+}
+
+type rtFunc func(req *http.Request) (*http.Response, error)
+
+func (f rtFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (s *RRSuite) TestIteratorReset(c *C) {
+	selections := func(opts ...LBOption) map[string]int {
+		lb, err := New(nil, opts...)
+		c.Assert(err, IsNil)
+
+		lb.UpsertServer(testutils.ParseURI("http://a"))
+		lb.UpsertServer(testutils.ParseURI("http://b"))
+		lb.UpsertServer(testutils.ParseURI("http://c"))
+
+		// every selection follows a reconfiguration
+		out := map[string]int{}
+		for i := 0; i < 300; i++ {
+			c.Assert(lb.UpsertServer(testutils.ParseURI("http://b"), Weight(1)), IsNil)
+			u, err := lb.NextServer()
+			c.Assert(err, IsNil)
+			out[u.Host]++
+		}
+		return out
+	}
+
+	c.Assert(selections(), DeepEquals, map[string]int{"a": 300})
+	c.Assert(selections(IteratorReset(ResetCarryOver)), DeepEquals, map[string]int{"a": 100, "b": 100, "c": 100})
+
+	random := selections(IteratorReset(ResetRandom))
+	c.Assert(random["a"] < 200, Equals, true)
+	c.Assert(len(random), Equals, 3)
+
+	_, err := New(nil, IteratorReset(IteratorResetPolicy(10)))
+	c.Assert(err, NotNil)
+}
+
+func (s *RRSuite) TestIteratorCarryOverWeights(c *C) {
+	lb, err := New(nil, IteratorReset(ResetCarryOver))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI("http://a"), Weight(2))
+	lb.UpsertServer(testutils.ParseURI("http://b"), Weight(1))
+	lb.UpsertServer(testutils.ParseURI("http://c"), Weight(1))
+
+	next := func() string {
+		u, err := lb.NextServer()
+		c.Assert(err, IsNil)
+		return u.Host
+	}
+	c.Assert([]string{next(), next()}, DeepEquals, []string{"a", "a"})
+
+	// the server disabled meanwhile is skipped after resuming
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://c"), Weight(0)), IsNil)
+	c.Assert([]string{next(), next(), next()}, DeepEquals, []string{"a", "b", "a"})
+}
+
+func newEqualWeightPool(b *testing.B) *RoundRobin {
+	lb, err := New(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		lb.UpsertServer(testutils.ParseURI(fmt.Sprintf("http://server-%d", i)))
+	}
+	return lb
+}
+
+func BenchmarkNextServerEqualWeights(b *testing.B) {
+	lb := newEqualWeightPool(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lb.NextServer()
+	}
+}
+
+func BenchmarkNextServerEqualWeightsGcd(b *testing.B) {
+	lb := newEqualWeightPool(b)
+	// forces the weighted round robin over the same pool
+	lb.equalWeight = 0
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lb.NextServer()
+	}
+}
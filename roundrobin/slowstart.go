@@ -0,0 +1,52 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// SkipOnRetryAfter takes the servers answering 503 Service Unavailable with a Retry-After header out of
+// the rotation until the delay elapses, e.g. while they warm up. The delay is capped to maxDelay, so a
+// misbehaving server can't take itself out for long. These responses mean "busy, come back later"
+// rather than "broken": they are not counted as failures by the adaptive strategy and the breakers.
+func SkipOnRetryAfter(maxDelay time.Duration) LBOption {
+	return func(s *RoundRobin) error {
+		if maxDelay <= 0 {
+			return fmt.Errorf("max Retry-After delay should be > 0, got %v", maxDelay)
+		}
+		s.retryAfterMax = maxDelay
+		return nil
+	}
+}
+
+// observeRetryAfter skips the server answering 503 with Retry-After, it returns true for such responses
+func (r *RoundRobin) observeRetryAfter(u *url.URL, code int, header http.Header) bool {
+	if code != http.StatusServiceUnavailable {
+		return false
+	}
+	now := r.clock.UtcNow()
+	d, ok := parseRetryAfter(header.Get("Retry-After"), now)
+	if !ok {
+		return false
+	}
+	if d > r.retryAfterMax {
+		d = r.retryAfterMax
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, _ := r.findServerByURL(u)
+	if s == nil {
+		return true
+	}
+	// the outcome is not recorded, so the probe is given back
+	s.breaker.release()
+	if until := now.Add(d); until.After(s.unavailableUntil) {
+		s.unavailableUntil = until
+		r.log.Infof("%v is unavailable until %v", u, until)
+		r.resetIterator()
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type SlowStartSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&SlowStartSuite{})
+
+func (s *SlowStartSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+func (s *SlowStartSuite) TestSkipOnRetryAfter(c *C) {
+	var warming int32 = 1
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&warming) == 1 {
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("warming"))
+			return
+		}
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	// a single failure would open the breaker
+	lb, err := New(fwd, SkipOnRetryAfter(time.Minute), CircuitBreaker(1, time.Hour, 1), RoundRobinClock(s.clock))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// a is skipped for 10 seconds after asking to come back later
+	c.Assert(seq(c, proxy.URL, 4), DeepEquals, []string{"warming", "b", "b", "b"})
+	infos := lb.ServerInfos()
+	c.Assert(infos[0].EffectiveWeight, Equals, 0)
+	c.Assert(infos[0].Breaker, Equals, BreakerClosed)
+
+	atomic.StoreInt32(&warming, 0)
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(10 * time.Second)
+	counts := map[string]int{}
+	for _, body := range seq(c, proxy.URL, 4) {
+		counts[body]++
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"a": 2, "b": 2})
+}
+
+func (s *SlowStartSuite) TestRetryAfterCapped(c *C) {
+	var warming int32 = 1
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.CompareAndSwapInt32(&warming, 1, 0) {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, SkipOnRetryAfter(5*time.Second), RoundRobinClock(s.clock))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"", "b", "b"})
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(5 * time.Second)
+	counts := map[string]int{}
+	for _, body := range seq(c, proxy.URL, 4) {
+		counts[body]++
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"a": 2, "b": 2})
+}
+
+func (s *SlowStartSuite) TestSkipOnRetryAfterBadOptions(c *C) {
+	_, err := New(nil, SkipOnRetryAfter(0))
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,75 @@
+package roundrobin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// StickyHashFallback picks the server of the requests without a sticky cookie by a weighted consistent
+// hash of key(req), e.g. a user id or the client IP, and sets the cookie. The first request of a client
+// and the requests not carrying the cookie land on the same server as long as it stays in the pool,
+// and a change of the pool only moves the keys of the servers added or removed. The share of the keys
+// of every server follows its effective weight. The requests with an empty key go through the round
+// robin. It requires EnableStickySession and replaces StickyIPFallback.
+func StickyHashFallback(key func(req *http.Request) string) LBOption {
+	return func(s *RoundRobin) error {
+		if key == nil {
+			return fmt.Errorf("sticky hash key can't be nil")
+		}
+		s.stickyHashKey = key
+		return nil
+	}
+}
+
+// serverByHash returns the server with the highest weighted rendezvous score for the key
+func (r *RoundRobin) serverByHash(key string) (*url.URL, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var (
+		best  *server
+		score float64
+	)
+	for _, srv := range r.servers {
+		weight := r.effectiveWeight(srv)
+		if weight <= 0 || r.tripped(srv) {
+			continue
+		}
+		if s := rendezvousScore(key, srv.url, weight); best == nil || s > score {
+			best, score = srv, s
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	return utils.CopyURL(best.url), true
+}
+
+// rendezvousScore is -weight/ln(h) for h uniformly drawn in (0, 1) by hashing the key and the server,
+// so every server wins the keys in proportion to its weight
+func rendezvousScore(key string, u *url.URL, weight int) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(u.String()))
+	// the fnv hashes of similar inputs are close, the finalizer of splitmix64 spreads them
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	unit := (float64(x>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(unit)
+}
+
+// stickyKey returns the consistent hash key of the request, empty without StickyHashFallback
+func (r *RoundRobin) stickyKey(req *http.Request) string {
+	if r.stickyHashKey == nil {
+		return ""
+	}
+	return r.stickyHashKey(req)
+}
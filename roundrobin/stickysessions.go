@@ -2,16 +2,33 @@
 package roundrobin
 
 import (
+	"hash/fnv"
+	"net"
 	"net/http"
 	"net/url"
 )
 
 type StickySession struct {
-	cookiename string
+	cookiename   string
+	codec        CookieCodec
+	ignoreScheme bool
 }
 
 func NewStickySession(c string) *StickySession {
-	return &StickySession{c}
+	return &StickySession{cookiename: c, codec: PlainCookieCodec{}}
+}
+
+// NewStickySessionWithCodec returns a sticky session encoding the backend in the cookie with the codec
+func NewStickySessionWithCodec(c string, codec CookieCodec) *StickySession {
+	return &StickySession{cookiename: c, codec: codec}
+}
+
+// SetIgnoreScheme makes the cookie point to the backend by host and path only, so the affinity survives
+// a change of the scheme the backend is registered with, e.g. from ws://a to http://a. The tradeoff is
+// that the servers differing only by their scheme can't be told apart anymore: the cookie sticks to the
+// first of them in the pool. The cookies set before are ignored, as they carry the scheme.
+func (s *StickySession) SetIgnoreScheme(b bool) {
+	s.ignoreScheme = b
 }
 
 // GetBackend returns the backend URL stored in the sticky cookie, iff the backend is still in the valid list of servers.
@@ -25,33 +42,64 @@ func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.
 		return nil, false, err
 	}
 
-	s_url, err := url.Parse(cookie.Value)
+	if s.ignoreScheme {
+		return s.getBackendIgnoringScheme(cookie.Value, servers)
+	}
+	backend, err := s.codec.Decode(cookie.Value, servers)
 	if err != nil {
 		return nil, false, err
 	}
+	return backend, backend != nil, nil
+}
 
-	if s.isBackendAlive(s_url, servers) {
-		return s_url, true, nil
-	} else {
-		return nil, false, nil
+// getBackendIgnoringScheme matches the cookie value against the servers stripped of their scheme
+func (s *StickySession) getBackendIgnoringScheme(value string, servers []*url.URL) (*url.URL, bool, error) {
+	stripped := make([]*url.URL, len(servers))
+	for i, u := range servers {
+		stripped[i] = withoutScheme(u)
+	}
+	backend, err := s.codec.Decode(value, stripped)
+	if err != nil || backend == nil {
+		return nil, false, err
+	}
+	for i, u := range stripped {
+		if u == backend {
+			return servers[i], true, nil
+		}
 	}
+	return nil, false, nil
 }
 
-func (s *StickySession) StickBackend(backend *url.URL, w *http.ResponseWriter) {
-	c := &http.Cookie{Name: s.cookiename, Value: backend.String()}
-	http.SetCookie(*w, c)
-	return
+func withoutScheme(u *url.URL) *url.URL {
+	out := *u
+	out.Scheme = ""
+	return &out
 }
 
-func (s *StickySession) isBackendAlive(needle *url.URL, haystack []*url.URL) bool {
-	if len(haystack) == 0 {
-		return false
+// GetBackendByIP returns the backend picked by hashing the client IP, the same client gets
+// the same backend as long as the list of servers doesn't change.
+func (s *StickySession) GetBackendByIP(req *http.Request, servers []*url.URL) (*url.URL, bool) {
+	if len(servers) == 0 {
+		return nil, false
 	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil, false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	return servers[h.Sum32()%uint32(len(servers))], true
+}
 
-	for _, s := range haystack {
-		if sameURL(needle, s) {
-			return true
-		}
+func (s *StickySession) StickBackend(backend *url.URL, w *http.ResponseWriter) {
+	if s.ignoreScheme {
+		backend = withoutScheme(backend)
 	}
-	return false
+	value, err := s.codec.Encode(backend)
+	if err != nil {
+		// the request goes on without affinity
+		return
+	}
+	c := &http.Cookie{Name: s.cookiename, Value: value}
+	http.SetCookie(*w, c)
 }
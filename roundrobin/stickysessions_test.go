@@ -1,9 +1,13 @@
 package roundrobin
 
 import (
+	"encoding/base64"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/vulcand/oxy/forward"
@@ -249,3 +253,447 @@ func (s *SSSuite) TestBadCookieVal(c *C) {
 	body, err = ioutil.ReadAll(resp.Body)
 	c.Assert(resp.StatusCode, Equals, http.StatusInternalServerError)
 }
+
+// Makes sure the sticky cookie does not replace the cookies set by the backend
+func (s *SSSuite) TestStickCookieKeepsBackendCookies(c *C) {
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "csrf", Value: "2"})
+		http.SetCookie(w, &http.Cookie{Name: "lang", Value: "3"})
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	cookies := map[string]string{}
+	for _, cookie := range resp.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	c.Assert(cookies, DeepEquals, map[string]string{"test": a.URL, "session": "1", "csrf": "2", "lang": "3"})
+}
+
+func (s *SSSuite) TestStickyDrain(c *C) {
+	a := testutils.NewResponder("a")
+	b := testutils.NewResponder("b")
+
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	for _, respectDrain := range []bool{true, false} {
+		lb, err := New(fwd, EnableStickySession(NewStickySession("test")), StickyRespectDrain(respectDrain))
+		c.Assert(err, IsNil)
+
+		lb.UpsertServer(testutils.ParseURI(a.URL))
+		lb.UpsertServer(testutils.ParseURI(b.URL))
+		// drain a
+		lb.UpsertServer(testutils.ParseURI(a.URL), Weight(0))
+
+		proxy := httptest.NewServer(lb)
+
+		req, err := http.NewRequest("GET", proxy.URL, nil)
+		c.Assert(err, IsNil)
+		req.AddCookie(&http.Cookie{Name: "test", Value: a.URL})
+
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		proxy.Close()
+		c.Assert(err, IsNil)
+
+		if respectDrain {
+			c.Assert(string(body), Equals, "a")
+			c.Assert(resp.Cookies(), HasLen, 0)
+		} else {
+			c.Assert(string(body), Equals, "b")
+			c.Assert(resp.Cookies()[0].Value, Equals, b.URL)
+		}
+	}
+}
+
+func (s *SSSuite) TestIPFallback(c *C) {
+	a := testutils.NewResponder("a")
+	b := testutils.NewResponder("b")
+
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")), StickyIPFallback(true))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// cookie-less requests from the same IP stick to the same server
+	var cookie *http.Cookie
+	var first string
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(proxy.URL)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		if i == 0 {
+			first = string(body)
+			cookie = resp.Cookies()[0]
+		}
+		c.Assert(string(body), Equals, first)
+	}
+
+	// the cookie is set, so the clients accepting it switch to the cookie based affinity
+	firstURL, other, otherURL := a.URL, "b", b.URL
+	if first == "b" {
+		firstURL, other, otherURL = b.URL, "a", a.URL
+	}
+	c.Assert(cookie.Value, Equals, firstURL)
+
+	// and the cookie takes precedence over the IP
+	req, err := http.NewRequest("GET", proxy.URL, nil)
+	c.Assert(err, IsNil)
+	req.AddCookie(&http.Cookie{Name: "test", Value: otherURL})
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, other)
+	c.Assert(resp.Cookies(), HasLen, 0)
+}
+
+func (s *SSSuite) TestIPFallbackRequiresStickySession(c *C) {
+	_, err := New(nil, StickyIPFallback(true))
+	c.Assert(err, NotNil)
+}
+
+func (s *SSSuite) TestHashFallback(c *C) {
+	a := testutils.NewResponder("a")
+	b := testutils.NewResponder("b")
+	d := testutils.NewResponder("d")
+
+	defer a.Close()
+	defer b.Close()
+	defer d.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	var reasons []string
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")),
+		StickyHashFallback(func(req *http.Request) string { return req.Header.Get("X-User") }),
+		SelectionObserver(func(_ *url.URL, reason string) { reasons = append(reasons, reason) }))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+	lb.UpsertServer(testutils.ParseURI(d.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	get := func(user string, cookie *http.Cookie) (string, []*http.Cookie) {
+		req, err := http.NewRequest("GET", proxy.URL, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("X-User", user)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		return string(body), resp.Cookies()
+	}
+
+	// the cookie-less requests of a user land on the same server, which is set in the cookie
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		user := "user-" + strconv.Itoa(i)
+		first, cookies := get(user, nil)
+		c.Assert(cookies, HasLen, 1)
+		seen[first] = true
+		for j := 0; j < 3; j++ {
+			body, _ := get(user, nil)
+			c.Assert(body, Equals, first)
+		}
+		// the cookie is authoritative
+		body, cookies := get("another-user", cookies[0])
+		c.Assert(body, Equals, first)
+		c.Assert(cookies, HasLen, 0)
+	}
+	c.Assert(seen, HasLen, 3)
+	c.Assert(reasons[:2], DeepEquals, []string{SelectionHash, SelectionHash})
+
+	// the requests without a key go through the round robin
+	reasons = nil
+	get("", nil)
+	c.Assert(reasons, DeepEquals, []string{SelectionRoundRobin})
+}
+
+func (s *SSSuite) TestHashFallbackConsistent(c *C) {
+	lb, err := New(nil, EnableStickySession(NewStickySession("test")),
+		StickyHashFallback(func(req *http.Request) string { return req.Header.Get("X-User") }))
+	c.Assert(err, IsNil)
+	for _, u := range []string{"http://a", "http://b", "http://c"} {
+		lb.UpsertServer(testutils.ParseURI(u))
+	}
+	lb.UpsertServer(testutils.ParseURI("http://d"), Weight(3))
+
+	const keys = 4000
+	before := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		u, ok := lb.serverByHash(key)
+		c.Assert(ok, Equals, true)
+		before[key] = u.String()
+		counts[u.String()]++
+	}
+	// the keys are spread by weight, d getting half of them
+	c.Assert(counts["http://d"] > keys*45/100 && counts["http://d"] < keys*55/100, Equals, true, Commentf("%v", counts))
+	c.Assert(counts["http://a"] > keys*13/100 && counts["http://a"] < keys*20/100, Equals, true, Commentf("%v", counts))
+
+	// removing a server only moves its keys
+	c.Assert(lb.RemoveServer(testutils.ParseURI("http://b")), IsNil)
+	for key, was := range before {
+		u, ok := lb.serverByHash(key)
+		c.Assert(ok, Equals, true)
+		if was != "http://b" {
+			c.Assert(u.String(), Equals, was)
+		} else {
+			c.Assert(u.String(), Not(Equals), was)
+		}
+	}
+}
+
+func (s *SSSuite) TestHashFallbackOptions(c *C) {
+	key := func(req *http.Request) string { return req.Header.Get("X-User") }
+	_, err := New(nil, StickyHashFallback(key))
+	c.Assert(err, NotNil)
+	_, err = New(nil, EnableStickySession(NewStickySession("test")), StickyHashFallback(key), StickyIPFallback(true))
+	c.Assert(err, NotNil)
+	_, err = New(nil, EnableStickySession(NewStickySession("test")), StickyHashFallback(nil))
+	c.Assert(err, NotNil)
+}
+
+// testCodec checks that the codec sticks the clients to the server they first got, and ignores the
+// values it didn't encode
+func testCodec(c *C, codec CookieCodec) {
+	a := testutils.NewResponder("a")
+	b := testutils.NewResponder("b")
+
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySessionWithCodec("test", codec)))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	get := func(cookie *http.Cookie) (string, []*http.Cookie) {
+		req, err := http.NewRequest("GET", proxy.URL, nil)
+		c.Assert(err, IsNil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		return string(body), resp.Cookies()
+	}
+
+	first, cookies := get(nil)
+	c.Assert(cookies, HasLen, 1)
+	cookie := cookies[0]
+	c.Assert(strings.Contains(cookie.Value, "127.0.0.1"), Equals, false)
+
+	for i := 0; i < 5; i++ {
+		body, cookies := get(cookie)
+		c.Assert(body, Equals, first)
+		c.Assert(cookies, HasLen, 0)
+	}
+
+	// the plain URL of a server is not accepted, the balancer picks a server and sets a new cookie
+	_, cookies = get(&http.Cookie{Name: "test", Value: a.URL})
+	c.Assert(cookies, HasLen, 1)
+}
+
+func (s *SSSuite) TestSignedCookieCodec(c *C) {
+	codec, err := NewSignedCookieCodec([]byte("secret"))
+	c.Assert(err, IsNil)
+	testCodec(c, codec)
+
+	// tampering with the URL invalidates the signature
+	value, err := codec.Encode(testutils.ParseURI("http://a"))
+	c.Assert(err, IsNil)
+	servers := []*url.URL{testutils.ParseURI("http://a"), testutils.ParseURI("http://b")}
+	u, err := codec.Decode(value, servers)
+	c.Assert(err, IsNil)
+	c.Assert(u.String(), Equals, "http://a")
+
+	forged := base64.RawURLEncoding.EncodeToString([]byte("http://b")) + value[strings.Index(value, "."):]
+	u, err = codec.Decode(forged, servers)
+	c.Assert(err, IsNil)
+	c.Assert(u, IsNil)
+
+	_, err = NewSignedCookieCodec(nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *SSSuite) TestAESCookieCodec(c *C) {
+	codec, err := NewAESCookieCodec([]byte("0123456789abcdef"))
+	c.Assert(err, IsNil)
+	testCodec(c, codec)
+
+	// another key can't decrypt the value
+	value, err := codec.Encode(testutils.ParseURI("http://a"))
+	c.Assert(err, IsNil)
+	other, err := NewAESCookieCodec([]byte("fedcba9876543210"))
+	c.Assert(err, IsNil)
+	u, err := other.Decode(value, []*url.URL{testutils.ParseURI("http://a")})
+	c.Assert(err, IsNil)
+	c.Assert(u, IsNil)
+
+	_, err = NewAESCookieCodec([]byte("short"))
+	c.Assert(err, NotNil)
+}
+
+func (s *SSSuite) TestVersionedCookieCodec(c *C) {
+	signed, err := NewSignedCookieCodec([]byte("secret"))
+	c.Assert(err, IsNil)
+	encrypted, err := NewAESCookieCodec([]byte("0123456789abcdef"))
+	c.Assert(err, IsNil)
+
+	codec, err := NewVersionedCookieCodec("v2", map[string]CookieCodec{"v1": signed, "v2": encrypted})
+	c.Assert(err, IsNil)
+	testCodec(c, codec)
+
+	// the cookies of every version decode during the transition, the new ones get the current version
+	migrating, err := NewVersionedCookieCodec("v2", map[string]CookieCodec{"": PlainCookieCodec{}, "v1": signed, "v2": encrypted})
+	c.Assert(err, IsNil)
+	servers := []*url.URL{testutils.ParseURI("http://a"), testutils.ParseURI("http://b")}
+
+	value, err := migrating.Encode(testutils.ParseURI("http://a"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(value, "v2~"), Equals, true)
+	u, err := migrating.Decode(value, servers)
+	c.Assert(err, IsNil)
+	c.Assert(u.String(), Equals, "http://a")
+
+	v1, err := signed.Encode(testutils.ParseURI("http://b"))
+	c.Assert(err, IsNil)
+	u, err = migrating.Decode("v1~"+v1, servers)
+	c.Assert(err, IsNil)
+	c.Assert(u.String(), Equals, "http://b")
+
+	// the values without a version decode with the codec of the empty version
+	u, err = migrating.Decode("http://b", servers)
+	c.Assert(err, IsNil)
+	c.Assert(u.String(), Equals, "http://b")
+	u, err = codec.Decode("http://b", servers)
+	c.Assert(err, IsNil)
+	c.Assert(u, IsNil)
+
+	// the unknown versions and the values of another version are ignored
+	u, err = migrating.Decode("v9~"+v1, servers)
+	c.Assert(err, IsNil)
+	c.Assert(u, IsNil)
+	u, err = migrating.Decode("v2~"+v1, servers)
+	c.Assert(err, IsNil)
+	c.Assert(u, IsNil)
+
+	_, err = NewVersionedCookieCodec("", map[string]CookieCodec{"": PlainCookieCodec{}})
+	c.Assert(err, NotNil)
+	_, err = NewVersionedCookieCodec("v3", map[string]CookieCodec{"v1": signed})
+	c.Assert(err, NotNil)
+	_, err = NewVersionedCookieCodec("v~1", map[string]CookieCodec{"v~1": signed})
+	c.Assert(err, NotNil)
+}
+
+func (s *SSSuite) TestIgnoreScheme(c *C) {
+	a := testutils.NewResponder("a")
+	b := testutils.NewResponder("b")
+
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	sticky := NewStickySession("test")
+	sticky.SetIgnoreScheme(true)
+
+	lb, err := New(fwd, EnableStickySession(sticky))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	first, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	cookie := resp.Cookies()[0]
+	c.Assert(strings.HasPrefix(cookie.Value, "//127.0.0.1:"), Equals, true)
+
+	// the cookie matches the server by host, whatever scheme it is registered with
+	firstURL := testutils.ParseURI(a.URL)
+	if string(first) == "b" {
+		firstURL = testutils.ParseURI(b.URL)
+	}
+	wsURL := *firstURL
+	wsURL.Scheme = "ws"
+	backend, present, err := sticky.GetBackend(&http.Request{Header: http.Header{"Cookie": []string{cookie.String()}}}, []*url.URL{&wsURL})
+	c.Assert(err, IsNil)
+	c.Assert(present, Equals, true)
+	c.Assert(backend, Equals, &wsURL)
+
+	for i := 0; i < 5; i++ {
+		req, err := http.NewRequest("GET", proxy.URL, nil)
+		c.Assert(err, IsNil)
+		req.AddCookie(cookie)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, string(first))
+	}
+}
@@ -0,0 +1,53 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// MaxConcurrentStreams limits the number of requests in flight to the server, which is a better
+// measure of the load than the number of connections for the multiplexed (HTTP/2) backends.
+// The balancer skips the server while it is at its limit. The limit is soft, concurrent
+// selections may overshoot it slightly.
+func MaxConcurrentStreams(n int) ServerOption {
+	return func(s *server) error {
+		if n <= 0 {
+			return fmt.Errorf("max concurrent streams should be > 0, got %v", n)
+		}
+		s.maxStreams = int64(n)
+		return nil
+	}
+}
+
+// InflightStreams returns the number of requests in flight to the server
+func (rr *RoundRobin) InflightStreams(u *url.URL) (int64, bool) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if s, _ := rr.findServerByURL(u); s != nil {
+		return s.streams, true
+	}
+	return -1, false
+}
+
+// serveNext sends the request to the next handler, accounting for the stream in flight
+func (r *RoundRobin) serveNext(w http.ResponseWriter, req *http.Request) {
+	r.updateStreams(req.URL, 1)
+	defer r.updateStreams(req.URL, -1)
+	r.next.ServeHTTP(w, req)
+}
+
+func (r *RoundRobin) updateStreams(u *url.URL, delta int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if s, _ := r.findServerByURL(u); s != nil {
+		s.streams += delta
+	}
+}
+
+// saturated returns true if the server is at its stream limit
+func (s *server) saturated() bool {
+	return s.maxStreams > 0 && s.streams >= s.maxStreams
+}
@@ -0,0 +1,95 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type StreamsSuite struct{}
+
+var _ = Suite(&StreamsSuite{})
+
+func (s *StreamsSuite) TestSkipSaturatedServer(c *C) {
+	release := make(chan bool)
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd)
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(a.URL), MaxConcurrentStreams(1))
+	lb.UpsertServer(testutils.ParseURI(b.URL))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	done := make(chan bool)
+	go func() {
+		_, body, err := testutils.Get(proxy.URL + "/slow")
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, "a")
+		done <- true
+	}()
+	waitForStreams(lb, testutils.ParseURI(a.URL), 1)
+
+	// a is at its limit
+	c.Assert(seq(c, proxy.URL, 3), DeepEquals, []string{"b", "b", "b"})
+
+	close(release)
+	<-done
+	waitForStreams(lb, testutils.ParseURI(a.URL), 0)
+
+	c.Assert(seq(c, proxy.URL, 2), DeepEquals, []string{"a", "b"})
+
+	streams, ok := lb.InflightStreams(testutils.ParseURI(b.URL))
+	c.Assert(ok, Equals, true)
+	c.Assert(streams, Equals, int64(0))
+}
+
+func (s *StreamsSuite) TestAllSaturated(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	a := testutils.ParseURI("http://a")
+	lb.UpsertServer(a, MaxConcurrentStreams(1))
+	lb.updateStreams(a, 1)
+
+	_, err = lb.NextServer()
+	c.Assert(err, FitsTypeOf, &NoServersError{})
+
+	_, ok := lb.InflightStreams(testutils.ParseURI("http://b"))
+	c.Assert(ok, Equals, false)
+}
+
+func (s *StreamsSuite) TestBadOptions(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://a"), MaxConcurrentStreams(0)), NotNil)
+}
+
+func waitForStreams(lb *RoundRobin, u *url.URL, expected int64) {
+	for i := 0; i < 100; i++ {
+		if streams, _ := lb.InflightStreams(u); streams == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
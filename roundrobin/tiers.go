@@ -0,0 +1,83 @@
+package roundrobin
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Tier sets the priority tier of the server, 0 by default. The servers of a tier only get traffic
+// when all the servers of the lower tiers are unavailable: disabled, with an open circuit breaker, or
+// at their stream or rate limit. E.g. the servers of a disaster recovery region in tier 1 take the
+// traffic once the primary servers in tier 0 are all down, and give it back once they recover.
+func Tier(n int) ServerOption {
+	return func(s *server) error {
+		if n < 0 {
+			return fmt.Errorf("tier should be >= 0, got %v", n)
+		}
+		s.tier = n
+		return nil
+	}
+}
+
+// selectTier selects a server of the lowest tier with an available server. When there is none,
+// the error of the lowest tier is returned.
+func (r *RoundRobin) selectTier() (*server, error) {
+	var firstErr error
+	for _, tier := range r.tiers {
+		srv, err := r.selectInTier(tier)
+		if err == nil {
+			return srv, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// selectInTier selects a server of the tier, the iterator is only moved to another tier on success
+func (r *RoundRobin) selectInTier(tier int) (*server, error) {
+	if tier == r.tier {
+		return r.selectServer()
+	}
+	prevTier, index, currentWeight := r.tier, r.index, r.currentWeight
+	r.tier, r.currentWeight = tier, 0
+	srv, err := r.selectServer()
+	if err != nil {
+		r.tier, r.index, r.currentWeight = prevTier, index, currentWeight
+		return nil, err
+	}
+	r.log.Infof("Switched from the servers of tier %v to tier %v", prevTier, tier)
+	return srv, nil
+}
+
+// selectionWeights returns the effective weights of the servers of the current tier, 0 for the others.
+func (r *RoundRobin) selectionWeights(now time.Time) []int {
+	weights := make([]int, len(r.servers))
+	for i, s := range r.servers {
+		if r.tiers == nil || s.tier == r.tier {
+			weights[i] = r.effectiveWeightAt(s, now)
+		}
+	}
+	return weights
+}
+
+// resetTiers lists the tiers of the servers
+func (r *RoundRobin) resetTiers() {
+	r.tiers = nil
+	seen := map[int]bool{}
+	for _, s := range r.servers {
+		if !seen[s.tier] {
+			seen[s.tier] = true
+			r.tiers = append(r.tiers, s.tier)
+		}
+	}
+	if len(r.tiers) < 2 {
+		// a single tier, maybe not the tier 0, balances as usual
+		r.tiers = nil
+		r.tier = 0
+		return
+	}
+	sort.Ints(r.tiers)
+}
@@ -0,0 +1,57 @@
+package roundrobin
+
+import (
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type TierSuite struct{}
+
+var _ = Suite(&TierSuite{})
+
+func (s *TierSuite) TestTierFailover(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI("http://a"), MaxConcurrentStreams(1))
+	lb.UpsertServer(testutils.ParseURI("http://b"))
+	lb.UpsertServer(testutils.ParseURI("http://dr1"), Tier(1), Weight(2))
+	lb.UpsertServer(testutils.ParseURI("http://dr2"), Tier(1))
+
+	next := func(n int) []string {
+		var out []string
+		for i := 0; i < n; i++ {
+			u, err := lb.NextServer()
+			c.Assert(err, IsNil)
+			out = append(out, u.Host)
+		}
+		return out
+	}
+
+	// the traffic stays on tier 0 while one of its servers is available
+	c.Assert(next(4), DeepEquals, []string{"a", "b", "a", "b"})
+	lb.UpsertServer(testutils.ParseURI("http://b"), Weight(0))
+	c.Assert(next(2), DeepEquals, []string{"a", "a"})
+
+	// then moves to tier 1, balanced with the weights of tier 1
+	lb.updateStreams(testutils.ParseURI("http://a"), 1)
+	c.Assert(next(6), DeepEquals, []string{"dr1", "dr1", "dr2", "dr1", "dr1", "dr2"})
+
+	// and back to tier 0 once a server recovers
+	lb.updateStreams(testutils.ParseURI("http://a"), -1)
+	c.Assert(next(2), DeepEquals, []string{"a", "a"})
+	lb.UpsertServer(testutils.ParseURI("http://b"), Weight(1))
+	c.Assert(next(4), DeepEquals, []string{"a", "b", "a", "b"})
+
+	// the error of tier 0 is returned when no tier has an available server
+	lb.UpsertServer(testutils.ParseURI("http://a"), Weight(0))
+	lb.UpsertServer(testutils.ParseURI("http://b"), Weight(0))
+	lb.UpsertServer(testutils.ParseURI("http://dr1"), Weight(0))
+	lb.UpsertServer(testutils.ParseURI("http://dr2"), Weight(0))
+	_, err = lb.NextServer()
+	c.Assert(err, NotNil)
+
+	c.Assert(lb.ServerInfos()[2].Tier, Equals, 1)
+	c.Assert(lb.UpsertServer(testutils.ParseURI("http://a"), Tier(-1)), NotNil)
+}
@@ -0,0 +1,88 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/memmetrics"
+)
+
+// OtherVersion is the metrics series of the servers whose version is not one of the known versions
+const OtherVersion = "other"
+
+// Version labels the server with the version of the application it runs, see VersionMetrics
+func Version(v string) ServerOption {
+	return func(s *server) error {
+		s.version = v
+		return nil
+	}
+}
+
+// VersionMetrics records the response times and codes of every known version of the servers into
+// a separate series, to compare a canary with the stable version. The servers without a known
+// version share the OtherVersion series, which bounds the number of series.
+func VersionMetrics(versions ...string) LBOption {
+	return func(s *RoundRobin) error {
+		if len(versions) == 0 {
+			return fmt.Errorf("at least one version is required")
+		}
+		s.versions = &versionMetrics{known: versions}
+		return nil
+	}
+}
+
+// MetricsByVersion returns the metrics of the servers of the version, or of OtherVersion
+func (r *RoundRobin) MetricsByVersion(version string) (*memmetrics.RTMetrics, bool) {
+	if r.versions == nil {
+		return nil, false
+	}
+	r.versions.mutex.Lock()
+	defer r.versions.mutex.Unlock()
+	m, ok := r.versions.metrics[version]
+	return m, ok
+}
+
+type versionMetrics struct {
+	known []string
+
+	mutex   *sync.Mutex
+	metrics map[string]*memmetrics.RTMetrics
+}
+
+func (v *versionMetrics) init(r *RoundRobin) error {
+	v.mutex = &sync.Mutex{}
+	v.metrics = make(map[string]*memmetrics.RTMetrics, len(v.known)+1)
+	versions := append([]string{OtherVersion}, v.known...)
+	for _, version := range versions {
+		m, err := memmetrics.NewRTMetrics(memmetrics.RTClock(r.clock))
+		if err != nil {
+			return err
+		}
+		v.metrics[version] = m
+	}
+	return nil
+}
+
+func (v *versionMetrics) record(version string, code int, d time.Duration) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	m, ok := v.metrics[version]
+	if !ok {
+		m = v.metrics[OtherVersion]
+	}
+	m.Record(code, d)
+}
+
+// serverVersion returns the version of the server
+func (r *RoundRobin) serverVersion(u *url.URL) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if s, _ := r.findServerByURL(u); s != nil {
+		return s.version
+	}
+	return ""
+}
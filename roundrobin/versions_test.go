@@ -0,0 +1,72 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type VersionSuite struct{}
+
+var _ = Suite(&VersionSuite{})
+
+func (s *VersionSuite) TestMetricsByVersion(c *C) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+
+	stable := testutils.NewResponder("stable")
+	defer stable.Close()
+
+	canary := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		clock.CurrentTime = clock.CurrentTime.Add(50 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer canary.Close()
+
+	unknown := testutils.NewResponder("unknown")
+	defer unknown.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, VersionMetrics("v1", "v2"), RoundRobinClock(clock))
+	c.Assert(err, IsNil)
+
+	lb.UpsertServer(testutils.ParseURI(stable.URL), Version("v1"))
+	lb.UpsertServer(testutils.ParseURI(canary.URL), Version("v2"))
+	lb.UpsertServer(testutils.ParseURI(unknown.URL), Version("v3"))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	seq(c, proxy.URL, 6)
+
+	v1, ok := lb.MetricsByVersion("v1")
+	c.Assert(ok, Equals, true)
+	c.Assert(v1.TotalCount(), Equals, int64(2))
+	c.Assert(v1.StatusCodesCounts(), DeepEquals, map[int]int64{http.StatusOK: 2})
+
+	v2, ok := lb.MetricsByVersion("v2")
+	c.Assert(ok, Equals, true)
+	c.Assert(v2.TotalCount(), Equals, int64(2))
+	c.Assert(v2.StatusCodesCounts(), DeepEquals, map[int]int64{http.StatusInternalServerError: 2})
+	h, err := v2.LatencyHistogram()
+	c.Assert(err, IsNil)
+	// the histograms have 2 significant figures
+	c.Assert(h.LatencyAtQuantile(100).Round(time.Millisecond), Equals, 50*time.Millisecond)
+
+	// the unknown versions share a single series
+	other, ok := lb.MetricsByVersion(OtherVersion)
+	c.Assert(ok, Equals, true)
+	c.Assert(other.TotalCount(), Equals, int64(2))
+	_, ok = lb.MetricsByVersion("v3")
+	c.Assert(ok, Equals, false)
+
+	_, err = New(fwd, VersionMetrics())
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,82 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// Warmup pre-dials count connections to the servers added to the pool, so the first requests
+// don't pay for the dial. The balancer sends count concurrent GET requests for path, e.g. the
+// health check endpoint, through the next handler and discards the responses. The connections stay
+// in the idle pool of the forwarder transport as long as it keeps that many idle connections per host.
+// The warmup requests are cancelled after 10 seconds, or as soon as the server is removed.
+func Warmup(count int, path string) LBOption {
+	return func(s *RoundRobin) error {
+		if count <= 0 {
+			return fmt.Errorf("warmup count should be > 0, got %v", count)
+		}
+		s.warmup = &warmup{count: count, path: path}
+		return nil
+	}
+}
+
+// warmupTimeout bounds the warmup requests, so a hanging server doesn't hold on to them
+const warmupTimeout = 10 * time.Second
+
+type warmup struct {
+	count int
+	path  string
+}
+
+// warm sends the warmup requests to the new server in the background
+func (r *RoundRobin) warm(srv *server) {
+	if r.warmup == nil {
+		return
+	}
+	u := srv.url
+	target := utils.CopyURL(u)
+	target.Path, target.RawPath, target.RawQuery = r.warmup.path, "", ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+	srv.stopWarmup = cancel
+	go func() {
+		defer cancel()
+		wg := &sync.WaitGroup{}
+		for i := 0; i < r.warmup.count; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+				if err != nil {
+					r.log.Errorf("failed to warm up %v: %v", u, err)
+					return
+				}
+				req = req.WithContext(ctx)
+				w := utils.NewBufferWriter(utils.NopWriteCloser(ioutil.Discard))
+				r.next.ServeHTTP(w, req)
+				if w.Code >= http.StatusInternalServerError {
+					r.log.Warningf("warmup of %v got %v", u, w.Code)
+				}
+			}()
+		}
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			r.log.Warningf("warmup of %v stopped: %v", u, err)
+			return
+		}
+		r.log.Infof("warmed up %v connections to %v", r.warmup.count, u)
+	}()
+}
+
+// cancelWarmup stops the warmup requests still in flight to the removed server
+func (s *server) cancelWarmup() {
+	if s.stopWarmup != nil {
+		s.stopWarmup()
+	}
+}
@@ -0,0 +1,112 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type WarmupSuite struct{}
+
+var _ = Suite(&WarmupSuite{})
+
+func (s *WarmupSuite) TestWarmup(c *C) {
+	mutex := &sync.Mutex{}
+	var warmups int
+	conns := make(map[string]bool)
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		if req.URL.Path == "/health" {
+			warmups++
+			conns[req.RemoteAddr] = true
+		}
+		mutex.Unlock()
+		// hold the warmup requests so they get their own connections
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(req.RemoteAddr))
+	})
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, Warmup(2, "/health"))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+
+	warmedUp := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return warmups == 2
+	}
+	for i := 0; i < 100 && !warmedUp(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(warmedUp(), Equals, true)
+	mutex.Lock()
+	c.Assert(conns, HasLen, 2)
+	mutex.Unlock()
+	// let the warmup responses return the connections to the idle pool
+	time.Sleep(50 * time.Millisecond)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// the first request reuses a warm connection
+	_, body, err := testutils.Get(proxy.URL)
+	c.Assert(err, IsNil)
+	mutex.Lock()
+	c.Assert(conns[string(body)], Equals, true)
+	mutex.Unlock()
+
+	// updating the server doesn't warm it up again
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL), Weight(2)), IsNil)
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	c.Assert(warmups, Equals, 2)
+	mutex.Unlock()
+
+	_, err = New(fwd, Warmup(0, "/health"))
+	c.Assert(err, NotNil)
+}
+
+func (s *WarmupSuite) TestWarmupCancelledOnRemove(c *C) {
+	started, cancelled := make(chan bool, 1), make(chan bool, 1)
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		started <- true
+		select {
+		case <-req.Context().Done():
+			cancelled <- true
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer a.Close()
+
+	fwd, err := forward.New()
+	c.Assert(err, IsNil)
+
+	lb, err := New(fwd, Warmup(1, "/health"))
+	c.Assert(err, IsNil)
+
+	c.Assert(lb.UpsertServer(testutils.ParseURI(a.URL)), IsNil)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("the server was not warmed up")
+	}
+
+	// the hanging warmup request doesn't outlive the server
+	c.Assert(lb.RemoveServer(testutils.ParseURI(a.URL)), IsNil)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		c.Fatalf("the warmup request was not cancelled")
+	}
+}
@@ -0,0 +1,83 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// ServerSpec describes the desired state of a server in the pool
+type ServerSpec struct {
+	URL     *url.URL
+	Options []ServerOption
+}
+
+// SetServers atomically replaces the pool with the given servers. Servers already in the pool
+// keep their state and get the new options applied, servers missing from the specs are removed.
+// If any of the specs is invalid, the pool is left untouched.
+func (rr *RoundRobin) SetServers(specs []ServerSpec) error {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	servers := make([]*server, 0, len(specs))
+	var added []*server
+	for _, spec := range specs {
+		if spec.URL == nil {
+			return fmt.Errorf("server URL can't be nil")
+		}
+		for _, s := range servers {
+			if sameURL(s.url, spec.URL) {
+				return fmt.Errorf("duplicate server %v", spec.URL)
+			}
+		}
+		if s, _ := rr.findServerByURL(spec.URL); s != nil {
+			updated := *s
+			for _, o := range spec.Options {
+				if err := o(&updated); err != nil {
+					return err
+				}
+			}
+			rr.startRamp(&updated, rr.rampedWeight(s))
+			servers = append(servers, &updated)
+			continue
+		}
+		srv, err := rr.newServer(spec.URL, spec.Options)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, srv)
+		added = append(added, srv)
+	}
+
+	for _, s := range rr.servers {
+		if !hasServer(servers, s.url) {
+			s.cancelWarmup()
+		}
+	}
+	rr.servers = servers
+	rr.resetState()
+	for _, s := range added {
+		rr.warm(s)
+	}
+	return nil
+}
+
+// WatchServers applies every desired state received from the channel to the pool,
+// until the channel is closed.
+func (rr *RoundRobin) WatchServers(ch <-chan []ServerSpec) {
+	go func() {
+		for specs := range ch {
+			if err := rr.SetServers(specs); err != nil {
+				rr.log.Errorf("failed to update servers: %v", err)
+			}
+		}
+	}()
+}
+
+func hasServer(servers []*server, u *url.URL) bool {
+	for _, s := range servers {
+		if sameURL(s.url, u) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package roundrobin
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/vulcand/oxy/testutils"
+
+	. "gopkg.in/check.v1"
+)
+
+type WatchSuite struct{}
+
+var _ = Suite(&WatchSuite{})
+
+func (s *WatchSuite) TestSetServers(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	a, b, d := testutils.ParseURI("http://a"), testutils.ParseURI("http://b"), testutils.ParseURI("http://d")
+	c.Assert(lb.UpsertServer(a, Weight(3)), IsNil)
+	c.Assert(lb.UpsertServer(b), IsNil)
+
+	c.Assert(lb.SetServers([]ServerSpec{{URL: b, Options: []ServerOption{Weight(2)}}, {URL: d}}), IsNil)
+	c.Assert(lb.Servers(), DeepEquals, []*url.URL{b, d})
+
+	w, ok := lb.ServerWeight(b)
+	c.Assert(ok, Equals, true)
+	c.Assert(w, Equals, 2)
+}
+
+func (s *WatchSuite) TestSetServersBadSpec(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	a, b := testutils.ParseURI("http://a"), testutils.ParseURI("http://b")
+	c.Assert(lb.UpsertServer(a), IsNil)
+
+	c.Assert(lb.SetServers([]ServerSpec{{URL: b}, {URL: nil}}), NotNil)
+	c.Assert(lb.SetServers([]ServerSpec{{URL: b}, {URL: b}}), NotNil)
+	c.Assert(lb.SetServers([]ServerSpec{{URL: b, Options: []ServerOption{Weight(-1)}}}), NotNil)
+
+	// the pool is left untouched
+	c.Assert(lb.Servers(), DeepEquals, []*url.URL{a})
+}
+
+func (s *WatchSuite) TestWatchServers(c *C) {
+	lb, err := New(nil)
+	c.Assert(err, IsNil)
+
+	a, b, d := testutils.ParseURI("http://a"), testutils.ParseURI("http://b"), testutils.ParseURI("http://d")
+
+	ch := make(chan []ServerSpec)
+	lb.WatchServers(ch)
+	defer close(ch)
+
+	states := [][]*url.URL{{a}, {a, b}, {b, d}, {}}
+	for _, state := range states {
+		specs := make([]ServerSpec, len(state))
+		for i, u := range state {
+			specs[i] = ServerSpec{URL: u}
+		}
+		ch <- specs
+		c.Assert(waitForServers(lb, state), Equals, true, Commentf("expected %v, got %v", state, lb.Servers()))
+	}
+}
+
+func waitForServers(lb *RoundRobin, expected []*url.URL) bool {
+	for i := 0; i < 100; i++ {
+		servers := lb.Servers()
+		if len(servers) == len(expected) {
+			same := true
+			for j := range servers {
+				same = same && sameURL(servers[j], expected[j])
+			}
+			if same {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// Backoff computes exponentially growing delays between retry attempts.
+// Delays are randomized by jitter so that retries of concurrent requests do not synchronize into storms.
+type Backoff struct {
+	// Base is the delay before the first retry
+	Base time.Duration
+	// Max caps the delay
+	Max time.Duration
+	// Jitter is the fraction of the delay, in range [0, 1], that is randomized
+	Jitter float64
+	// Clock is used to wait between the attempts, real time is used if not set
+	Clock timetools.TimeProvider
+}
+
+// NewBackoff returns backoff doubling the delay starting from base up to max
+func NewBackoff(base, max time.Duration, jitter float64) (*Backoff, error) {
+	if base < 0 {
+		return nil, fmt.Errorf("base should be >= 0, got %v", base)
+	}
+	if max < base {
+		return nil, fmt.Errorf("max should be >= base, got %v < %v", max, base)
+	}
+	if jitter < 0 || jitter > 1 {
+		return nil, fmt.Errorf("jitter should be in range [0, 1], got %v", jitter)
+	}
+	return &Backoff{Base: base, Max: max, Jitter: jitter}, nil
+}
+
+// Delay returns the delay before the given retry, retries are counted from 1
+func (b *Backoff) Delay(retry int) time.Duration {
+	d := b.Base
+	for i := 1; i < retry && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * b.Jitter * float64(d))
+	}
+	return d
+}
+
+// Wait sleeps for the delay before the given retry. It returns false if the context
+// was done before the delay has passed.
+func (b *Backoff) Wait(ctx context.Context, retry int) bool {
+	d := b.Delay(retry)
+	if d <= 0 {
+		return true
+	}
+	clock := b.Clock
+	if clock == nil {
+		clock = &timetools.RealTime{}
+	}
+	select {
+	case <-clock.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
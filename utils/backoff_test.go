@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type BackoffSuite struct{}
+
+var _ = Suite(&BackoffSuite{})
+
+func (s *BackoffSuite) TestGrowth(c *C) {
+	b, err := NewBackoff(10*time.Millisecond, 100*time.Millisecond, 0)
+	c.Assert(err, IsNil)
+
+	c.Assert(b.Delay(1), Equals, 10*time.Millisecond)
+	c.Assert(b.Delay(2), Equals, 20*time.Millisecond)
+	c.Assert(b.Delay(3), Equals, 40*time.Millisecond)
+	c.Assert(b.Delay(4), Equals, 80*time.Millisecond)
+	c.Assert(b.Delay(5), Equals, 100*time.Millisecond)
+	c.Assert(b.Delay(100), Equals, 100*time.Millisecond)
+}
+
+func (s *BackoffSuite) TestJitter(c *C) {
+	b, err := NewBackoff(100*time.Millisecond, time.Second, 0.5)
+	c.Assert(err, IsNil)
+
+	distinct := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		d := b.Delay(2)
+		c.Assert(d >= 100*time.Millisecond && d <= 200*time.Millisecond, Equals, true, Commentf("delay %v", d))
+		distinct[d] = true
+	}
+	c.Assert(len(distinct) > 1, Equals, true)
+}
+
+func (s *BackoffSuite) TestWaitCancelled(c *C) {
+	b, err := NewBackoff(time.Hour, time.Hour, 0)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(b.Wait(ctx, 1), Equals, false)
+
+	b, err = NewBackoff(time.Millisecond, time.Millisecond, 0)
+	c.Assert(err, IsNil)
+	c.Assert(b.Wait(context.Background(), 1), Equals, true)
+}
+
+func (s *BackoffSuite) TestBadParameters(c *C) {
+	_, err := NewBackoff(-1, time.Second, 0)
+	c.Assert(err, NotNil)
+
+	_, err = NewBackoff(time.Second, time.Millisecond, 0)
+	c.Assert(err, NotNil)
+
+	_, err = NewBackoff(time.Millisecond, time.Second, 1.5)
+	c.Assert(err, NotNil)
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync/atomic"
 )
 
 type ErrorHandler interface {
@@ -36,3 +37,28 @@ type ErrorHandlerFunc func(http.ResponseWriter, *http.Request, error)
 func (f ErrorHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request, err error) {
 	f(w, r, err)
 }
+
+// SwappableErrorHandler delegates to an error handler that can be swapped
+// while serving requests, e.g. to flip to a maintenance handler
+type SwappableErrorHandler struct {
+	v atomic.Value
+}
+
+type errorHandlerBox struct {
+	h ErrorHandler
+}
+
+func NewSwappableErrorHandler(h ErrorHandler) *SwappableErrorHandler {
+	s := &SwappableErrorHandler{}
+	s.Set(h)
+	return s
+}
+
+// Set atomically replaces the error handler
+func (s *SwappableErrorHandler) Set(h ErrorHandler) {
+	s.v.Store(errorHandlerBox{h})
+}
+
+func (s *SwappableErrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	s.v.Load().(errorHandlerBox).h.ServeHTTP(w, req, err)
+}
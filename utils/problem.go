@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// StatusCoder is implemented by errors that define the status code of the response
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// Problem is a machine-readable error document as defined by RFC 7807
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ProblemHandler is an error handler replying with application/problem+json documents.
+// Problem types are relative to BaseType, e.g. BaseType + "/upstream-timeout".
+type ProblemHandler struct {
+	BaseType string
+}
+
+func (h *ProblemHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	p := h.Problem(err)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// Problem maps the error to the problem document. Details of the network errors are not
+// included, as they would expose the addresses of the upstream servers.
+func (h *ProblemHandler) Problem(err error) *Problem {
+	var status int
+	var kind, detail string
+	if e, ok := err.(net.Error); ok {
+		if e.Timeout() {
+			status, kind, detail = http.StatusGatewayTimeout, "upstream-timeout", "The upstream server did not respond in time"
+		} else {
+			status, kind, detail = http.StatusBadGateway, "upstream-unavailable", "The upstream server could not be reached"
+		}
+	} else if err == io.EOF {
+		status, kind, detail = http.StatusBadGateway, "upstream-unavailable", "The upstream server closed the connection"
+	} else if e, ok := err.(StatusCoder); ok {
+		status, detail = e.StatusCode(), err.Error()
+		kind = strings.ToLower(strings.Replace(http.StatusText(status), " ", "-", -1))
+	} else {
+		status, kind = http.StatusInternalServerError, "internal-error"
+	}
+	return &Problem{
+		Type:   strings.TrimSuffix(h.BaseType, "/") + "/" + kind,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
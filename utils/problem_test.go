@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProblemSuite struct{}
+
+var _ = Suite(&ProblemSuite{})
+
+type statusErr int
+
+func (e statusErr) Error() string   { return "rejected" }
+func (e statusErr) StatusCode() int { return int(e) }
+
+func (s *ProblemSuite) TestProblems(c *C) {
+	_, dialErr := net.DialTimeout("tcp", "localhost:0", time.Second)
+	c.Assert(dialErr, NotNil)
+
+	h := &ProblemHandler{BaseType: "https://example.com/problems/"}
+	cases := []struct {
+		err      error
+		expected Problem
+	}{
+		{
+			err:      dialErr,
+			expected: Problem{Type: "https://example.com/problems/upstream-unavailable", Title: "Bad Gateway", Status: 502, Detail: "The upstream server could not be reached"},
+		},
+		{
+			err:      &net.DNSError{IsTimeout: true},
+			expected: Problem{Type: "https://example.com/problems/upstream-timeout", Title: "Gateway Timeout", Status: 504, Detail: "The upstream server did not respond in time"},
+		},
+		{
+			err:      statusErr(http.StatusServiceUnavailable),
+			expected: Problem{Type: "https://example.com/problems/service-unavailable", Title: "Service Unavailable", Status: 503, Detail: "rejected"},
+		},
+		{
+			err:      fmt.Errorf("oops"),
+			expected: Problem{Type: "https://example.com/problems/internal-error", Title: "Internal Server Error", Status: 500},
+		},
+	}
+	for _, tc := range cases {
+		buf := &bytes.Buffer{}
+		w := NewBufferWriter(NopWriteCloser(buf))
+		h.ServeHTTP(w, nil, tc.err)
+		c.Assert(w.Code, Equals, tc.expected.Status)
+		c.Assert(w.Header().Get("Content-Type"), Equals, "application/problem+json")
+
+		var p Problem
+		c.Assert(json.Unmarshal(buf.Bytes(), &p), IsNil)
+		c.Assert(p, DeepEquals, tc.expected)
+	}
+}